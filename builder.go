@@ -2,18 +2,24 @@ package kuysor
 
 import (
 	"fmt"
-	"slices"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/redhajuanda/kuysor/modifier"
 )
 
 type builder struct {
-	ks     *Kuysor
-	sqlMod *modifier.SQLModifier
+	ks          *Kuysor
+	sqlMod      *modifier.SQLModifier
+	injected    []any             // values of the placeholders injected by kuysor, see arg
+	mainColumns map[string]string // sort columns of the main query as output by a UNION, see wrapMainUnion
+	cteColumns  map[string]string // sort columns of the primary CTE or derived table, see targetColumnMap
+	having      bool              // the cursor condition goes into HAVING, see appendCursorWhere
 }
 
 func newBuilder(ks *Kuysor) *builder {
-	return &builder{ks, &modifier.SQLModifier{}}
+	return &builder{ks: ks, sqlMod: &modifier.SQLModifier{}}
 }
 
 func (b *builder) build() (string, error) {
@@ -24,12 +30,42 @@ func (b *builder) build() (string, error) {
 		vSorts  *vSorts  = b.ks.vTabling.vSorts
 	)
 
-	b.sqlMod = modifier.NewSQLModifier(b.ks.sql)
+	limitSyntax, err := modifierLimitSyntax(b.ks.options.limitSyntax(), vCursor == nil && vOffset != nil)
+	if err != nil {
+		return "", err
+	}
 
-	// when the user has specified a CTE to target, tell the modifier so that
-	// all subsequent WHERE / ORDER BY / LIMIT calls operate on that CTE body
+	clausePolicy, err := modifierClausePolicy(b.ks.options.ClausePolicy)
+	if err != nil {
+		return "", err
+	}
+
+	b.sqlMod = modifier.NewSQLModifier(b.ks.query())
+	b.sqlMod.SetLimitSyntax(limitSyntax)
+	b.sqlMod.SetClausePolicy(clausePolicy)
+	if b.ks.options.Dialect != nil {
+		b.sqlMod.SetGrammar(b.ks.options.Dialect.Clauses())
+	}
+	b.sqlMod.SetPreserveFormatting(b.ks.options.Format == Preserve)
+
+	// when the user has specified a CTE or derived table to target, tell the
+	// modifier so that all subsequent WHERE / ORDER BY / LIMIT calls operate on its body
 	if b.ks.uTabling != nil && b.ks.uTabling.uPaging != nil && b.ks.uTabling.uPaging.CTETarget != "" {
-		b.sqlMod.SetCTETarget(b.ks.uTabling.uPaging.CTETarget)
+		b.setPrimaryTarget()
+		if b.cteColumns, err = b.targetColumnMap(b.ks.uTabling.uPaging.CTEOptions); err != nil {
+			return "", err
+		}
+		if err := b.setTargetHaving(); err != nil {
+			return "", err
+		}
+	} else if (vCursor != nil || vOffset != nil || vSorts != nil) && b.sqlMod.HasMainUnion() {
+		if err := b.wrapMainUnion(); err != nil {
+			return "", err
+		}
+	} else if vSorts != nil {
+		if err := b.setMainColumns(); err != nil {
+			return "", err
+		}
 	}
 
 	if vCursor != nil {
@@ -49,22 +85,91 @@ func (b *builder) build() (string, error) {
 		}
 	}
 
+	if up := b.ks.uTabling.uPaging; up != nil && up.Locking != NoLock {
+		if err := b.sqlMod.SetLock(up.Locking.clause()); err != nil {
+			return "", err
+		}
+	}
+
 	res, err := b.sqlMod.Build()
 	if err != nil {
 		return "", err
 	}
 
-	return b.sanitizeQuery(res), nil
+	res, err = b.sanitizeQuery(res)
+	if err != nil {
+		return "", err
+	}
+
+	if b.ks.options.Format == Pretty {
+		res = modifier.Pretty(res)
+	}
+
+	return res, nil
 }
 
 // sanitizeQuery sanitizes the query.
-func (b *builder) sanitizeQuery(query string) string {
+func (b *builder) sanitizeQuery(query string) (string, error) {
+
+	var (
+		placeHolderType = b.ks.options.placeHolderType()
+		err             error
+	)
+
+	query = b.resolveInjectedArgs(query)
+	namedOutput := b.ks.namedArgs != nil && b.ks.namedOutput
+	query, b.ks.args, err = b.ks.marked.render(query, b.ks.vArgs, b.ks.marked.prefix(placeHolderType), namedOutput, b.ks.options.ExpandSlices)
+	if err != nil || namedOutput {
+		return query, err
+	}
 
-	ord := findOrderOfInternalPlaceholders(query)
-	for i, o := range ord {
-		b.ks.uArgs = slices.Insert[[]any](b.ks.uArgs, o, b.ks.vArgs[i])
+	if b.ks.options.ExpandSlices {
+		query, b.ks.args, err = expandSliceArgs(query, b.ks.args)
+		if err != nil {
+			return "", err
+		}
 	}
-	return replacePlaceholders(query, b.ks.options.PlaceHolderType)
+
+	return replacePlaceholders(query, placeHolderType), nil
+
+}
+
+// injectedArgRe matches the markers returned by arg.
+var injectedArgRe = regexp.MustCompile(`\bkuysor_varg_(\d+)\b`)
+
+// arg records value and returns a numbered marker to write in place of its
+// placeholder. The markers are resolved by resolveInjectedArgs from their
+// positions in the final SQL, so the args bind correctly whatever the order the
+// clauses were injected in: a secondary CTE defined after the primary one, a
+// condition mirrored on the main query, or a dialect that puts the clause before
+// placeholders injected earlier (e.g. "SELECT TOP (?)", or "OFFSET ? ROWS" in
+// front of "FETCH NEXT ? ROWS ONLY"). A marker dropped while the query is
+// rewritten drops its arg too.
+func (b *builder) arg(value any) string {
+
+	b.injected = append(b.injected, value)
+	return fmt.Sprintf("kuysor_varg_%d", len(b.injected)-1)
+
+}
+
+// injectArg calls set with the marker of value, see arg.
+func (b *builder) injectArg(set func(string) error, value any) error {
+	return set(b.arg(value))
+}
+
+// resolveInjectedArgs replaces the markers of arg with the internal placeholder and
+// sets vArgs to their values, in placeholder string order.
+func (b *builder) resolveInjectedArgs(query string) string {
+
+	markers := injectedArgRe.FindAllStringSubmatchIndex(query, -1)
+
+	b.ks.vArgs = make([]any, 0, len(markers))
+	for _, marker := range markers {
+		idx, _ := strconv.Atoi(query[marker[2]:marker[3]])
+		b.ks.vArgs = append(b.ks.vArgs, b.injected[idx])
+	}
+
+	return injectedArgRe.ReplaceAllLiteralString(query, defaultInternalPlaceHolder)
 
 }
 
@@ -84,63 +189,33 @@ func (b *builder) handlePagination() (err error) {
 func (b *builder) handlePaginationCursor() (err error) {
 
 	var (
-		vCursor    = b.ks.vTabling.vCursor
-		cursorArgs []any
+		vCursor = b.ks.vTabling.vCursor
 	)
 
-	// Inject secondary CTE bodies first. They are defined before the primary CTE
-	// in the WITH clause, so their cursor WHERE / ORDER BY / LIMIT placeholders
-	// appear earliest in the SQL string and their args must be appended first.
-	// ORDER BY uses the same (possibly reversed) sort direction and limit+1 as the
-	// primary; the cursor WHERE is only applied beyond the first page.
+	// Inject the secondary CTE bodies. ORDER BY uses the same (possibly reversed)
+	// sort direction and limit as the primary; the cursor WHERE is only applied
+	// beyond the first page.
 	if b.hasSecondaryCTEs() && b.ks.vTabling.vSorts != nil {
 		secSorts := *b.ks.vTabling.vSorts
 		if vCursor != nil && vCursor.Prefix.isPrev() {
 			secSorts = b.ks.vTabling.vSorts.reverseDirection()
 		}
-		if err = b.applySecondaryCTEs(secSorts, b.ks.uTabling.uPaging.Limit+1, vCursor != nil && vCursor.cursor != ""); err != nil {
+		if err = b.applySecondaryCTEs(secSorts, b.cursorLimit(), b.hasCursorWhere()); err != nil {
 			return err
 		}
 	}
 
 	// if cursor is not empty, it means it is not the first page
 	// so we need to apply where clause
-	if vCursor != nil && vCursor.cursor != "" {
-		// snapshot vArgs length before WHERE so we can identify the cursor args
-		vArgsBefore := len(b.ks.vArgs)
+	if b.hasCursorWhere() {
 		err = b.applyWhere()
 		if err != nil {
 			return err
 		}
-		// capture the args added by applyWhere (cursor values)
-		if len(b.ks.vArgs) > vArgsBefore {
-			cursorArgs = make([]any, len(b.ks.vArgs)-vArgsBefore)
-			copy(cursorArgs, b.ks.vArgs[vArgsBefore:])
-		}
 	}
 
 	// apply limit and sorts
-	if err = b.applyLimitAndSorts(); err != nil {
-		return err
-	}
-
-	// When WHERE mode is CTETargetModeBoth, the cursor WHERE condition is placed
-	// in both the CTE body (early in the string) and the main query (late in the
-	// string, after LIMIT). The internal placeholder for the main WHERE therefore
-	// appears AFTER the LIMIT placeholder in the final SQL string, so we append
-	// the cursor arg(s) now — after limit+1 was added — to keep vArgs aligned
-	// with placeholder string order: [CTE WHERE, CTE LIMIT, main WHERE].
-	if len(cursorArgs) > 0 && b.ks.uTabling != nil && b.ks.uTabling.uPaging != nil && b.ks.uTabling.uPaging.CTETarget != "" {
-		var opts *CTEOptions
-		if b.ks.uTabling.uPaging.CTEOptions != nil {
-			opts = b.ks.uTabling.uPaging.CTEOptions
-		}
-		if effectiveWhereMode(opts) == CTETargetModeBoth {
-			b.ks.vArgs = append(b.ks.vArgs, cursorArgs...)
-		}
-	}
-
-	return nil
+	return b.applyLimitAndSorts()
 
 }
 
@@ -151,31 +226,16 @@ func (b *builder) handlePaginationOffset() (err error) {
 		vSorts  = b.ks.vTabling.vSorts
 	)
 
-	// Inject secondary CTE bodies first (defined before the primary CTE). For
-	// offset pagination secondaries receive ORDER BY + LIMIT only (no OFFSET, no
-	// WHERE) as a coarse early cap; the primary CTE/main query still applies the
-	// exact offset window. Requires an ORDER BY (the column the LIMIT is meaningful on).
+	// Inject the secondary CTE bodies. For offset pagination secondaries receive
+	// ORDER BY + LIMIT only (no OFFSET, no WHERE) as a coarse early cap; the
+	// primary CTE/main query still applies the exact offset window. Requires an
+	// ORDER BY (the column the LIMIT is meaningful on).
 	if b.hasSecondaryCTEs() && vSorts != nil {
 		if err = b.applySecondaryCTEs(*vSorts, b.ks.uTabling.uPaging.Limit, false); err != nil {
 			return err
 		}
 	}
 
-	// When LIMIT/OFFSET mode is CTETargetModeBoth we must interleave args in
-	// string-position order: CTE_LIMIT, CTE_OFFSET, main_LIMIT, main_OFFSET.
-	// Delegating to applyLimit/applyOffset would produce the wrong order
-	// ([limit,limit,offset,offset] instead of [limit,offset,limit,offset]),
-	// so handle this case explicitly at this level.
-	if b.ks.uTabling.uPaging.CTETarget != "" {
-		var opts *CTEOptions
-		if b.ks.uTabling.uPaging.CTEOptions != nil {
-			opts = b.ks.uTabling.uPaging.CTEOptions
-		}
-		if effectiveLimitOffsetMode(opts) == CTETargetModeBoth {
-			return b.handlePaginationOffsetBoth(vOffset, vSorts)
-		}
-	}
-
 	err = b.applyLimit()
 	if err != nil {
 		return err
@@ -199,97 +259,50 @@ func (b *builder) handlePaginationOffset() (err error) {
 
 }
 
-// handlePaginationOffsetBoth handles the CTETargetModeBoth case for offset pagination.
-// It writes CTE modifications first, then main-query modifications, so that vArgs
-// stays aligned with the internal-placeholder string-position order:
-// [CTE LIMIT, CTE OFFSET, main LIMIT, main OFFSET].
-func (b *builder) handlePaginationOffsetBoth(vOffset *vOffset, vSorts *vSorts) error {
-
-	limit := b.ks.uTabling.uPaging.Limit
-
-	// ── CTE phase ──────────────────────────────────────────────────────────────
-	if err := b.sqlMod.SetLimit(defaultInternalPlaceHolder); err != nil {
-		return err
-	}
-	b.ks.vArgs = append(b.ks.vArgs, limit)
-
-	if vOffset != nil {
-		if err := b.sqlMod.SetOffset(defaultInternalPlaceHolder); err != nil {
-			return err
-		}
-		b.ks.vArgs = append(b.ks.vArgs, vOffset.Offset)
-	}
-
-	if vSorts != nil {
-		if err := b.applySorts(vSorts); err != nil {
-			return err
-		}
-	}
-
-	// ── Main phase ─────────────────────────────────────────────────────────────
-	if err := b.sqlMod.SetLimitMain(defaultInternalPlaceHolder); err != nil {
-		return err
-	}
-	b.ks.vArgs = append(b.ks.vArgs, limit)
-
-	if vOffset != nil {
-		if err := b.sqlMod.SetOffsetMain(defaultInternalPlaceHolder); err != nil {
-			return err
-		}
-		b.ks.vArgs = append(b.ks.vArgs, vOffset.Offset)
-	}
-
-	return nil
-
-}
-
 // applyWhere applies the where clause to the sql query.
 func (b *builder) applyWhere() (err error) {
 
 	// When no CTE target is set, always route to main query.
 	if b.ks.uTabling.uPaging.CTETarget == "" {
-		condition, err := b.buildCondition(nil, true)
+		condition, err := b.buildCondition(b.mainColumns)
 		if err != nil {
 			return err
 		}
-		return b.sqlMod.AppendWhere(condition)
+		return b.appendCursorWhere(condition)
 	}
 
 	var opts *CTEOptions
 	if b.ks.uTabling.uPaging.CTEOptions != nil {
 		opts = b.ks.uTabling.uPaging.CTEOptions
 	}
-	colMap := cteColumnMap(opts)
+	colMap := b.cteColumns
 
 	switch effectiveWhereMode(opts) {
 	case CTETargetModeCTE:
-		// CTE body uses the remapped column; this is the single arg-producing build.
-		condition, err := b.buildCondition(colMap, true)
+		// CTE body uses the remapped column.
+		condition, err := b.buildCondition(colMap)
 		if err != nil {
 			return err
 		}
-		return b.sqlMod.AppendWhere(condition)
+		return b.appendCursorWhere(condition)
 	case CTETargetModeMain:
-		condition, err := b.buildCondition(nil, true)
+		condition, err := b.buildCondition(nil)
 		if err != nil {
 			return err
 		}
 		return b.sqlMod.AppendWhereMain(condition)
 	case CTETargetModeBoth:
-		// CTE placement uses the remapped column and produces the cursor args.
-		// Main placement keeps the original column and must NOT append args again —
-		// its args are re-appended by handlePaginationCursor AFTER applyLimitAndSorts
-		// runs, to keep vArgs aligned with placeholder string order. With a nil map
-		// both conditions are identical, preserving previous behavior exactly.
-		cteCond, err := b.buildCondition(colMap, true)
+		// CTE placement uses the remapped column; main placement keeps the original
+		// column. Each condition binds its own copy of the cursor values.
+		cteCond, err := b.buildCondition(colMap)
 		if err != nil {
 			return err
 		}
-		mainCond, err := b.buildCondition(nil, false)
+		mainCond, err := b.buildCondition(nil)
 		if err != nil {
 			return err
 		}
-		if err := b.sqlMod.AppendWhere(cteCond); err != nil {
+		if err := b.appendCursorWhere(cteCond); err != nil {
 			return err
 		}
 		return b.sqlMod.AppendWhereMain(mainCond)
@@ -298,37 +311,268 @@ func (b *builder) applyWhere() (err error) {
 
 }
 
-// buildCondition constructs the cursor WHERE condition string. colMap (when
-// non-nil) remaps columns to their CTE-body equivalents; appendArgs controls
-// whether the cursor values are appended to vArgs (set false for a secondary
-// rendering of the same condition to avoid duplicating args).
-func (b *builder) buildCondition(colMap map[string]string, appendArgs bool) (string, error) {
+// appendCursorWhere appends the cursor condition to the WHERE clause of the target
+// of the modifier, or to its HAVING clause when the sort is on an aggregate (see
+// WithAggregateSort).
+func (b *builder) appendCursorWhere(condition string) error {
+	if b.having {
+		return b.sqlMod.AppendHaving(condition)
+	}
+	return b.sqlMod.AppendWhere(condition)
+}
+
+// setMainColumns renders the sort keys of the main query as their expressions
+// (see WithSortExpr and WithAggregateSort). A cursor page sorted by an aggregate puts its condition
+// into HAVING, or, when the query has no GROUP BY, wraps the query so that the
+// condition filters the columns of the derived table, by their unqualified names.
+func (b *builder) setMainColumns() error {
+
+	var (
+		vSorts    = *b.ks.vTabling.vSorts
+		aggregate = vSorts.hasAggregate() && b.ks.vTabling.vCursor != nil
+	)
+
+	if aggregate {
+		grouped, err := b.sqlMod.HasGroupBy()
+		if err != nil {
+			return err
+		}
+		if !grouped {
+			b.sqlMod.WrapMain()
+			b.mainColumns = make(map[string]string, len(vSorts))
+			for _, vSort := range vSorts {
+				_, column, err := vSort.extractColumn()
+				if err != nil {
+					return err
+				}
+				b.mainColumns[vSort.column] = column
+			}
+			return nil
+		}
+	}
 
-	exprs, err := b.constructExprs(colMap, appendArgs)
+	b.mainColumns = vSorts.exprColumns(nil)
+	b.having = aggregate
+	return nil
+
+}
+
+// setTargetHaving makes a cursor page sorted by an aggregate put its condition into
+// the HAVING clause of the primary CTE or derived table, which must group its rows.
+func (b *builder) setTargetHaving() error {
+
+	vSorts := b.ks.vTabling.vSorts
+	if vSorts == nil || !vSorts.hasAggregate() || b.ks.vTabling.vCursor == nil {
+		return nil
+	}
+
+	grouped, err := b.sqlMod.HasGroupBy()
+	if err != nil {
+		return err
+	}
+	if !grouped {
+		return fmt.Errorf("sorting by an aggregate requires a GROUP BY in %s", b.ks.uTabling.uPaging.CTETarget)
+	}
+	b.having = true
+	return nil
+
+}
+
+// hasCursorWhere reports whether the cursor WHERE condition is applied: beyond the
+// first page, or on every page in stable shape mode.
+func (b *builder) hasCursorWhere() bool {
+	vCursor := b.ks.vTabling.vCursor
+	return vCursor != nil && (vCursor.cursor != "" || b.ks.options.StableShape)
+}
+
+// buildCondition constructs the cursor WHERE condition string. In stable shape
+// mode (see Options.StableShape) it holds the keyset conditions of both
+// directions behind a bound direction d, "(d IS NULL OR (d = 0 AND <next>) OR
+// (d = 1 AND <prev>))", where d is NULL on the first page, 0 on next pages and 1
+// on previous pages, so every page renders the same SQL.
+// colMap behaves as in buildKeysetCondition.
+func (b *builder) buildCondition(colMap map[string]string) (string, error) {
+
+	vCursor := b.ks.vTabling.vCursor
+	if !b.ks.options.StableShape {
+		return b.buildKeysetCondition(vCursor.Prefix, colMap)
+	}
+
+	next, err := b.buildKeysetCondition(cursorPrefixNext, colMap)
+	if err != nil {
+		return "", err
+	}
+	prev, err := b.buildKeysetCondition(cursorPrefixPrev, colMap)
 	if err != nil {
 		return "", err
 	}
 
-	if len(exprs) == 1 {
-		return exprs[0].Expression, nil
+	var direction any
+	if vCursor.cursor != "" {
+		direction = b.prevFlag()
+	}
+
+	return fmt.Sprintf("(%s IS NULL OR (%s = 0 AND %s) OR (%s = 1 AND %s))",
+		b.flag(direction), b.flag(direction), next, b.flag(direction), prev), nil
+}
+
+// prevFlag returns 1 on previous pages and 0 otherwise.
+func (b *builder) prevFlag() int {
+	if b.ks.vTabling.vCursor.Prefix.isPrev() {
+		return 1
 	}
-	return modifier.NewNestedCondition("OR", exprs...).Expression, nil
+	return 0
 }
 
-// constructExprs constructs the expressions.
-func (b *builder) constructExprs(colMap map[string]string, appendArgs bool) (expr []modifier.SQLCondition, err error) {
+// flag binds value, a 0 / 1 flag or nil, with arg and casts its placeholder to
+// DECIMAL, a type every supported database can cast to, so that the type of the
+// parameter is known even where it is only compared with NULL.
+func (b *builder) flag(value any) string {
+	return fmt.Sprintf("CAST(%s AS DECIMAL)", b.arg(value))
+}
+
+// buildKeysetCondition constructs the keyset part of the cursor WHERE condition
+// for the page direction of prefix. colMap (when non-nil) remaps columns to their
+// CTE-body equivalents. The cursor values are bound through arg, once per
+// rendering of the condition.
+func (b *builder) buildKeysetCondition(prefix cursorPrefix, colMap map[string]string) (string, error) {
+
+	var guard *modifier.SQLCondition
+	if b.canUseRangeGuard() {
+		g, err := b.constructRangeGuard(prefix, colMap)
+		if err != nil {
+			return "", err
+		}
+		guard = &g
+	}
+
+	var condition modifier.SQLCondition
+	if b.canUseRowValues() {
+		expr, err := b.constructRowValueExpr(prefix, colMap)
+		if err != nil {
+			return "", err
+		}
+		condition = modifier.NewCondition(expr)
+	} else {
+		exprs, err := b.constructExprs(prefix, colMap)
+		if err != nil {
+			return "", err
+		}
+		condition = modifier.NewNestedCondition("OR", exprs...)
+		if len(exprs) == 1 {
+			condition = exprs[0]
+		}
+	}
+
+	if guard != nil {
+		return modifier.NewNestedCondition("AND", *guard, condition).Expression, nil
+	}
+	return condition.Expression, nil
+}
+
+// canUseRangeGuard reports whether the cursor condition gets a leading-column range
+// guard (see Options.RangeGuard). The guard is only added to multi-column sorts
+// whose first column is not nullable and has a cursor value.
+func (b *builder) canUseRangeGuard() bool {
 
 	var (
-		vSorts  = b.ks.vTabling.vSorts
+		vSorts  = *b.ks.vTabling.vSorts
+		vCursor = b.ks.vTabling.vCursor
+	)
+
+	if !b.ks.options.RangeGuard || len(vSorts) < 2 || vSorts[0].isNullable() {
+		return false
+	}
+
+	_, column, err := vSorts[0].extractColumn()
+	return err == nil && (vCursor.Cols[column] != nil || b.ks.options.StableShape)
+}
+
+// constructRangeGuard constructs the redundant range predicate on the first sort
+// column, e.g. "a >= ?" in front of "(a > ?) OR (a = ? AND b > ?)", which lets
+// MySQL turn the condition into an index range scan.
+// colMap behaves as in constructCompExpr.
+func (b *builder) constructRangeGuard(prefix cursorPrefix, colMap map[string]string) (modifier.SQLCondition, error) {
+
+	var (
+		vSort    = (*b.ks.vTabling.vSorts)[0]
+		operator = b.getOperator(prefix, &vSort) + "="
+	)
+
+	return b.constructCompExpr(&vSort, operator, colMap)
+}
+
+// canUseRowValues reports whether the cursor condition can be rendered as a single
+// row-value comparison, e.g. (a, b) > (?, ?). That needs a dialect that supports
+// row values and a multi-column sort with one direction, no nullable column and a
+// cursor value for every column.
+func (b *builder) canUseRowValues() bool {
+
+	var (
+		dialect = b.ks.options.Dialect
+		vSorts  = *b.ks.vTabling.vSorts
 		vCursor = b.ks.vTabling.vCursor
-		exprs   = make([]modifier.SQLCondition, 0)
+	)
+
+	if dialect == nil || !dialect.SupportsRowValues() || len(vSorts) < 2 {
+		return false
+	}
+
+	for _, vSort := range vSorts {
+		if vSort.isNullable() || vSort.direction != vSorts[0].direction {
+			return false
+		}
+		_, column, err := vSort.extractColumn()
+		if err != nil || vCursor.Cols[column] == nil && !b.ks.options.StableShape {
+			return false
+		}
+	}
+
+	return true
+}
+
+// constructRowValueExpr constructs the row-value comparison, e.g. (a, b) > (?, ?).
+// colMap behaves as in constructCompExpr.
+func (b *builder) constructRowValueExpr(prefix cursorPrefix, colMap map[string]string) (string, error) {
+
+	var (
+		vSorts       = *b.ks.vTabling.vSorts
+		vCursor      = b.ks.vTabling.vCursor
+		columns      = make([]string, 0, len(vSorts))
+		placeholders = make([]string, 0, len(vSorts))
+		operator     = b.getOperator(prefix, &vSorts[0])
+	)
+
+	for _, vSort := range vSorts {
+		_, column, err := vSort.extractColumn()
+		if err != nil {
+			return "", err
+		}
+
+		columns = append(columns, renderColumn(vSort.column, colMap))
+		placeholders = append(placeholders, b.arg(vCursor.Cols[column]))
+	}
+
+	return fmt.Sprintf("(%s) %s (%s)", strings.Join(columns, ", "), operator, strings.Join(placeholders, ", ")), nil
+}
+
+// constructExprs constructs the expressions for the page direction of prefix.
+func (b *builder) constructExprs(prefix cursorPrefix, colMap map[string]string) (expr []modifier.SQLCondition, err error) {
+
+	if b.ks.options.StableShape {
+		return b.constructStableExprs(prefix, colMap)
+	}
+
+	var (
+		vSorts = b.ks.vTabling.vSorts
+		exprs  = make([]modifier.SQLCondition, 0)
 	)
 
 	for i, vSort := range *vSorts {
 
 		var (
 			expr     = make([]modifier.SQLCondition, 0)
-			operator = b.getOperator(vCursor.Prefix, &vSort)
+			operator = b.getOperator(prefix, &vSort)
 		)
 
 		// get cursor value
@@ -337,8 +581,8 @@ func (b *builder) constructExprs(colMap map[string]string, appendArgs bool) (exp
 			return nil, err
 		}
 
-		if col != nil && vCursor.Prefix.isNext() && vSort.isNullable() && vSort.isAsc() ||
-			col != nil && vCursor.Prefix.isPrev() && vSort.isNullable() && vSort.isDesc() {
+		if col != nil && prefix.isNext() && vSort.isNullable() && vSort.isAsc() ||
+			col != nil && prefix.isPrev() && vSort.isNullable() && vSort.isDesc() {
 			// construct IS NULL expression
 			e, err := b.constructIsExpr(&vSort, "NULL", colMap)
 			if err != nil {
@@ -347,8 +591,8 @@ func (b *builder) constructExprs(colMap map[string]string, appendArgs bool) (exp
 			exprs = append(exprs, e)
 		}
 
-		if col == nil && vCursor.Prefix.isPrev() && vSort.nullable && vSort.isAsc() ||
-			col == nil && vCursor.Prefix.isNext() && vSort.nullable && vSort.isDesc() {
+		if col == nil && prefix.isPrev() && vSort.nullable && vSort.isAsc() ||
+			col == nil && prefix.isNext() && vSort.nullable && vSort.isDesc() {
 			// construct IS NOT NULL expression
 			e, err := b.constructIsExpr(&vSort, "NOT NULL", colMap)
 			if err != nil {
@@ -382,7 +626,7 @@ func (b *builder) constructExprs(colMap map[string]string, appendArgs bool) (exp
 					}
 					expr = append(expr, e)
 				} else {
-					e, err := b.constructCompExpr(&vSort2, "=", colMap, appendArgs)
+					e, err := b.constructCompExpr(&vSort2, "=", colMap)
 					if err != nil {
 						return nil, err
 					}
@@ -390,7 +634,7 @@ func (b *builder) constructExprs(colMap map[string]string, appendArgs bool) (exp
 				}
 
 			} else {
-				e, err := b.constructCompExpr(&vSort2, operator, colMap, appendArgs)
+				e, err := b.constructCompExpr(&vSort2, operator, colMap)
 				if err != nil {
 					return nil, err
 				}
@@ -407,11 +651,81 @@ func (b *builder) constructExprs(colMap map[string]string, appendArgs bool) (exp
 	return exprs, nil
 }
 
+// constructStableExprs constructs the expressions of the stable shape mode, whose
+// shape doesn't depend on which cursor values are NULL: every column is compared
+// through constructNullSafeExpr.
+func (b *builder) constructStableExprs(prefix cursorPrefix, colMap map[string]string) ([]modifier.SQLCondition, error) {
+
+	var (
+		vSorts = *b.ks.vTabling.vSorts
+		exprs  = make([]modifier.SQLCondition, 0, len(vSorts))
+	)
+
+	for i := range vSorts {
+
+		expr := make([]modifier.SQLCondition, 0, i+1)
+		for j := 0; j <= i; j++ {
+
+			operator := "="
+			if j == i {
+				operator = b.getOperator(prefix, &vSorts[i])
+			}
+
+			e, err := b.constructNullSafeExpr(&vSorts[j], operator, colMap)
+			if err != nil {
+				return nil, err
+			}
+			expr = append(expr, e)
+		}
+
+		exprs = append(exprs, modifier.NewNestedCondition("AND", expr...))
+	}
+
+	return exprs, nil
+}
+
+// constructNullSafeExpr constructs the comparison of a sort column with its
+// cursor value. A nullable column, whose NULLs sort after every value, also
+// matches its NULLs through a bound flag telling whether the cursor value is
+// NULL, e.g. "(a > ? OR (a IS NULL AND CAST(? AS DECIMAL) = 0))".
+func (b *builder) constructNullSafeExpr(vSort *vSort, operator string, colMap map[string]string) (modifier.SQLCondition, error) {
+
+	cnd, err := b.constructCompExpr(vSort, operator, colMap)
+	if err != nil || !vSort.isNullable() {
+		return cnd, err
+	}
+
+	_, column, err := vSort.extractColumn()
+	if err != nil {
+		return modifier.SQLCondition{}, err
+	}
+
+	isNull := 0
+	if b.ks.vTabling.vCursor.Cols[column] == nil {
+		isNull = 1
+	}
+
+	var (
+		rendered = renderColumn(vSort.column, colMap)
+		nulls    string
+	)
+	switch operator {
+	case "=":
+		nulls = fmt.Sprintf("%s IS NULL AND %s = 1", rendered, b.flag(isNull))
+	case ">":
+		nulls = fmt.Sprintf("%s IS NULL AND %s = 0", rendered, b.flag(isNull))
+	case "<":
+		nulls = fmt.Sprintf("%s IS NOT NULL AND %s = 1", rendered, b.flag(isNull))
+	}
+
+	return modifier.NewCondition(fmt.Sprintf("(%s OR (%s))", cnd.Expression, nulls)), nil
+}
+
 func (b *builder) getOperator(prefix cursorPrefix, vSort *vSort) string {
 
 	var (
-		next     = prefix == cursorPrefixNext
-		prev     = !next
+		prev     = prefix.isPrev()
+		next     = !prev
 		operator string
 	)
 
@@ -437,7 +751,8 @@ func (b *builder) getCursorValue(vSort *vSort) (col *string, err error) {
 		return nil, err
 	}
 
-	if vCursor.Cols[column] == nil {
+	// in stable shape mode the first page binds nil, so the value is always bound
+	if vCursor.Cols[column] == nil && !b.ks.options.StableShape {
 		col = nil
 	} else {
 		col = &t
@@ -448,30 +763,19 @@ func (b *builder) getCursorValue(vSort *vSort) (col *string, err error) {
 
 // constructCompExpr constructs the comparison expression.
 // colMap (when non-nil) remaps the rendered column for the CTE body; the cursor
-// value lookup still uses the original column. appendArgs controls whether the
-// cursor value is appended to vArgs (false when re-rendering the same condition).
-func (b *builder) constructCompExpr(vSort *vSort, operator string, colMap map[string]string, appendArgs bool) (cnd modifier.SQLCondition, err error) {
+// value lookup still uses the original column, and its value is bound with arg.
+func (b *builder) constructCompExpr(vSort *vSort, operator string, colMap map[string]string) (cnd modifier.SQLCondition, err error) {
 
 	var (
 		vCursor = b.ks.vTabling.vCursor
 	)
 
-	// get cursor value
-	col, err := b.getCursorValue(vSort)
-	if err != nil {
-		return modifier.SQLCondition{}, err
-	}
-
-	cnd = modifier.NewCondition(fmt.Sprintf("%s %s %s", renderColumn(vSort.column, colMap), operator, *col))
-
 	_, column, err := vSort.extractColumn()
 	if err != nil {
 		return modifier.SQLCondition{}, err
 	}
 
-	if appendArgs {
-		b.ks.vArgs = append(b.ks.vArgs, vCursor.Cols[column])
-	}
+	cnd = modifier.NewCondition(fmt.Sprintf("%s %s %s", renderColumn(vSort.column, colMap), operator, b.arg(vCursor.Cols[column])))
 
 	return cnd, nil
 
@@ -494,10 +798,9 @@ func (b *builder) applyOffset() error {
 
 	// When no CTE target is set, always route to main query.
 	if b.ks.uTabling.uPaging.CTETarget == "" {
-		if err := b.sqlMod.SetOffset(defaultInternalPlaceHolder); err != nil {
+		if err := b.injectArg(b.sqlMod.SetOffset, offset); err != nil {
 			return err
 		}
-		b.ks.vArgs = append(b.ks.vArgs, offset)
 		return nil
 	}
 
@@ -505,18 +808,16 @@ func (b *builder) applyOffset() error {
 	if b.ks.uTabling.uPaging.CTEOptions != nil {
 		opts = b.ks.uTabling.uPaging.CTEOptions
 	}
-	// CTETargetModeBoth is handled at the handlePaginationOffset level.
 	switch effectiveLimitOffsetMode(opts) {
-	case CTETargetModeCTE, CTETargetModeBoth:
-		if err := b.sqlMod.SetOffset(defaultInternalPlaceHolder); err != nil {
-			return err
-		}
-		b.ks.vArgs = append(b.ks.vArgs, offset)
+	case CTETargetModeCTE:
+		return b.injectArg(b.sqlMod.SetOffset, offset)
 	case CTETargetModeMain:
-		if err := b.sqlMod.SetOffsetMain(defaultInternalPlaceHolder); err != nil {
+		return b.injectArg(b.sqlMod.SetOffsetMain, offset)
+	case CTETargetModeBoth:
+		if err := b.injectArg(b.sqlMod.SetOffset, offset); err != nil {
 			return err
 		}
-		b.ks.vArgs = append(b.ks.vArgs, offset)
+		return b.injectArg(b.sqlMod.SetOffsetMain, offset)
 	}
 	return nil
 
@@ -530,10 +831,9 @@ func (b *builder) applyLimit() error {
 
 	// When no CTE target is set, always route to main query.
 	if b.ks.uTabling.uPaging.CTETarget == "" {
-		if err := b.sqlMod.SetLimit(defaultInternalPlaceHolder); err != nil {
+		if err := b.injectArg(b.sqlMod.SetLimit, limit); err != nil {
 			return err
 		}
-		b.ks.vArgs = append(b.ks.vArgs, limit)
 		return nil
 	}
 
@@ -541,18 +841,16 @@ func (b *builder) applyLimit() error {
 	if b.ks.uTabling.uPaging.CTEOptions != nil {
 		opts = b.ks.uTabling.uPaging.CTEOptions
 	}
-	// CTETargetModeBoth is handled at the handlePaginationOffset level.
 	switch effectiveLimitOffsetMode(opts) {
-	case CTETargetModeCTE, CTETargetModeBoth:
-		if err := b.sqlMod.SetLimit(defaultInternalPlaceHolder); err != nil {
-			return err
-		}
-		b.ks.vArgs = append(b.ks.vArgs, limit)
+	case CTETargetModeCTE:
+		return b.injectArg(b.sqlMod.SetLimit, limit)
 	case CTETargetModeMain:
-		if err := b.sqlMod.SetLimitMain(defaultInternalPlaceHolder); err != nil {
+		return b.injectArg(b.sqlMod.SetLimitMain, limit)
+	case CTETargetModeBoth:
+		if err := b.injectArg(b.sqlMod.SetLimit, limit); err != nil {
 			return err
 		}
-		b.ks.vArgs = append(b.ks.vArgs, limit)
+		return b.injectArg(b.sqlMod.SetLimitMain, limit)
 	}
 	return nil
 
@@ -562,7 +860,7 @@ func (b *builder) applyLimit() error {
 func (b *builder) applyLimitAndSorts() error {
 
 	var (
-		limit  = b.ks.uTabling.uPaging.Limit
+		limit  = b.cursorLimit()
 		vSorts = *b.ks.vTabling.vSorts
 	)
 
@@ -575,10 +873,9 @@ func (b *builder) applyLimitAndSorts() error {
 
 	// When no CTE target is set, always route to main query.
 	if b.ks.uTabling.uPaging.CTETarget == "" {
-		if err := b.sqlMod.SetLimit(defaultInternalPlaceHolder); err != nil {
+		if err := b.injectArg(b.sqlMod.SetLimit, limit); err != nil {
 			return err
 		}
-		b.ks.vArgs = append(b.ks.vArgs, limit+1)
 		return b.applySorts(&vSorts)
 	}
 
@@ -588,41 +885,181 @@ func (b *builder) applyLimitAndSorts() error {
 	}
 	switch effectiveLimitOffsetMode(opts) {
 	case CTETargetModeCTE:
-		if err := b.sqlMod.SetLimit(defaultInternalPlaceHolder); err != nil {
+		if err := b.injectArg(b.sqlMod.SetLimit, limit); err != nil {
 			return err
 		}
-		b.ks.vArgs = append(b.ks.vArgs, limit+1)
 		return b.applySorts(&vSorts)
 	case CTETargetModeMain:
-		if err := b.sqlMod.SetLimitMain(defaultInternalPlaceHolder); err != nil {
+		if err := b.injectArg(b.sqlMod.SetLimitMain, limit); err != nil {
 			return err
 		}
-		b.ks.vArgs = append(b.ks.vArgs, limit+1)
 		return b.applySorts(&vSorts)
 	case CTETargetModeBoth:
-		// String-position order for cursor+both:
-		// CTE LIMIT → CTE ORDER BY → main LIMIT → main ORDER BY
-		// So vArgs must be [limit+1, limit+1] with ORDER BY between the two LIMITs in SQL.
-		// CTE phase:
-		if err := b.sqlMod.SetLimit(defaultInternalPlaceHolder); err != nil {
+		if err := b.injectArg(b.sqlMod.SetLimit, limit); err != nil {
 			return err
 		}
-		b.ks.vArgs = append(b.ks.vArgs, limit+1)
-		if err := b.applySorts(&vSorts); err != nil {
+		if err := b.injectArg(b.sqlMod.SetLimitMain, limit); err != nil {
 			return err
 		}
-		// Main phase (appended after CTE ORDER BY is already in the string):
-		if err := b.sqlMod.SetLimitMain(defaultInternalPlaceHolder); err != nil {
+		return b.applySorts(&vSorts)
+	}
+
+	return nil
+
+}
+
+// cursorLimit returns the LIMIT of cursor pages: one more row than the page size,
+// which tells SanitizeMap / SanitizeStruct whether there is a next page, or
+// exactly the page size with WithLocking, so that no extra row is locked.
+func (b *builder) cursorLimit() int {
+	if b.ks.uTabling.uPaging.Locking != NoLock {
+		return b.ks.uTabling.uPaging.Limit
+	}
+	return b.ks.uTabling.uPaging.Limit + 1
+}
+
+// wrapMainUnion paginates a main-level UNION as a whole: the union is wrapped in a
+// derived table (see modifier.WrapMainUnion) and the sort columns are rendered by
+// the names the union outputs them as. With Options.UnionPushDown the cursor
+// condition, ORDER BY and LIMIT are first repeated inside every branch.
+func (b *builder) wrapMainUnion() error {
+
+	vSorts := b.ks.vTabling.vSorts
+	if vSorts == nil {
+		b.sqlMod.WrapMainUnion()
+		return nil
+	}
+
+	columns := make([]string, 0, len(*vSorts))
+	for _, vSort := range *vSorts {
+		columns = append(columns, vSort.column)
+	}
+	output, branches, err := b.sqlMod.UnionColumns(columns...)
+	if err != nil {
+		return err
+	}
+
+	// the cursor values are read from the rows by column name, so each sort
+	// column must be output under its own name
+	if b.ks.vTabling.vCursor != nil {
+		for _, vSort := range *vSorts {
+			_, column, err := vSort.extractColumn()
+			if err != nil {
+				return err
+			}
+			if name := strings.Trim(output[vSort.column], "`\"[]"); !strings.EqualFold(name, column) {
+				return fmt.Errorf("sort column %s is output as %s by the UNION, sort by %s instead", vSort.column, name, name)
+			}
+		}
+	}
+	b.mainColumns = output
+
+	if b.ks.options.UnionPushDown {
+		if err := b.pushDownUnion(branches); err != nil {
 			return err
 		}
-		b.ks.vArgs = append(b.ks.vArgs, limit+1)
-		return nil
 	}
 
+	b.sqlMod.WrapMainUnion()
 	return nil
 
 }
 
+// pushDownUnion repeats the cursor condition, ORDER BY and LIMIT of the page
+// inside every branch of a main-level UNION, with the sort columns rendered as
+// selected by the branch (branches, see modifier.UnionColumns), so that no branch
+// reads more than a page. Offset pages limit each branch to the rows up to the
+// end of the page.
+func (b *builder) pushDownUnion(branches []map[string]string) error {
+
+	var (
+		vCursor    = b.ks.vTabling.vCursor
+		vSorts     = *b.ks.vTabling.vSorts
+		limit      int
+		withCursor bool
+	)
+
+	switch {
+	case vCursor != nil:
+		limit, withCursor = b.cursorLimit(), b.hasCursorWhere()
+		if vCursor.Prefix.isPrev() {
+			vSorts = b.ks.vTabling.vSorts.reverseDirection()
+		}
+	case b.ks.vTabling.vOffset != nil:
+		limit = b.ks.uTabling.uPaging.Offset + b.ks.uTabling.uPaging.Limit
+	default:
+		return nil
+	}
+
+	return b.sqlMod.EachUnionBranch(func(i int, branch *modifier.SQLModifier) error {
+		if withCursor {
+			condition, err := b.buildCondition(branches[i])
+			if err != nil {
+				return err
+			}
+			appendCondition := branch.AppendWhere
+			if vSorts.hasAggregate() {
+				appendCondition = branch.AppendHaving
+			}
+			if err := appendCondition(condition); err != nil {
+				return err
+			}
+		}
+		if err := branch.SetOrderBy(b.sortClauses(&vSorts, branches[i])...); err != nil {
+			return err
+		}
+		return b.injectArg(branch.SetLimit, limit)
+	})
+
+}
+
+// setPrimaryTarget makes the CTE or derived table set by WithCTETarget or
+// WithSubqueryTarget the target of the modifier.
+func (b *builder) setPrimaryTarget() {
+	if up := b.ks.uTabling.uPaging; up.SubqueryTarget {
+		b.sqlMod.SetSubqueryTarget(up.CTETarget)
+	} else {
+		b.sqlMod.SetCTETarget(up.CTETarget)
+	}
+}
+
+// targetColumnMap returns the ColumnMap of opts, the options of the current target
+// of the modifier. With InferColumnMap, the sort columns it does not list are
+// mapped by the modifier from the target body. The sort keys of WithSortExpr and
+// WithAggregateSort map to their expressions.
+func (b *builder) targetColumnMap(opts *CTEOptions) (map[string]string, error) {
+
+	colMap := cteColumnMap(opts)
+	vSorts := b.ks.vTabling.vSorts
+	if vSorts == nil {
+		return colMap, nil
+	}
+	if opts == nil || !opts.InferColumnMap {
+		return vSorts.exprColumns(colMap), nil
+	}
+
+	var columns []string
+	for _, vSort := range *vSorts {
+		if _, ok := colMap[vSort.column]; !ok && vSort.expr == "" {
+			columns = append(columns, vSort.column)
+		}
+	}
+	inferred, err := b.sqlMod.InferColumnMap(columns...)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string]string, len(*vSorts))
+	for column, mapped := range inferred {
+		merged[column] = mapped
+	}
+	for column, mapped := range colMap {
+		merged[column] = mapped
+	}
+	return vSorts.exprColumns(merged), nil
+
+}
+
 // hasSecondaryCTEs reports whether any secondary CTE targets are registered.
 func (b *builder) hasSecondaryCTEs() bool {
 	return b.ks.uTabling != nil && b.ks.uTabling.uPaging != nil && len(b.ks.uTabling.uPaging.SecondaryCTEs) > 0
@@ -630,11 +1067,11 @@ func (b *builder) hasSecondaryCTEs() bool {
 
 // applySecondaryCTEs injects the cursor WHERE (when withCursor), LIMIT, and
 // ORDER BY into each registered secondary CTE body, in registration order. The
-// secondaries must be defined before the primary CTE in the WITH clause so that
-// these placeholders — appended to vArgs here, before the primary is processed —
-// stay aligned with their query-string positions. Each secondary's clauses are
+// args bind by placeholder position (see arg), so the secondaries may be defined
+// anywhere in the WITH clause. Each secondary's clauses are
 // confined to its CTE body (never mirrored on the main query); a UNION body is
-// auto-wrapped by the modifier, and ColumnMap remaps the injected column.
+// auto-wrapped by the modifier, and ColumnMap and InferColumnMap remap the injected
+// column.
 func (b *builder) applySecondaryCTEs(vSorts vSorts, limit int, withCursor bool) error {
 
 	up := b.ks.uTabling.uPaging
@@ -642,42 +1079,44 @@ func (b *builder) applySecondaryCTEs(vSorts vSorts, limit int, withCursor bool)
 		return nil
 	}
 
-	// Secondaries are layered on top of a primary CTE target; without one there is
-	// no defined query-string ordering for the injected placeholders.
+	// Secondaries are layered on top of a primary CTE target.
 	if up.CTETarget == "" {
 		return fmt.Errorf("WithCTESecondaryTarget requires a primary WithCTETarget")
 	}
 
-	// Restore the primary CTE as the modifier target on the way out so the primary
-	// pagination flow operates on the correct CTE.
-	restore := func() { b.sqlMod.SetCTETarget(up.CTETarget) }
+	// Restore the primary target on the way out so the primary pagination flow
+	// operates on the correct CTE or derived table.
+	restore := b.setPrimaryTarget
 
 	for _, sec := range up.SecondaryCTEs {
-		colMap := cteColumnMap(sec.options)
 		b.sqlMod.SetCTETarget(sec.name)
+		colMap, err := b.targetColumnMap(sec.options)
+		if err != nil {
+			restore()
+			return err
+		}
 
 		// cursor WHERE (uses the original sort directions, like the primary)
 		if withCursor {
-			cond, err := b.buildCondition(colMap, true)
+			cond, err := b.buildCondition(colMap)
 			if err != nil {
 				restore()
 				return err
 			}
-			if err := b.sqlMod.AppendWhere(cond); err != nil {
+			if err := b.appendCursorWhere(cond); err != nil {
 				restore()
 				return err
 			}
 		}
 
 		// LIMIT
-		if err := b.sqlMod.SetLimit(defaultInternalPlaceHolder); err != nil {
+		if err := b.injectArg(b.sqlMod.SetLimit, limit); err != nil {
 			restore()
 			return err
 		}
-		b.ks.vArgs = append(b.ks.vArgs, limit)
 
 		// ORDER BY (CTE body only — not mirrored on main)
-		if err := b.sqlMod.SetOrderBy(orderClauses(&vSorts, colMap)...); err != nil {
+		if err := b.sqlMod.SetOrderBy(b.sortClauses(&vSorts, colMap)...); err != nil {
 			restore()
 			return err
 		}
@@ -694,7 +1133,7 @@ func (b *builder) applySorts(vSorts *vSorts) error {
 
 	// When no CTE target is set, always route ORDER BY to the main query.
 	if b.ks.uTabling == nil || b.ks.uTabling.uPaging == nil || b.ks.uTabling.uPaging.CTETarget == "" {
-		return b.sqlMod.SetOrderBy(orderClauses(vSorts, nil)...)
+		return b.sqlMod.SetOrderBy(b.sortClauses(vSorts, b.mainColumns)...)
 	}
 
 	var opts *CTEOptions
@@ -705,8 +1144,8 @@ func (b *builder) applySorts(vSorts *vSorts) error {
 	// The CTE body uses the remapped column (when ColumnMap is set); the main
 	// query always keeps the original column. With a nil map both are identical,
 	// preserving previous behavior exactly.
-	cteClauses := orderClauses(vSorts, cteColumnMap(opts))
-	mainClauses := orderClauses(vSorts, nil)
+	cteClauses := b.sortClauses(vSorts, b.cteColumns)
+	mainClauses := b.sortClauses(vSorts, nil)
 
 	switch effectiveOrderByMode(opts) {
 	case CTETargetModeCTE:
@@ -726,12 +1165,59 @@ func (b *builder) applySorts(vSorts *vSorts) error {
 
 }
 
+// sortClauses renders the ORDER BY clause fragments of the page, see
+// orderClauses. In stable shape mode vSorts is ignored and the page sorts of
+// both directions are rendered behind the bound direction, each direction
+// blanking the other's terms:
+// "CASE WHEN d = 1 THEN NULL ELSE a END ASC, CASE WHEN d = 0 THEN NULL ELSE a
+// END DESC", where d is 1 on previous pages and 0 otherwise.
+func (b *builder) sortClauses(vSorts *vSorts, colMap map[string]string) []string {
+
+	if !b.ks.options.StableShape || b.ks.vTabling.vCursor == nil {
+		return orderClauses(vSorts, colMap)
+	}
+
+	var (
+		next     = *b.ks.vTabling.vSorts
+		prev     = next.reverseDirection()
+		prevFlag = b.prevFlag()
+		clauses  []string
+	)
+
+	for _, term := range orderTerms(&next, colMap) {
+		clauses = append(clauses, fmt.Sprintf("CASE WHEN %s = 1 THEN NULL ELSE %s END %s", b.flag(prevFlag), term.expr, term.direction))
+	}
+	for _, term := range orderTerms(&prev, colMap) {
+		clauses = append(clauses, fmt.Sprintf("CASE WHEN %s = 0 THEN NULL ELSE %s END %s", b.flag(prevFlag), term.expr, term.direction))
+	}
+
+	return clauses
+}
+
 // orderClauses renders the ORDER BY clause fragments for the given sorts.
 // colMap (when non-nil) remaps each column to its CTE-body equivalent; the
 // sort direction and null handling are unchanged.
 func orderClauses(vSorts *vSorts, colMap map[string]string) []string {
 
 	var clauses []string
+	for _, term := range orderTerms(vSorts, colMap) {
+		clauses = append(clauses, term.expr+" "+term.direction)
+	}
+
+	return clauses
+}
+
+// orderTerm is an ORDER BY term split into its expression and its direction,
+// which includes any NULLS FIRST / LAST.
+type orderTerm struct {
+	expr      string
+	direction string
+}
+
+// orderTerms renders the ORDER BY terms for the given sorts, see orderClauses.
+func orderTerms(vSorts *vSorts, colMap map[string]string) []orderTerm {
+
+	var terms []orderTerm
 
 	for _, vSort := range *vSorts {
 
@@ -745,7 +1231,7 @@ func orderClauses(vSorts *vSorts, colMap map[string]string) []string {
 		}
 
 		if vSort.isNullable() && vSort.nullSortMethod == CaseWhen {
-			clauses = append(clauses, fmt.Sprintf("CASE WHEN %s IS NULL THEN 1 ELSE 0 END %s", column, direction))
+			terms = append(terms, orderTerm{fmt.Sprintf("CASE WHEN %s IS NULL THEN 1 ELSE 0 END", column), direction})
 		}
 
 		if vSort.isNullable() && vSort.nullSortMethod == FirstLast {
@@ -755,16 +1241,16 @@ func orderClauses(vSorts *vSorts, colMap map[string]string) []string {
 			} else {
 				lf = "FIRST"
 			}
-			clauses = append(clauses, fmt.Sprintf("%s %s NULLS %s", column, direction, lf))
+			terms = append(terms, orderTerm{column, direction + " NULLS " + lf})
 			continue
 		}
 
 		if vSort.isNullable() && vSort.nullSortMethod == BoolSort {
-			clauses = append(clauses, fmt.Sprintf("%s IS NULL %s", column, direction))
+			terms = append(terms, orderTerm{column + " IS NULL", direction})
 		}
 
-		clauses = append(clauses, fmt.Sprintf("%s %s", column, direction))
+		terms = append(terms, orderTerm{column, direction})
 	}
 
-	return clauses
+	return terms
 }
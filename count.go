@@ -17,18 +17,43 @@ const (
 // Count converts a SELECT query into a COUNT query.
 // It replaces only the main query's SELECT clause (not in subqueries or CTEs)
 // with count(*), count(1), or count(column).
-// Unused LEFT JOINs (not referenced in WHERE, GROUP BY, or HAVING) are removed automatically.
+// Clauses that cannot change the count are removed automatically: unused LEFT JOINs
+// (not referenced in WHERE, GROUP BY, or HAVING), CTEs that are no longer referenced,
+// scalar subqueries in the SELECT list, and INNER JOINs that follow a ForeignKey hint.
 type Count struct {
-	query string
-	expr  string
+	query           string
+	expr            string
+	distinct        []string
+	args            []any
+	foreignKeys     []ForeignKey
+	placeHolderType PlaceHolderType
+}
+
+// ForeignKey is a schema hint for the count optimizer. It declares that
+// Table.Column is a foreign key referencing the unique key RefColumn of
+// RefTable. Set NotNull when the column is NOT NULL: an INNER JOIN from Table to
+// RefTable on exactly those columns then matches one row per Table row, so it
+// cannot change the count and is removed when nothing else references the
+// joined table. A nullable foreign key drops the rows whose column is NULL, so
+// its joins are always kept.
+type ForeignKey struct {
+	Table     string
+	Column    string
+	RefTable  string
+	RefColumn string
+	NotNull   bool
 }
 
 // NewCount creates a new Count instance for converting a query to a count query.
 // By default uses count(*). Use UseColumn to customize.
+// ForeignKey hints set in the global options are applied.
 func NewCount(query string) *Count {
+	opts := getGlobalOptions()
 	return &Count{
-		query: strings.TrimSpace(query),
-		expr:  CountStar,
+		query:           strings.TrimSpace(query),
+		expr:            CountStar,
+		foreignKeys:     opts.ForeignKeys,
+		placeHolderType: opts.placeHolderType(),
 	}
 }
 
@@ -43,13 +68,102 @@ func (c *Count) UseColumn(expr string) *Count {
 	return c
 }
 
+// Distinct counts the distinct values of the given columns instead of rows.
+// It is meant for queries that join one-to-many tables, where COUNT(*) would
+// count the joined rows more than once.
+// A single column renders COUNT(DISTINCT col); several columns (a composite key)
+// are counted through a wrapped "SELECT DISTINCT cols" subquery. Queries that
+// already use DISTINCT are wrapped the same way so the count stays correct.
+// A query with GROUP BY is wrapped whole and cols name its output columns: their
+// qualifier is dropped, so each must appear in its select list.
+// Distinct takes precedence over UseColumn.
+func (c *Count) Distinct(cols ...string) *Count {
+	c.distinct = c.distinct[:0]
+	for _, col := range cols {
+		if col = strings.TrimSpace(col); col != "" {
+			c.distinct = append(c.distinct, col)
+		}
+	}
+	return c
+}
+
+// WithForeignKeys adds ForeignKey hints used to remove INNER JOINs that cannot
+// change the count, on top of the ones set in the global options.
+func (c *Count) WithForeignKeys(fks ...ForeignKey) *Count {
+	c.foreignKeys = append(c.foreignKeys[:len(c.foreignKeys):len(c.foreignKeys)], fks...)
+	return c
+}
+
+// WithArgs sets the arguments of the query, used by BuildWithArgs.
+func (c *Count) WithArgs(args ...any) *Count {
+	c.args = args
+	return c
+}
+
+// WithPlaceHolderType sets the placeholder type used by BuildWithArgs.
+// It is useful when you want to override the global options.
+func (c *Count) WithPlaceHolderType(placeHolderType PlaceHolderType) *Count {
+	c.placeHolderType = placeHolderType
+	return c
+}
+
+// WithDialect sets the dialect used by BuildWithArgs, i.e. its placeholder type.
+// It is useful when you want to override the global options.
+func (c *Count) WithDialect(dialect Dialect) *Count {
+	c.placeHolderType = dialect.PlaceHolderType()
+	return c
+}
+
 // Build converts the query to a count query and returns the result.
-// Unused LEFT JOINs are automatically removed.
+// Clauses that cannot change the count are automatically removed, except the
+// joins, CTEs and scalar subqueries that bind placeholders. Use BuildWithArgs
+// to remove those as well and get the realigned args.
 func (c *Count) Build() (string, error) {
-	m := modifier.NewSQLModifier(c.query)
-	m.StripUnusedLeftJoins()
-	if err := m.ConvertToCountExpr(c.expr); err != nil {
+	return c.build(c.query, true)
+}
+
+// BuildWithArgs converts the query to a count query and returns it with the args
+// set by WithArgs. Args bound by removed clauses (e.g. a placeholder inside an
+// unused CTE or a scalar subquery) are dropped so the remaining args stay aligned.
+func (c *Count) BuildWithArgs() (string, []any, error) {
+
+	marked, err := markUserPlaceholders(c.query)
+	if err != nil {
+		return "", nil, err
+	}
+
+	query, err := c.build(marked, false)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return restoreUserPlaceholders(query, c.args, c.placeHolderType)
+
+}
+
+// build converts the given query to a count query. keepBound keeps the
+// clauses that bind placeholders, see SQLModifier.SetKeepPlaceholders.
+func (c *Count) build(query string, keepBound bool) (string, error) {
+	m := modifier.NewSQLModifier(query)
+	m.SetKeepPlaceholders(keepBound)
+	m.StripUnusedLeftJoins(c.distinct...)
+	m.StripRedundantInnerJoins(c.modifierForeignKeys())
+	if len(c.distinct) > 0 {
+		if err := m.ConvertToCountDistinct(c.distinct...); err != nil {
+			return "", fmt.Errorf("failed to convert to count query: %w", err)
+		}
+	} else if err := m.ConvertToCountExpr(c.expr); err != nil {
 		return "", fmt.Errorf("failed to convert to count query: %w", err)
 	}
+	m.StripUnusedCTEs()
 	return m.Build()
 }
+
+// modifierForeignKeys converts the ForeignKey hints for the modifier.
+func (c *Count) modifierForeignKeys() []modifier.ForeignKey {
+	fks := make([]modifier.ForeignKey, 0, len(c.foreignKeys))
+	for _, fk := range c.foreignKeys {
+		fks = append(fks, modifier.ForeignKey(fk))
+	}
+	return fks
+}
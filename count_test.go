@@ -498,3 +498,303 @@ func TestNewCountUseColumnChaining(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, strings.ToLower(got))
 	}
 }
+
+func TestNewCountDistinct(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		distinct  []string
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:     "single column on one-to-many join",
+			query:    "SELECT a.id, a.name FROM account a INNER JOIN orders o ON o.account_id = a.id WHERE o.total > ?",
+			distinct: []string{"a.id"},
+			expected: "select count(distinct a.id) from account a inner join orders o on o.account_id = a.id where o.total > ?",
+		},
+		{
+			name:     "composite key wraps distinct subquery",
+			query:    "SELECT a.x, a.y, o.id FROM account a INNER JOIN orders o ON o.account_id = a.id",
+			distinct: []string{"a.x", "a.y"},
+			expected: "select count(*) from (select distinct a.x, a.y from account a inner join orders o on o.account_id = a.id) kuysor_count",
+		},
+		{
+			name:     "unused left join removed",
+			query:    "SELECT a.id, p.name FROM account a LEFT JOIN profiles p ON p.account_id = a.id INNER JOIN orders o ON o.account_id = a.id",
+			distinct: []string{"a.id"},
+			expected: "select count(distinct a.id) from account a inner join orders o on o.account_id = a.id",
+		},
+		{
+			name:     "left join referenced by distinct column kept",
+			query:    "SELECT a.id FROM account a LEFT JOIN profiles p ON p.account_id = a.id LEFT JOIN avatars v ON v.account_id = a.id",
+			distinct: []string{"p.id"},
+			expected: "select count(distinct p.id) from account a left join profiles p on p.account_id = a.id",
+		},
+		{
+			name:     "existing distinct wraps",
+			query:    "SELECT DISTINCT a.id, a.name FROM account a INNER JOIN orders o ON o.account_id = a.id ORDER BY a.name LIMIT 10",
+			distinct: []string{"a.id"},
+			expected: "select count(*) from (select distinct a.id from account a inner join orders o on o.account_id = a.id) kuysor_count",
+		},
+		{
+			name:     "group by wraps",
+			query:    "SELECT a.status, COUNT(*) FROM account a INNER JOIN orders o ON o.account_id = a.id GROUP BY a.status HAVING COUNT(*) > 1",
+			distinct: []string{"a.status"},
+			expected: "select count(distinct status) from (select a.status, count(*) from account a inner join orders o on o.account_id = a.id group by a.status having count(*) > 1) kuysor_count",
+		},
+		{
+			name:     "group by with having alias and composite key wraps whole query",
+			query:    "SELECT o.account_id, o.kind, SUM(o.total) AS spent FROM orders o GROUP BY o.account_id, o.kind HAVING spent > 100 ORDER BY spent DESC",
+			distinct: []string{"o.account_id", "o.kind"},
+			expected: "select count(*) from (select distinct account_id, kind from (select o.account_id, o.kind, sum(o.total) as spent from orders o group by o.account_id, o.kind having spent > 100) kuysor_distinct) kuysor_count",
+		},
+		{
+			name:     "group by expression resolved to its alias",
+			query:    "SELECT COALESCE(a.region, 'none') AS region, COUNT(*) FROM account a GROUP BY COALESCE(a.region, 'none')",
+			distinct: []string{"COALESCE(a.region, 'none')"},
+			expected: "select count(distinct region) from (select coalesce(a.region, 'none') as region, count(*) from account a group by coalesce(a.region, 'none')) kuysor_count",
+		},
+		{
+			name:      "group by column not selected rejected",
+			query:     "SELECT a.status, COUNT(*) FROM account a GROUP BY a.status, a.kind",
+			distinct:  []string{"a.kind"},
+			expectErr: true,
+		},
+		{
+			name:      "group by unnamed expression rejected",
+			query:     "SELECT COALESCE(a.region, 'none'), COUNT(*) FROM account a GROUP BY COALESCE(a.region, 'none')",
+			distinct:  []string{"COALESCE(a.region, 'none')"},
+			expectErr: true,
+		},
+		{
+			name:      "group by duplicate output name rejected",
+			query:     "SELECT a.id, o.id FROM account a INNER JOIN orders o ON o.account_id = a.id GROUP BY a.id, o.id",
+			distinct:  []string{"a.id"},
+			expectErr: true,
+		},
+		{
+			name:     "CTE kept at statement level",
+			query:    "WITH f AS (SELECT id FROM account WHERE status = ?) SELECT f.id, o.id FROM f INNER JOIN orders o ON o.account_id = f.id",
+			distinct: []string{"f.id", "o.kind"},
+			expected: "with f as (select id from account where status = ?) select count(*) from (select distinct f.id, o.kind from f inner join orders o on o.account_id = f.id) kuysor_count",
+		},
+		{
+			name:      "union rejected",
+			query:     "SELECT id FROM a UNION SELECT id FROM b",
+			distinct:  []string{"id"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewCount(tt.query).Distinct(tt.distinct...).Build()
+			if tt.expectErr {
+				if err == nil {
+					t.Error("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			gotLower := strings.ToLower(got)
+			if gotLower != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, gotLower)
+			}
+		})
+	}
+}
+
+func TestNewCountStripUnusedCTEsAndSubqueries(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:     "CTE only used by the select list is removed",
+			query:    "WITH stats AS (SELECT user_id, COUNT(*) AS total FROM orders GROUP BY user_id) SELECT u.id, s.total FROM users u LEFT JOIN stats s ON s.user_id = u.id WHERE u.status = 1",
+			expected: "select count(*) from users u where u.status = 1",
+		},
+		{
+			name:     "referenced CTE kept, unreferenced one removed",
+			query:    "WITH a AS (SELECT id FROM t1), b AS (SELECT id FROM t2) SELECT x.id FROM a x",
+			expected: "with a as (select id from t1) select count(*) from a x",
+		},
+		{
+			name:     "CTE referenced by a kept CTE is kept",
+			query:    "WITH base AS (SELECT id FROM t1), filtered AS (SELECT id FROM base WHERE id > 1), unused AS (SELECT 1 FROM t3) SELECT f.id FROM filtered f",
+			expected: "with base as (select id from t1), filtered as (select id from base where id > 1) select count(*) from filtered f",
+		},
+		{
+			name:     "recursive keyword kept",
+			query:    "WITH RECURSIVE tree AS (SELECT id FROM node WHERE parent_id IS NULL UNION ALL SELECT n.id FROM node n JOIN tree t ON n.parent_id = t.id), other AS (SELECT 1 FROM x) SELECT id FROM tree",
+			expected: "with recursive tree as (select id from node where parent_id is null union all select n.id from node n join tree t on n.parent_id = t.id) select count(*) from tree",
+		},
+		{
+			name:     "scalar subqueries dropped from grouped select list",
+			query:    "SELECT u.dept, (SELECT COUNT(*) FROM orders o WHERE o.dept = u.dept) AS order_count, COUNT(*) FROM users u GROUP BY u.dept",
+			expected: "select count(*) from (select u.dept, count(*) from users u group by u.dept) kuysor_count",
+		},
+		{
+			name:     "scalar subquery referenced by having kept",
+			query:    "SELECT u.dept, (SELECT MAX(x) FROM limits) AS cap FROM users u GROUP BY u.dept HAVING COUNT(*) < cap",
+			expected: "select count(*) from (select u.dept, (select max(x) from limits) as cap from users u group by u.dept having count(*) < cap) kuysor_count",
+		},
+		{
+			name:     "CTE binding a placeholder is kept",
+			query:    "WITH stats AS (SELECT user_id FROM orders WHERE kind = ?) SELECT u.id, s.user_id FROM users u LEFT JOIN stats s ON s.user_id = u.id WHERE u.status = ?",
+			expected: "with stats as (select user_id from orders where kind = ?) select count(*) from users u where u.status = ?",
+		},
+		{
+			name:     "scalar subquery binding a placeholder is kept",
+			query:    "SELECT u.dept, (SELECT COUNT(*) FROM orders o WHERE o.kind = ?) AS n FROM users u WHERE u.status = ? GROUP BY u.dept",
+			expected: "select count(*) from (select u.dept, (select count(*) from orders o where o.kind = ?) as n from users u where u.status = ? group by u.dept) kuysor_count",
+		},
+		{
+			name:     "scalar subqueries kept for distinct",
+			query:    "SELECT DISTINCT u.dept, (SELECT 1 FROM x) AS flag FROM users u",
+			expected: "select count(*) from (select distinct u.dept, (select 1 from x) as flag from users u) kuysor_count",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewCount(tt.query).Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			gotLower := strings.ToLower(got)
+			if gotLower != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, gotLower)
+			}
+		})
+	}
+}
+
+func TestNewCountForeignKeyHints(t *testing.T) {
+	fks := []ForeignKey{
+		{Table: "orders", Column: "account_id", RefTable: "account", RefColumn: "id", NotNull: true},
+		{Table: "account", Column: "region_id", RefTable: "region", RefColumn: "id", NotNull: true},
+		{Table: "orders", Column: "coupon_id", RefTable: "coupon", RefColumn: "id"},
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{
+			name:     "inner join following foreign key removed",
+			query:    "SELECT o.id, a.name FROM orders o INNER JOIN account a ON a.id = o.account_id WHERE o.total > 10",
+			expected: "select count(*) from orders o where o.total > 10",
+		},
+		{
+			name:     "plain join with reversed equality removed",
+			query:    "SELECT o.id FROM orders o JOIN account a ON (o.account_id = a.id)",
+			expected: "select count(*) from orders o",
+		},
+		{
+			name:     "join referenced in where kept",
+			query:    "SELECT o.id FROM orders o JOIN account a ON a.id = o.account_id WHERE a.status = 1",
+			expected: "select count(*) from orders o join account a on a.id = o.account_id where a.status = 1",
+		},
+		{
+			name:     "join with extra ON condition kept",
+			query:    "SELECT o.id FROM orders o JOIN account a ON a.id = o.account_id AND a.deleted_at = 0",
+			expected: "select count(*) from orders o join account a on a.id = o.account_id and a.deleted_at = 0",
+		},
+		{
+			name:     "join without hint kept",
+			query:    "SELECT o.id FROM orders o JOIN customer c ON c.id = o.customer_id",
+			expected: "select count(*) from orders o join customer c on c.id = o.customer_id",
+		},
+		{
+			name:     "join on nullable foreign key kept",
+			query:    "SELECT o.id, c.code FROM orders o JOIN coupon c ON c.id = o.coupon_id",
+			expected: "select count(*) from orders o join coupon c on c.id = o.coupon_id",
+		},
+		{
+			name:     "join in the reverse direction kept",
+			query:    "SELECT a.id FROM account a JOIN orders o ON o.account_id = a.id",
+			expected: "select count(*) from account a join orders o on o.account_id = a.id",
+		},
+		{
+			name:     "chained joins removed when only the chain references them",
+			query:    "SELECT o.id, r.name FROM orders o JOIN account a ON a.id = o.account_id JOIN region r ON r.id = a.region_id",
+			expected: "select count(*) from orders o",
+		},
+		{
+			name:     "chained join needed by where keeps its parent",
+			query:    "SELECT o.id FROM orders o JOIN account a ON a.id = o.account_id JOIN region r ON r.id = a.region_id WHERE r.code = 'EU'",
+			expected: "select count(*) from orders o join account a on a.id = o.account_id join region r on r.id = a.region_id where r.code = 'eu'",
+		},
+		{
+			name:     "grouped select column of removed join cleaned",
+			query:    "SELECT o.status, a.name FROM orders o JOIN account a ON a.id = o.account_id GROUP BY o.status",
+			expected: "select count(*) from (select o.status from orders o group by o.status) kuysor_count",
+		},
+		{
+			name:     "distinct select list keeps the join",
+			query:    "SELECT DISTINCT a.name FROM orders o JOIN account a ON a.id = o.account_id",
+			expected: "select count(*) from (select distinct a.name from orders o join account a on a.id = o.account_id) kuysor_count",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewCount(tt.query).WithForeignKeys(fks...).Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			gotLower := strings.ToLower(got)
+			if gotLower != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, gotLower)
+			}
+		})
+	}
+}
+
+func TestNewCountBuildWithArgs(t *testing.T) {
+	query := "WITH stats AS (SELECT user_id FROM orders WHERE kind = ?) SELECT u.id, (SELECT COUNT(*) FROM s WHERE s.x = ?) AS n, st.user_id FROM users u LEFT JOIN stats st ON st.user_id = u.id WHERE u.status = ? ORDER BY u.id LIMIT ?"
+
+	got, args, err := NewCount(query).WithArgs("k", "x", "active", 10).BuildWithArgs()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "select count(*) from users u where u.status = ?"
+	if strings.ToLower(got) != expected {
+		t.Errorf("expected %q, got %q", expected, strings.ToLower(got))
+	}
+	if len(args) != 1 || args[0] != "active" {
+		t.Errorf("expected args [active], got %v", args)
+	}
+}
+
+func TestNewCountBuildWithArgsMixedPlaceholders(t *testing.T) {
+	query := "SELECT u.id FROM users u WHERE u.status = ? AND u.kind = $1"
+
+	if _, _, err := NewCount(query).WithArgs("active", "k").BuildWithArgs(); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestNewCountWithDialect(t *testing.T) {
+	query := "SELECT u.id FROM users u WHERE u.status = ? AND u.kind = ? ORDER BY u.id LIMIT ?"
+
+	got, args, err := NewCount(query).WithArgs("active", "k", 10).WithDialect(PostgreSQL).BuildWithArgs()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "select count(*) from users u where u.status = $1 and u.kind = $2"
+	if strings.ToLower(got) != expected {
+		t.Errorf("expected %q, got %q", expected, strings.ToLower(got))
+	}
+	if len(args) != 2 || args[0] != "active" || args[1] != "k" {
+		t.Errorf("expected args [active k], got %v", args)
+	}
+}
@@ -9,7 +9,11 @@ import (
 type vCursor struct {
 	Prefix cursorPrefix   `json:"prefix"`
 	Cols   map[string]any `json:"cols"`
-	cursor cursorBase64   `json:"-"`
+	// Total and CountedAt carry the total row count (and when it was computed, in
+	// unix seconds) between pages when a total count max age is set.
+	Total     *int64       `json:"total,omitempty"`
+	CountedAt int64        `json:"counted_at,omitempty"`
+	cursor    cursorBase64 `json:"-"`
 }
 
 // generateCursorBase64 generates the cursor base64 from vCursor.
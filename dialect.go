@@ -0,0 +1,181 @@
+package kuysor
+
+import (
+	"fmt"
+
+	"github.com/redhajuanda/kuysor/modifier"
+)
+
+// LimitSyntax describes how a dialect caps and skips rows.
+type LimitSyntax uint8
+
+const (
+	// LimitOffsetSyntax renders "LIMIT ? OFFSET ?".
+	LimitOffsetSyntax LimitSyntax = iota
+	// OffsetFetchSyntax renders "OFFSET ? ROWS FETCH NEXT ? ROWS ONLY".
+	OffsetFetchSyntax
+	// TopSyntax renders "SELECT TOP (?) ..." for cursor pages and falls back to
+	// OffsetFetchSyntax for offset pages.
+	TopSyntax
+	// FetchFirstSyntax renders "[OFFSET ? ROWS] FETCH FIRST ? ROWS ONLY".
+	FetchFirstSyntax
+	// RowNumSyntax wraps the paginated statement in ROWNUM filters, e.g.
+	// "SELECT * FROM (...) WHERE ROWNUM <= ?". Offset pages filter on an extra
+	// KUYSOR_RN column, which is only returned when the statement selects "*" or
+	// an unnamed expression.
+	RowNumSyntax
+)
+
+// modifierLimitSyntax converts the limit syntax for the modifier. Offset pages
+// cannot use TOP, so they get OFFSET ... FETCH instead.
+func modifierLimitSyntax(syntax LimitSyntax, offsetPage bool) (modifier.LimitSyntax, error) {
+	switch syntax {
+	case LimitOffsetSyntax:
+		return modifier.LimitOffset, nil
+	case OffsetFetchSyntax:
+		return modifier.OffsetFetch, nil
+	case TopSyntax:
+		if offsetPage {
+			return modifier.OffsetFetch, nil
+		}
+		return modifier.Top, nil
+	case FetchFirstSyntax:
+		return modifier.FetchFirst, nil
+	case RowNumSyntax:
+		return modifier.RowNum, nil
+	}
+	return 0, fmt.Errorf("unsupported limit syntax: %d", syntax)
+}
+
+// Dialect describes the SQL syntax of a database. It decides how placeholders are
+// rendered, how nullable sort columns are ordered, how rows are limited, where
+// clauses go and whether row-value comparisons such as (a, b) > (?, ?) are
+// supported.
+//
+// MySQL, PostgreSQL, SQLite, SQLServer, Oracle and Oracle11 are provided. Set it through
+// Options.Dialect or Kuysor.WithDialect. A non-zero PlaceHolderType or
+// NullSortMethod in Options, or one set with the WithPlaceHolderType /
+// WithNullSortMethod methods of Options or Kuysor, still overrides the dialect.
+type Dialect interface {
+	// Name returns the name of the dialect, e.g. "postgres".
+	Name() string
+	// PlaceHolderType returns the placeholder type used to render the query.
+	PlaceHolderType() PlaceHolderType
+	// NullSortMethod returns the method used to order nullable sort columns.
+	NullSortMethod() NullSortMethod
+	// LimitSyntax returns the syntax used to limit and skip rows.
+	LimitSyntax() LimitSyntax
+	// SupportsRowValues reports whether row-value comparisons are supported.
+	SupportsRowValues() bool
+	// SupportsLocking reports whether a paginated statement can end with the
+	// locking clause of mode.
+	SupportsLocking(mode LockMode) bool
+	// Clauses returns the clauses that can follow FROM in a statement, in the order
+	// the dialect accepts them. Each clause is listed by the keywords that start it,
+	// e.g. {"FOR UPDATE", "FOR SHARE"}. kuysor inserts WHERE, ORDER BY, LIMIT,
+	// OFFSET and FETCH before the first clause of the query that follows them.
+	Clauses() [][]string
+}
+
+var (
+	// MySQL is the dialect for MySQL 8.
+	MySQL Dialect = mysqlDialect{}
+	// PostgreSQL is the dialect for PostgreSQL.
+	PostgreSQL Dialect = postgresDialect{}
+	// SQLite is the dialect for SQLite.
+	SQLite Dialect = sqliteDialect{}
+	// SQLServer is the dialect for SQL Server 2012 and later. Offset pages need an
+	// ORDER BY (WithOrderBy), as SQL Server rejects OFFSET ... FETCH without one.
+	// WithLocking is not supported: SQL Server locks rows with table hints.
+	SQLServer Dialect = sqlserverDialect{}
+	// Oracle is the dialect for Oracle 12c and later. It does not support
+	// WithLocking, as Oracle rejects FOR UPDATE with FETCH FIRST (ORA-02014).
+	Oracle Dialect = oracleDialect{}
+	// Oracle11 is the dialect for Oracle 11g and older, which lack OFFSET / FETCH
+	// and are paginated with ROWNUM instead.
+	Oracle11 Dialect = oracle11Dialect{}
+)
+
+var (
+	mysqlClauses = [][]string{
+		{"WHERE"}, {"GROUP BY"}, {"HAVING"}, {"WINDOW"}, {"ORDER BY"}, {"LIMIT"}, {"OFFSET"},
+		{"FOR UPDATE", "FOR SHARE", "LOCK IN SHARE MODE"}, {"INTO"},
+	}
+	postgresClauses = [][]string{
+		{"WHERE"}, {"GROUP BY"}, {"HAVING"}, {"WINDOW"}, {"ORDER BY"}, {"LIMIT"}, {"OFFSET"}, {"FETCH"},
+		{"FOR UPDATE", "FOR NO KEY UPDATE", "FOR SHARE", "FOR KEY SHARE"}, {"RETURNING"},
+	}
+	sqliteClauses = [][]string{
+		{"WHERE"}, {"GROUP BY"}, {"HAVING"}, {"WINDOW"}, {"ORDER BY"}, {"LIMIT"}, {"OFFSET"}, {"RETURNING"},
+	}
+	sqlserverClauses = [][]string{
+		{"WHERE"}, {"GROUP BY"}, {"HAVING"}, {"WINDOW"}, {"ORDER BY"}, {"OFFSET"}, {"FETCH"},
+		{"FOR XML", "FOR JSON", "FOR BROWSE"}, {"OPTION"},
+	}
+	oracleClauses = [][]string{
+		{"WHERE"}, {"START WITH", "CONNECT BY"}, {"GROUP BY"}, {"HAVING"}, {"WINDOW"}, {"ORDER BY"},
+		{"OFFSET"}, {"FETCH"}, {"FOR UPDATE"}, {"RETURNING"},
+	}
+	// oracle11Clauses has the LIMIT and OFFSET clauses that the RowNum syntax
+	// rewrites into ROWNUM filters.
+	oracle11Clauses = [][]string{
+		{"WHERE"}, {"START WITH", "CONNECT BY"}, {"GROUP BY"}, {"HAVING"}, {"ORDER BY"},
+		{"LIMIT"}, {"OFFSET"}, {"FOR UPDATE"}, {"RETURNING"},
+	}
+)
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string                     { return "mysql" }
+func (mysqlDialect) PlaceHolderType() PlaceHolderType { return Question }
+func (mysqlDialect) NullSortMethod() NullSortMethod   { return BoolSort }
+func (mysqlDialect) LimitSyntax() LimitSyntax         { return LimitOffsetSyntax }
+func (mysqlDialect) SupportsRowValues() bool          { return true }
+func (mysqlDialect) Clauses() [][]string              { return mysqlClauses }
+func (mysqlDialect) SupportsLocking(LockMode) bool    { return true }
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string                     { return "postgres" }
+func (postgresDialect) PlaceHolderType() PlaceHolderType { return Dollar }
+func (postgresDialect) NullSortMethod() NullSortMethod   { return FirstLast }
+func (postgresDialect) LimitSyntax() LimitSyntax         { return LimitOffsetSyntax }
+func (postgresDialect) SupportsRowValues() bool          { return true }
+func (postgresDialect) Clauses() [][]string              { return postgresClauses }
+func (postgresDialect) SupportsLocking(LockMode) bool    { return true }
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string                     { return "sqlite" }
+func (sqliteDialect) PlaceHolderType() PlaceHolderType { return Question }
+func (sqliteDialect) NullSortMethod() NullSortMethod   { return BoolSort }
+func (sqliteDialect) LimitSyntax() LimitSyntax         { return LimitOffsetSyntax }
+func (sqliteDialect) SupportsRowValues() bool          { return true }
+func (sqliteDialect) Clauses() [][]string              { return sqliteClauses }
+func (sqliteDialect) SupportsLocking(LockMode) bool    { return false }
+
+type sqlserverDialect struct{}
+
+func (sqlserverDialect) Name() string                     { return "sqlserver" }
+func (sqlserverDialect) PlaceHolderType() PlaceHolderType { return At }
+func (sqlserverDialect) NullSortMethod() NullSortMethod   { return CaseWhen }
+func (sqlserverDialect) LimitSyntax() LimitSyntax         { return TopSyntax }
+func (sqlserverDialect) SupportsRowValues() bool          { return false }
+func (sqlserverDialect) Clauses() [][]string              { return sqlserverClauses }
+func (sqlserverDialect) SupportsLocking(LockMode) bool    { return false }
+
+type oracleDialect struct{}
+
+func (oracleDialect) Name() string                     { return "oracle" }
+func (oracleDialect) PlaceHolderType() PlaceHolderType { return Colon }
+func (oracleDialect) NullSortMethod() NullSortMethod   { return FirstLast }
+func (oracleDialect) LimitSyntax() LimitSyntax         { return FetchFirstSyntax }
+func (oracleDialect) SupportsRowValues() bool          { return false }
+func (oracleDialect) Clauses() [][]string              { return oracleClauses }
+func (oracleDialect) SupportsLocking(LockMode) bool    { return false }
+
+type oracle11Dialect struct{ oracleDialect }
+
+func (oracle11Dialect) Name() string             { return "oracle11" }
+func (oracle11Dialect) LimitSyntax() LimitSyntax { return RowNumSyntax }
+func (oracle11Dialect) Clauses() [][]string      { return oracle11Clauses }
@@ -0,0 +1,29 @@
+package kuysor
+
+import (
+	"fmt"
+
+	"github.com/redhajuanda/kuysor/modifier"
+)
+
+// ErrExistingClause is wrapped by the error of Build when the query already has an
+// ORDER BY, LIMIT, OFFSET or FETCH clause and the ClausePolicy is RejectClauses.
+var ErrExistingClause = modifier.ErrExistingClause
+
+// ErrAmbiguousColumn is wrapped by the error of Build when CTEOptions.InferColumnMap
+// matches a sort column against several columns of the CTE or derived table.
+var ErrAmbiguousColumn = modifier.ErrAmbiguousColumn
+
+// ArgCountError is returned by Build when the number of args passed with WithArgs
+// does not match the placeholders of the query.
+type ArgCountError struct {
+	// Expected is the number of args the placeholders bind: one per "?", and the
+	// highest number among $n, @pn and :n, so a reused "$1" counts once.
+	Expected int
+	// Actual is the number of args passed.
+	Actual int
+}
+
+func (e *ArgCountError) Error() string {
+	return fmt.Sprintf("query expects %d args, got %d", e.Expected, e.Actual)
+}
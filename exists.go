@@ -0,0 +1,86 @@
+package kuysor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/redhajuanda/kuysor/modifier"
+)
+
+// Exists converts a SELECT query into a cheap "has any rows" check, e.g. for
+// empty-state UIs that only need to know whether a filter matches anything.
+// The main query becomes "SELECT EXISTS(SELECT 1 FROM ... LIMIT 1)", or
+// "SELECT CASE WHEN EXISTS(SELECT 1 FROM ...) THEN 1 ELSE 0 END" for dialects
+// without LIMIT such as SQL Server.
+// Unused LEFT JOINs, unreferenced CTEs, and ORDER BY / LIMIT / OFFSET are removed
+// the same way as in NewCount, and so is a row-locking clause. The select list is
+// kept when the query has a HAVING clause, which may refer to its aliases.
+type Exists struct {
+	query           string
+	args            []any
+	placeHolderType PlaceHolderType
+	limitSyntax     LimitSyntax
+}
+
+// NewExists creates a new Exists instance for converting a query to an existence check.
+func NewExists(query string) *Exists {
+	opts := getGlobalOptions()
+	return &Exists{
+		query:           strings.TrimSpace(query),
+		placeHolderType: opts.placeHolderType(),
+		limitSyntax:     opts.limitSyntax(),
+	}
+}
+
+// WithArgs sets the arguments of the query.
+func (e *Exists) WithArgs(args ...any) *Exists {
+	e.args = args
+	return e
+}
+
+// WithPlaceHolderType sets the placeholder type of the built query.
+// It is useful when you want to override the global options.
+func (e *Exists) WithPlaceHolderType(placeHolderType PlaceHolderType) *Exists {
+	e.placeHolderType = placeHolderType
+	return e
+}
+
+// WithDialect sets the dialect of the built query, including its placeholder type.
+// It is useful when you want to override the global options.
+func (e *Exists) WithDialect(dialect Dialect) *Exists {
+	e.placeHolderType = dialect.PlaceHolderType()
+	e.limitSyntax = dialect.LimitSyntax()
+	return e
+}
+
+// Build converts the query to an existence check and returns it with its args.
+// Args bound by removed clauses (e.g. the ON clause of an unused LEFT JOIN or a
+// LIMIT ?) are dropped so the remaining args stay aligned.
+func (e *Exists) Build() (string, []any, error) {
+
+	limitSyntax, err := modifierLimitSyntax(e.limitSyntax, false)
+	if err != nil {
+		return "", nil, err
+	}
+
+	marked, err := markUserPlaceholders(e.query)
+	if err != nil {
+		return "", nil, err
+	}
+
+	m := modifier.NewSQLModifier(marked)
+	m.SetLimitSyntax(limitSyntax)
+	m.StripUnusedLeftJoins()
+	if err := m.ConvertToExists(); err != nil {
+		return "", nil, fmt.Errorf("failed to convert to exists query: %w", err)
+	}
+	m.StripUnusedCTEs()
+
+	query, err := m.Build()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return restoreUserPlaceholders(query, e.args, e.placeHolderType)
+
+}
@@ -0,0 +1,135 @@
+package kuysor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewExists(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		args      []any
+		phType    PlaceHolderType
+		dialect   Dialect
+		expected  string
+		argsOut   []any
+		expectErr bool
+	}{
+		{
+			name:     "simple select",
+			query:    "SELECT id, name FROM users WHERE status = ?",
+			args:     []any{"active"},
+			expected: "select exists(select 1 from users where status = ? limit 1)",
+			argsOut:  []any{"active"},
+		},
+		{
+			name:     "order by and limit stripped with their args",
+			query:    "SELECT id FROM users WHERE status = ? ORDER BY name LIMIT ? OFFSET ?",
+			args:     []any{"active", 10, 20},
+			expected: "select exists(select 1 from users where status = ? limit 1)",
+			argsOut:  []any{"active"},
+		},
+		{
+			name:     "unused left join removed with its arg",
+			query:    "SELECT u.id, p.name FROM users u LEFT JOIN profiles p ON p.user_id = u.id AND p.kind = ? WHERE u.status = ?",
+			args:     []any{"main", "active"},
+			expected: "select exists(select 1 from users u where u.status = ? limit 1)",
+			argsOut:  []any{"active"},
+		},
+		{
+			name:     "CTE kept at statement level with dollar placeholders",
+			query:    "WITH f AS (SELECT id FROM users WHERE tenant = $1) SELECT f.id FROM f WHERE f.id > $2 ORDER BY f.id LIMIT $3",
+			args:     []any{"t1", 5, 10},
+			phType:   Dollar,
+			expected: "with f as (select id from users where tenant = $1) select exists(select 1 from f where f.id > $2 limit 1)",
+			argsOut:  []any{"t1", 5},
+		},
+		{
+			name:     "group by kept",
+			query:    "SELECT dept, COUNT(*) FROM employees GROUP BY dept HAVING COUNT(*) > ?",
+			args:     []any{5},
+			expected: "select exists(select dept, count(*) from employees group by dept having count(*) > ? limit 1)",
+			argsOut:  []any{5},
+		},
+		{
+			name:     "select list and its joins kept for a having alias",
+			query:    "SELECT e.dept, SUM(b.amount) AS total FROM employees e LEFT JOIN bonuses b ON b.employee_id = e.id GROUP BY e.dept HAVING total > ?",
+			args:     []any{100},
+			expected: "select exists(select e.dept, sum(b.amount) as total from employees e left join bonuses b on b.employee_id = e.id group by e.dept having total > ? limit 1)",
+			argsOut:  []any{100},
+		},
+		{
+			name:     "locking clause stripped",
+			query:    "SELECT id FROM jobs WHERE status = ? ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED",
+			args:     []any{"ready", 10},
+			expected: "select exists(select 1 from jobs where status = ? limit 1)",
+			argsOut:  []any{"ready"},
+		},
+		{
+			name:     "locking clause without order by stripped",
+			query:    "SELECT id FROM jobs WHERE status = ? LOCK IN SHARE MODE",
+			args:     []any{"ready"},
+			expected: "select exists(select 1 from jobs where status = ? limit 1)",
+			argsOut:  []any{"ready"},
+		},
+		{
+			name:     "union wrapped",
+			query:    "SELECT id FROM employees WHERE a = ? UNION ALL SELECT id FROM contractors WHERE b = ?",
+			args:     []any{1, 2},
+			expected: "select exists(select 1 from (select id from employees where a = ? union all select id from contractors where b = ?) kuysor_exists limit 1)",
+			argsOut:  []any{1, 2},
+		},
+		{
+			name:     "sql server uses case when",
+			query:    "SELECT id FROM users WHERE status = @p1 ORDER BY name OFFSET @p2 ROWS FETCH NEXT @p3 ROWS ONLY",
+			args:     []any{"active", 20, 10},
+			dialect:  SQLServer,
+			expected: "select case when exists(select 1 from users where status = @p1) then 1 else 0 end",
+			argsOut:  []any{"active"},
+		},
+		{
+			name:     "oracle selects from dual",
+			query:    "SELECT id FROM users WHERE status = :1 ORDER BY name FETCH FIRST :2 ROWS ONLY",
+			args:     []any{"active", 10},
+			dialect:  Oracle,
+			expected: "select case when exists(select 1 from users where status = :1) then 1 else 0 end from dual",
+			argsOut:  []any{"active"},
+		},
+		{
+			name:      "no from clause",
+			query:     "SELECT 1",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewExists(tt.query).WithArgs(tt.args...).WithPlaceHolderType(tt.phType)
+			if tt.dialect != nil {
+				e.WithDialect(tt.dialect)
+			}
+			got, args, err := e.Build()
+			if tt.expectErr {
+				if err == nil {
+					t.Error("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if gotLower := strings.ToLower(got); gotLower != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, gotLower)
+			}
+			if len(args) != len(tt.argsOut) {
+				t.Fatalf("expected args %v, got %v", tt.argsOut, args)
+			}
+			for i, v := range tt.argsOut {
+				if args[i] != v {
+					t.Errorf("arg[%d]: expected %v, got %v", i, v, args[i])
+				}
+			}
+		})
+	}
+}
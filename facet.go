@@ -0,0 +1,189 @@
+package kuysor
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/redhajuanda/kuysor/modifier"
+)
+
+// FacetCount builds per-value count queries (facets) from the same base query,
+// e.g. the number of rows per status or per category shown next to search results.
+// Each facet rewrites the main SELECT into "SELECT <column>, COUNT(*) ... GROUP BY <column>",
+// keeping the WITH, JOIN, and WHERE clauses. Unused LEFT JOINs and unreferenced CTEs
+// are removed the same way NewCount removes them.
+type FacetCount struct {
+	query           string
+	args            []any
+	facets          []facet
+	placeHolderType PlaceHolderType
+}
+
+// FacetOptions controls how a single facet query is built.
+type FacetOptions struct {
+	// ExcludeFilter is the WHERE predicate that filters on the facet itself, e.g.
+	// "a.status = ?". It is dropped from this facet's query (together with the args
+	// it binds) so the facet still shows the counts of the values that are not
+	// currently selected. It must match a top-level AND condition of the WHERE
+	// clause; whitespace, letter case, and placeholder style are ignored.
+	ExcludeFilter string
+}
+
+// facet is a single facet column registered with By.
+type facet struct {
+	column  string
+	options FacetOptions
+}
+
+// FacetQuery is a built facet count query with its aligned args.
+type FacetQuery struct {
+	Column string
+	Query  string
+	Args   []any
+}
+
+// NewFacetCount creates a new FacetCount instance for the given query.
+func NewFacetCount(query string) *FacetCount {
+	return &FacetCount{
+		query:           strings.TrimSpace(query),
+		placeHolderType: getGlobalOptions().placeHolderType(),
+	}
+}
+
+// WithArgs sets the arguments of the base query.
+func (f *FacetCount) WithArgs(args ...any) *FacetCount {
+	f.args = args
+	return f
+}
+
+// WithPlaceHolderType sets the placeholder type of the built facet queries.
+// It is useful when you want to override the global options.
+func (f *FacetCount) WithPlaceHolderType(placeHolderType PlaceHolderType) *FacetCount {
+	f.placeHolderType = placeHolderType
+	return f
+}
+
+// By adds a facet on the given column or expression, e.g. "a.status".
+// May be called multiple times; facet queries are built in registration order.
+func (f *FacetCount) By(column string, opts ...FacetOptions) *FacetCount {
+
+	fc := facet{column: strings.TrimSpace(column)}
+	if len(opts) > 0 {
+		fc.options = opts[0]
+	}
+
+	f.facets = append(f.facets, fc)
+	return f
+
+}
+
+// Build builds one count query per facet, in registration order.
+func (f *FacetCount) Build() ([]FacetQuery, error) {
+
+	if len(f.facets) == 0 {
+		return nil, fmt.Errorf("at least one facet is required")
+	}
+
+	marked, err := markUserPlaceholders(f.query)
+	if err != nil {
+		return nil, err
+	}
+
+	queries := make([]FacetQuery, 0, len(f.facets))
+
+	for _, fc := range f.facets {
+		q, err := f.buildFacet(marked, fc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build facet %q: %w", fc.column, err)
+		}
+		queries = append(queries, q)
+	}
+
+	return queries, nil
+
+}
+
+// buildFacet builds the count query of a single facet from the marked base query.
+func (f *FacetCount) buildFacet(marked string, fc facet) (FacetQuery, error) {
+
+	m := modifier.NewSQLModifier(marked)
+
+	if fc.options.ExcludeFilter != "" {
+		filter, err := markUserPlaceholders(fc.options.ExcludeFilter)
+		if err != nil {
+			return FacetQuery{}, err
+		}
+		want := normalizeFacetPredicate(filter)
+		removed, err := m.RemoveWhereConditions(func(condition string) bool {
+			return normalizeFacetPredicate(condition) == want
+		})
+		if err != nil {
+			return FacetQuery{}, err
+		}
+		if removed == 0 {
+			return FacetQuery{}, fmt.Errorf("filter %q not found in the WHERE clause", fc.options.ExcludeFilter)
+		}
+	}
+
+	m.StripUnusedLeftJoins(fc.column)
+	if err := m.ConvertToFacetCount(fc.column); err != nil {
+		return FacetQuery{}, err
+	}
+	m.StripUnusedCTEs()
+
+	query, err := m.Build()
+	if err != nil {
+		return FacetQuery{}, err
+	}
+
+	query, args, err := restoreUserPlaceholders(query, f.args, f.placeHolderType)
+	if err != nil {
+		return FacetQuery{}, err
+	}
+
+	return FacetQuery{
+		Column: fc.column,
+		Query:  query,
+		Args:   args,
+	}, nil
+
+}
+
+// normalizeFacetPredicate normalizes a marked predicate for comparison: placeholder
+// markers become "?", whitespace is collapsed (and dropped around parentheses,
+// commas, and comparison operators), enclosing parentheses are removed,
+// and letters are uppercased.
+func normalizeFacetPredicate(predicate string) string {
+
+	predicate = userPlaceholderMarkerRe.ReplaceAllString(predicate, "?")
+	predicate = strings.ToUpper(strings.Join(strings.Fields(predicate), " "))
+	predicate = facetSpaceAroundPunctRe.ReplaceAllString(predicate, "$1")
+	for strings.HasPrefix(predicate, "(") && strings.HasSuffix(predicate, ")") && enclosedByParens(predicate) {
+		predicate = strings.TrimSpace(predicate[1 : len(predicate)-1])
+	}
+	return predicate
+
+}
+
+var facetSpaceAroundPunctRe = regexp.MustCompile(`\s*([(),=<>!])\s*`)
+
+// enclosedByParens reports whether the opening parenthesis at s[0] is closed by
+// the last byte of s.
+func enclosedByParens(s string) bool {
+
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i == len(s)-1
+			}
+		}
+	}
+	return false
+
+}
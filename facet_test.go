@@ -0,0 +1,189 @@
+package kuysor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewFacetCount(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		args      []any
+		column    string
+		options   FacetOptions
+		phType    PlaceHolderType
+		expected  string
+		argsOut   []any
+		expectErr bool
+	}{
+		{
+			name:     "simple facet",
+			query:    "SELECT a.id, a.name FROM account a WHERE a.deleted_at = 0",
+			column:   "a.status",
+			expected: "select a.status, count(*) from account a where a.deleted_at = 0 group by a.status",
+		},
+		{
+			name:     "args kept and order by limit stripped",
+			query:    "SELECT a.id FROM account a WHERE a.type = ? AND a.status = ? ORDER BY a.id LIMIT 10",
+			args:     []any{"corp", "active"},
+			column:   "a.status",
+			expected: "select a.status, count(*) from account a where a.type = ? and a.status = ? group by a.status",
+			argsOut:  []any{"corp", "active"},
+		},
+		{
+			name:     "exclude own filter drops predicate and its arg",
+			query:    "SELECT a.id FROM account a WHERE a.type = ? AND a.status = ? AND a.region = ?",
+			args:     []any{"corp", "active", "eu"},
+			column:   "a.status",
+			options:  FacetOptions{ExcludeFilter: "a.status = ?"},
+			expected: "select a.status, count(*) from account a where a.type = ? and a.region = ? group by a.status",
+			argsOut:  []any{"corp", "eu"},
+		},
+		{
+			name:     "exclude only filter drops where",
+			query:    "SELECT a.id FROM account a WHERE (a.status IN (?, ?))",
+			args:     []any{"active", "blocked"},
+			column:   "a.status",
+			options:  FacetOptions{ExcludeFilter: "a.status in (?,?)"},
+			expected: "select a.status, count(*) from account a group by a.status",
+			argsOut:  []any{},
+		},
+		{
+			name:     "left join kept for facet column, unused pruned",
+			query:    "SELECT a.id, p.name FROM account a LEFT JOIN category c ON c.id = a.category_id LEFT JOIN profile p ON p.account_id = a.id WHERE a.type = ?",
+			args:     []any{"corp"},
+			column:   "c.name",
+			expected: "select c.name, count(*) from account a left join category c on c.id = a.category_id where a.type = ? group by c.name",
+			argsOut:  []any{"corp"},
+		},
+		{
+			name:     "left join only needed by excluded filter is pruned with its arg",
+			query:    "SELECT a.id FROM account a LEFT JOIN tag t ON t.account_id = a.id AND t.kind = ? WHERE t.name = ? AND a.type = ?",
+			args:     []any{"label", "vip", "corp"},
+			column:   "a.type",
+			options:  FacetOptions{ExcludeFilter: "t.name = ?"},
+			expected: "select a.type, count(*) from account a where a.type = ? group by a.type",
+			argsOut:  []any{"corp"},
+		},
+		{
+			name:     "CTE kept and dollar placeholders renumbered",
+			query:    "WITH f AS (SELECT id FROM account WHERE tenant = $1) SELECT a.id FROM f JOIN account a ON a.id = f.id WHERE a.status = $2 AND a.type = $3",
+			args:     []any{"t1", "active", "corp"},
+			column:   "a.status",
+			options:  FacetOptions{ExcludeFilter: "a.status = $2"},
+			phType:   Dollar,
+			expected: "with f as (select id from account where tenant = $1) select a.status, count(*) from f join account a on a.id = f.id where a.type = $2 group by a.status",
+			argsOut:  []any{"t1", "corp"},
+		},
+		{
+			name:     "between is not split",
+			query:    "SELECT a.id FROM account a WHERE a.created_at BETWEEN ? AND ? AND a.status = ?",
+			args:     []any{1, 2, "active"},
+			column:   "a.status",
+			options:  FacetOptions{ExcludeFilter: "a.status = ?"},
+			expected: "select a.status, count(*) from account a where a.created_at between ? and ? group by a.status",
+			argsOut:  []any{1, 2},
+		},
+		{
+			name:      "excluded filter not found",
+			query:     "SELECT a.id FROM account a WHERE a.type = ?",
+			args:      []any{"corp"},
+			column:    "a.status",
+			options:   FacetOptions{ExcludeFilter: "a.status = ?"},
+			expectErr: true,
+		},
+		{
+			name:      "top-level OR cannot be split",
+			query:     "SELECT a.id FROM account a WHERE a.type = ? OR a.status = ?",
+			args:      []any{"corp", "active"},
+			column:    "a.status",
+			options:   FacetOptions{ExcludeFilter: "a.status = ?"},
+			expectErr: true,
+		},
+		{
+			name:      "group by rejected",
+			query:     "SELECT a.type, COUNT(*) FROM account a GROUP BY a.type",
+			column:    "a.status",
+			expectErr: true,
+		},
+		{
+			name:      "missing args",
+			query:     "SELECT a.id FROM account a WHERE a.type = ?",
+			column:    "a.status",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewFacetCount(tt.query).
+				WithArgs(tt.args...).
+				WithPlaceHolderType(tt.phType).
+				By(tt.column, tt.options).
+				Build()
+			if tt.expectErr {
+				if err == nil {
+					t.Error("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("expected 1 facet query, got %d", len(got))
+			}
+			if q := strings.ToLower(got[0].Query); q != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, q)
+			}
+			if len(got[0].Args) != len(tt.argsOut) {
+				t.Fatalf("expected args %v, got %v", tt.argsOut, got[0].Args)
+			}
+			for i, v := range tt.argsOut {
+				if got[0].Args[i] != v {
+					t.Errorf("arg[%d]: expected %v, got %v", i, v, got[0].Args[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNewFacetCountMultipleFacets(t *testing.T) {
+	query := "SELECT a.id FROM account a WHERE a.status = ? AND a.type = ?"
+
+	got, err := NewFacetCount(query).
+		WithArgs("active", "corp").
+		By("a.status", FacetOptions{ExcludeFilter: "a.status = ?"}).
+		By("a.type", FacetOptions{ExcludeFilter: "a.type = ?"}).
+		By("a.region").
+		Build()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []FacetQuery{
+		{Column: "a.status", Query: "select a.status, count(*) from account a where a.type = ? group by a.status", Args: []any{"corp"}},
+		{Column: "a.type", Query: "select a.type, count(*) from account a where a.status = ? group by a.type", Args: []any{"active"}},
+		{Column: "a.region", Query: "select a.region, count(*) from account a where a.status = ? and a.type = ? group by a.region", Args: []any{"active", "corp"}},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d facet queries, got %d", len(expected), len(got))
+	}
+	for i, e := range expected {
+		if got[i].Column != e.Column {
+			t.Errorf("facet[%d]: expected column %q, got %q", i, e.Column, got[i].Column)
+		}
+		if q := strings.ToLower(got[i].Query); q != e.Query {
+			t.Errorf("facet[%d]: expected %q, got %q", i, e.Query, q)
+		}
+		if len(got[i].Args) != len(e.Args) {
+			t.Fatalf("facet[%d]: expected args %v, got %v", i, e.Args, got[i].Args)
+		}
+		for j, v := range e.Args {
+			if got[i].Args[j] != v {
+				t.Errorf("facet[%d] arg[%d]: expected %v, got %v", i, j, v, got[i].Args[j])
+			}
+		}
+	}
+}
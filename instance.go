@@ -7,7 +7,7 @@ type Instance struct {
 // NewInstance creates a new Kuysor instance with the given options.
 // It is useful for grouping multiple queries with the same options.
 // For example, if you manage multiple databases with different options, let's say you have Postgres and MySQL databases in the same application,
-// you can create an instance for each database with different options, one with PlaceHolderType=Dollar and the other with PlaceHolderType=Question.
+// you can create an instance for each database with different options, one with Dialect=PostgreSQL and the other with Dialect=MySQL.
 func NewInstance(opt ...Options) *Instance {
 
 	i := &Instance{}
@@ -29,7 +29,9 @@ func (i *Instance) NewQuery(query string, paginationType PaginationType) *Kuysor
 		sql: query,
 	}
 
-	p.options = i.options
+	// copy the options so query-level overrides don't leak into the instance options
+	opts := *i.options
+	p.options = &opts
 
 	if paginationType != "" {
 		p.uTabling = &uTabling{
@@ -0,0 +1,286 @@
+// Package lexer splits SQL queries into tokens. It is shared by kuysor and the
+// modifier package so that placeholder and clause detection never match inside
+// string literals, comments or quoted identifiers.
+package lexer
+
+import "strings"
+
+// Kind is the kind of a token.
+type Kind uint8
+
+const (
+	// Space is a run of whitespace.
+	Space Kind = iota
+	// Comment is a "-- ..." line comment (without its newline) or a
+	// "/* ... */" block comment, which may be nested.
+	Comment
+	// String is a string literal: '...' (with '' or backslash escapes), a
+	// prefixed E'...', N'...', X'...' or B'...', or a dollar-quoted $$...$$ or
+	// $tag$...$tag$.
+	String
+	// Ident is a quoted identifier: "...", `...` or [...].
+	Ident
+	// Placeholder is a positional placeholder: ?, $n, @pn or :n.
+	Placeholder
+	// Named is a named placeholder: :name or @name.
+	Named
+	// Word is a keyword, an unquoted identifier, a number or a @@variable.
+	Word
+	// Symbol is any other character, or a "::" cast operator.
+	Symbol
+)
+
+// Token is a token of a query. Text is query[Pos:Pos+len(Text)].
+type Token struct {
+	Kind Kind
+	Pos  int
+	Text string
+}
+
+// Tokenize splits query into tokens. Concatenating their texts gives back query.
+// An unterminated literal, comment or quoted identifier runs to the end of query.
+func Tokenize(query string) []Token {
+
+	var (
+		tokens []Token
+		i      int
+	)
+
+	emit := func(kind Kind, end int) {
+		tokens = append(tokens, Token{Kind: kind, Pos: i, Text: query[i:end]})
+		i = end
+	}
+
+	for i < len(query) {
+		c := query[i]
+		switch {
+		case isSpace(c):
+			end := i + 1
+			for end < len(query) && isSpace(query[end]) {
+				end++
+			}
+			emit(Space, end)
+
+		case c == '-' && peek(query, i+1) == '-':
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query)
+			} else {
+				end += i
+			}
+			emit(Comment, end)
+
+		case c == '/' && peek(query, i+1) == '*':
+			emit(Comment, blockCommentEnd(query, i))
+
+		case c == '\'':
+			emit(String, quotedEnd(query, i, '\'', true))
+
+		case (c == 'E' || c == 'e' || c == 'N' || c == 'n' || c == 'X' || c == 'x' || c == 'B' || c == 'b') &&
+			peek(query, i+1) == '\'' && !isNameChar(prev(query, i)):
+			emit(String, quotedEnd(query, i+1, '\'', true))
+
+		case c == '"' || c == '`':
+			emit(Ident, quotedEnd(query, i, c, false))
+
+		case c == '[' && !isNameChar(prev(query, i)) && prev(query, i) != ']' && prev(query, i) != ')':
+			emit(Ident, quotedEnd(query, i, ']', false))
+
+		case c == '?':
+			emit(Placeholder, i+1)
+
+		case c == '$' && isDigit(peek(query, i+1)):
+			emit(Placeholder, digitsEnd(query, i+1))
+
+		case c == '$':
+			if end, ok := dollarQuotedEnd(query, i); ok {
+				emit(String, end)
+				continue
+			}
+			emit(Symbol, i+1)
+
+		case c == ':' && peek(query, i+1) == ':':
+			emit(Symbol, i+2)
+
+		case c == ':' && !isNameChar(prev(query, i)) && isDigit(peek(query, i+1)):
+			emit(Placeholder, digitsEnd(query, i+1))
+
+		case c == ':' && !isNameChar(prev(query, i)) && isNameStart(peek(query, i+1)):
+			emit(Named, nameEnd(query, i+1))
+
+		case c == '@' && peek(query, i+1) == '@':
+			emit(Word, nameEnd(query, i+2))
+
+		case c == '@' && peek(query, i+1) == 'p' && isDigit(peek(query, i+2)) && !isNameChar(peek(query, digitsEnd(query, i+2))):
+			emit(Placeholder, digitsEnd(query, i+2))
+
+		case c == '@' && !isNameChar(prev(query, i)) && isNameStart(peek(query, i+1)):
+			emit(Named, nameEnd(query, i+1))
+
+		case isNameChar(c):
+			emit(Word, nameEnd(query, i))
+
+		default:
+			emit(Symbol, i+1)
+		}
+	}
+
+	return tokens
+
+}
+
+// Mask returns a copy of query of the same byte length in which keywords and
+// parentheses can be searched without matching inside literals or comments:
+// comments and the contents of string literals are blanked, the contents of
+// quoted identifiers are replaced by '_', ASCII letters are uppercased and other
+// non-ASCII bytes become '_'. Positions found in the mask are valid in query.
+func Mask(query string) string {
+
+	b := []byte(query)
+	for _, t := range Tokenize(query) {
+		end := t.Pos + len(t.Text)
+		switch t.Kind {
+		case Comment:
+			fill(b[t.Pos:end], ' ')
+		case String:
+			open, close := literalDelimiters(t.Text)
+			fill(b[t.Pos+open:end-close], ' ')
+		case Ident:
+			if len(t.Text) > 2 {
+				fill(b[t.Pos+1:end-1], '_')
+			}
+		}
+	}
+
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case c >= 0x80:
+			b[i] = '_'
+		}
+	}
+
+	return string(b)
+
+}
+
+// literalDelimiters returns the length of the opening and closing delimiters of a
+// string literal token, e.g. 2 and 1 for E'...', or 5 and 5 for $tag$...$tag$.
+func literalDelimiters(text string) (open, close int) {
+	if text[0] == '$' {
+		open = strings.IndexByte(text[1:], '$') + 2
+		if len(text) >= 2*open && text[len(text)-open:] == text[:open] {
+			return open, open
+		}
+		return open, 0
+	}
+	open = strings.IndexByte(text, '\'') + 1
+	if len(text) > open && text[len(text)-1] == '\'' {
+		return open, 1
+	}
+	return open, 0
+}
+
+func fill(b []byte, c byte) {
+	for i := range b {
+		b[i] = c
+	}
+}
+
+// quotedEnd returns the position just past the quoted text starting at
+// query[start], closed by quote. A doubled quote is an escaped quote, and so is a
+// backslash-escaped one when backslash is true.
+func quotedEnd(query string, start int, quote byte, backslash bool) int {
+	for i := start + 1; i < len(query); i++ {
+		switch {
+		case backslash && query[i] == '\\':
+			i++
+		case query[i] == quote && peek(query, i+1) == quote:
+			i++
+		case query[i] == quote:
+			return i + 1
+		}
+	}
+	return len(query)
+}
+
+// blockCommentEnd returns the position just past the block comment starting at
+// query[start], honouring nested comments.
+func blockCommentEnd(query string, start int) int {
+	depth := 0
+	for i := start; i < len(query)-1; i++ {
+		switch {
+		case query[i] == '/' && query[i+1] == '*':
+			depth++
+			i++
+		case query[i] == '*' && query[i+1] == '/':
+			depth--
+			i++
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(query)
+}
+
+// dollarQuotedEnd returns the position just past the dollar-quoted string starting
+// at query[start], and false when query[start] does not open one.
+func dollarQuotedEnd(query string, start int) (int, bool) {
+	tagEnd := start + 1
+	if isNameStart(peek(query, tagEnd)) {
+		for isNameChar(peek(query, tagEnd)) {
+			tagEnd++
+		}
+	}
+	if peek(query, tagEnd) != '$' {
+		return 0, false
+	}
+	tag := query[start : tagEnd+1]
+	if end := strings.Index(query[tagEnd+1:], tag); end >= 0 {
+		return tagEnd + 1 + end + len(tag), true
+	}
+	return len(query), true
+}
+
+func digitsEnd(query string, i int) int {
+	for i < len(query) && isDigit(query[i]) {
+		i++
+	}
+	return i
+}
+
+func nameEnd(query string, i int) int {
+	for i < len(query) && (isNameChar(query[i]) || query[i] == '$') {
+		i++
+	}
+	return i
+}
+
+func peek(query string, i int) byte {
+	if i < 0 || i >= len(query) {
+		return 0
+	}
+	return query[i]
+}
+
+func prev(query string, i int) byte {
+	return peek(query, i-1)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || isDigit(c)
+}
@@ -0,0 +1,84 @@
+package lexer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	testCases := []struct {
+		name  string
+		in    string
+		kind  Kind
+		token string // the first token of kind
+	}{
+		{name: "doubled quote", in: "a = 'it''s' AND b", kind: String, token: "'it''s'"},
+		{name: "backslash escape", in: `a = 'it\'s' AND b`, kind: String, token: `'it\'s'`},
+		{name: "escape string", in: `a = E'\'' AND b`, kind: String, token: `E'\''`},
+		{name: "national string", in: "a = N'x' AND b", kind: String, token: "N'x'"},
+		{name: "dollar quoted", in: "a = $$it's$$ AND b", kind: String, token: "$$it's$$"},
+		{name: "tagged dollar quoted", in: "a = $fn$ $$ $fn$ AND b", kind: String, token: "$fn$ $$ $fn$"},
+		{name: "line comment", in: "a -- WHERE (\nAND b", kind: Comment, token: "-- WHERE ("},
+		{name: "nested block comment", in: "a /* x /* y */ z */ b", kind: Comment, token: "/* x /* y */ z */"},
+		{name: "double quoted identifier", in: `SELECT "a""b" FROM t`, kind: Ident, token: `"a""b"`},
+		{name: "bracket identifier", in: "SELECT [a]]b] FROM t", kind: Ident, token: "[a]]b]"},
+		{name: "array subscript", in: "SELECT a[1] FROM t", kind: Symbol, token: "["},
+		{name: "question placeholder", in: "a = ?", kind: Placeholder, token: "?"},
+		{name: "dollar placeholder", in: "a = $12", kind: Placeholder, token: "$12"},
+		{name: "internal placeholder", in: "a = $0", kind: Placeholder, token: "$0"},
+		{name: "at placeholder", in: "a = @p3", kind: Placeholder, token: "@p3"},
+		{name: "colon placeholder", in: "a = :1", kind: Placeholder, token: ":1"},
+		{name: "placeholder in literal", in: "a = '?' AND b = $1", kind: Placeholder, token: "$1"},
+		{name: "named colon", in: "a = :status", kind: Named, token: ":status"},
+		{name: "named at", in: "a = @pid", kind: Named, token: "@pid"},
+		{name: "cast is not named", in: "a::text = :v", kind: Named, token: ":v"},
+		{name: "system variable", in: "@@ROWCOUNT > 0", kind: Word, token: "@@ROWCOUNT"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				sb    strings.Builder
+				found string
+			)
+			for _, token := range Tokenize(tc.in) {
+				if tc.in[token.Pos:token.Pos+len(token.Text)] != token.Text {
+					t.Fatalf("token %q does not match its position %d", token.Text, token.Pos)
+				}
+				if token.Kind == tc.kind && found == "" {
+					found = token.Text
+				}
+				sb.WriteString(token.Text)
+			}
+			if sb.String() != tc.in {
+				t.Errorf("tokens do not concatenate to the input: %q", sb.String())
+			}
+			if found != tc.token {
+				t.Errorf("expected %q, got %q", tc.token, found)
+			}
+		})
+	}
+}
+
+func TestMask(t *testing.T) {
+	testCases := []struct {
+		in  string
+		out string
+	}{
+		{in: "select 'a(b' from t", out: "SELECT '   ' FROM T"},
+		{in: `select "order" from t`, out: `SELECT "_____" FROM T`},
+		{in: "a /* limit */ b -- where\nc", out: "A             B         \nC"},
+		{in: "x = $q$ ) $q$", out: "X = $Q$   $Q$"},
+		{in: "x = 'é'", out: "X = '  '"},
+	}
+
+	for _, tc := range testCases {
+		got := Mask(tc.in)
+		if got != tc.out {
+			t.Errorf("Mask(%q): expected %q, got %q", tc.in, tc.out, got)
+		}
+		if len(got) != len(tc.in) {
+			t.Errorf("Mask(%q): length changed from %d to %d", tc.in, len(tc.in), len(got))
+		}
+	}
+}
@@ -4,6 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
+
+	"github.com/redhajuanda/kuysor/internal/lexer"
+	"github.com/redhajuanda/kuysor/modifier"
 )
 
 type Kuysor struct {
@@ -13,6 +17,11 @@ type Kuysor struct {
 	options  *Options
 	uArgs    []any
 	vArgs    []any
+
+	namedArgs   any          // set by WithNamedArgs
+	namedOutput bool         // set by WithNamedOutput
+	marked      *markedQuery // the query with its placeholders marked, set at build
+	args        []any        // the args of the built query, set at build
 }
 
 type PaginationType string
@@ -30,7 +39,9 @@ func NewQuery(query string, paginationType PaginationType) *Kuysor {
 		sql: query,
 	}
 
-	p.options = getGlobalOptions()
+	// copy the options so query-level overrides don't leak into the global options
+	opts := *getGlobalOptions()
+	p.options = &opts
 
 	if paginationType != "" {
 		p.uTabling = &uTabling{
@@ -64,6 +75,51 @@ func (p *Kuysor) WithOrderBy(orderBy ...string) *Kuysor {
 
 }
 
+// WithSortExpr declares the sort column key, as passed to WithOrderBy, as the SQL
+// expression expr, e.g. WithSortExpr("name", "LOWER(a.name)") with
+// WithOrderBy("name", "a.id"). Use it to sort by a function, a JSON path, or a
+// SELECT-list alias, which the WHERE clause cannot reference. The expression is
+// used in the ORDER BY and the cursor condition, and the key is the name the
+// cursor values are read from, so the query must select the expression as key,
+// e.g. "SELECT LOWER(a.name) AS name, ...". Inside a CTE or derived table target,
+// the expression is written as in its body.
+func (p *Kuysor) WithSortExpr(key, expr string) *Kuysor {
+
+	p.setSortExpr(key, sortExpr{expr: expr})
+	return p
+
+}
+
+// WithAggregateSort declares the sort column key, as passed to WithOrderBy, as the
+// aggregate expr, e.g. WithAggregateSort("total", "SUM(o.amount)") with
+// WithOrderBy("-total", "c.id") to page a GROUP BY report by its totals. The
+// expression is used in the ORDER BY, and the cursor condition goes into HAVING,
+// as aggregates cannot be used in WHERE. A query without GROUP BY, e.g. one
+// sorted by a window function, is wrapped in a derived table whose key column is
+// filtered and sorted instead. The query must select the expression as key, which
+// is the name the cursor values are read from.
+func (p *Kuysor) WithAggregateSort(key, expr string) *Kuysor {
+
+	p.setSortExpr(key, sortExpr{expr: expr, aggregate: true})
+	return p
+
+}
+
+// setSortExpr sets the expression of the sort key.
+func (p *Kuysor) setSortExpr(key string, e sortExpr) {
+
+	if p.uTabling == nil {
+		p.uTabling = &uTabling{}
+	}
+
+	if p.uTabling.sortExprs == nil {
+		p.uTabling.sortExprs = make(map[string]sortExpr)
+	}
+
+	p.uTabling.sortExprs[key] = e
+
+}
+
 // WithLimit sets the limit for the query.
 func (p *Kuysor) WithLimit(limit int) *Kuysor {
 
@@ -106,6 +162,30 @@ func (p *Kuysor) WithArgs(args ...any) *Kuysor {
 
 }
 
+// WithNamedArgs sets the arguments of a query written with named placeholders,
+// e.g. "WHERE status = :status" or "WHERE status = @status". arg is either a
+// map[string]any or a struct (or pointer to one) whose fields are named by their
+// "db" tag, falling back to the lowercased field name, as in sqlx.
+// The built query binds positional placeholders of the configured type unless
+// WithNamedOutput is enabled. It cannot be combined with WithArgs.
+func (p *Kuysor) WithNamedArgs(arg any) *Kuysor {
+
+	p.namedArgs = arg
+	return p
+
+}
+
+// WithNamedOutput keeps the named placeholders in the built query when the query
+// uses WithNamedArgs. The placeholders injected by kuysor are named kuysor_1,
+// kuysor_2, ... and Result.Args holds one sql.NamedArg per name; see also
+// Result.ArgsMap.
+func (p *Kuysor) WithNamedOutput(enabled bool) *Kuysor {
+
+	p.namedOutput = enabled
+	return p
+
+}
+
 // WithCursor sets the cursor for the query.
 func (p *Kuysor) WithCursor(cursor string) *Kuysor {
 
@@ -128,6 +208,7 @@ func (p *Kuysor) WithCursor(cursor string) *Kuysor {
 func (p *Kuysor) WithPlaceHolderType(placeHolderType PlaceHolderType) *Kuysor {
 
 	p.options.PlaceHolderType = placeHolderType
+	p.options.placeHolderTypeSet = true
 	return p
 
 }
@@ -152,6 +233,7 @@ func (p *Kuysor) WithCTETarget(cteName string, opts ...CTEOptions) *Kuysor {
 	}
 
 	p.uTabling.uPaging.CTETarget = cteName
+	p.uTabling.uPaging.SubqueryTarget = false
 
 	if len(opts) > 0 {
 		p.uTabling.uPaging.CTEOptions = &opts[0]
@@ -161,21 +243,36 @@ func (p *Kuysor) WithCTETarget(cteName string, opts ...CTEOptions) *Kuysor {
 
 }
 
+// WithSubqueryTarget sets the alias of the derived table whose body should receive
+// the WHERE, ORDER BY, and LIMIT modifications instead of the main query, e.g. "p"
+// in "SELECT ... FROM (SELECT ...) p JOIN ...". It is the WithCTETarget of databases
+// or queries without CTEs, such as MySQL 5.7, and takes the same CTEOptions: the
+// routing modes and ColumnMap apply to the derived table as they do to a CTE body.
+// The derived table must be in the FROM or JOIN clauses of the main query. It
+// replaces any WithCTETarget.
+func (p *Kuysor) WithSubqueryTarget(alias string, opts ...CTEOptions) *Kuysor {
+
+	p.WithCTETarget(alias, opts...)
+	p.uTabling.uPaging.SubqueryTarget = true
+	return p
+
+}
+
 // WithCTESecondaryTarget registers an ADDITIONAL CTE whose body also receives the
 // cursor WHERE, ORDER BY, and LIMIT — on top of the primary WithCTETarget. Use it
 // for stacked CTEs where an upstream id-gathering CTE (e.g. a UNION of ownership
 // lookups) should be capped early as well as the primary filtering CTE.
 //
 // Constraints:
-//   - A primary WithCTETarget must also be set.
-//   - The secondary CTE must be defined BEFORE the primary CTE in the WITH clause
-//     (its injected placeholders must appear earlier in the SQL string).
-//   - Only opts.ColumnMap is honored; the clauses are always injected into the CTE
-//     body (never mirrored on the main query). For a UNION CTE body the union is
-//     auto-wrapped in a derived table, so the column must reference the union's
-//     output column (use ColumnMap, e.g. {"t.id": "id"}).
+//   - A primary WithCTETarget must also be set. The secondary CTE may be defined
+//     before or after it in the WITH clause.
+//   - Only opts.ColumnMap and opts.InferColumnMap are honored; the clauses are
+//     always injected into the CTE body (never mirrored on the main query). For a
+//     UNION CTE body the union is auto-wrapped in a derived table, so the column
+//     must reference the union's output column (use ColumnMap, e.g. {"t.id": "id"},
+//     or InferColumnMap).
 //
-// May be called multiple times; register secondaries in WITH-clause order.
+// May be called multiple times, once per secondary CTE.
 func (p *Kuysor) WithCTESecondaryTarget(cteName string, opts ...CTEOptions) *Kuysor {
 
 	if p.uTabling == nil {
@@ -202,6 +299,110 @@ func (p *Kuysor) WithCTESecondaryTarget(cteName string, opts ...CTEOptions) *Kuy
 func (p *Kuysor) WithNullSortMethod(method NullSortMethod) *Kuysor {
 
 	p.options.NullSortMethod = method
+	p.options.nullSortMethodSet = true
+	return p
+
+}
+
+// WithRangeGuard enables or disables the leading-column range guard for the query.
+// It is useful when you want to override the instance options or the global options.
+// See Options.RangeGuard.
+func (p *Kuysor) WithRangeGuard(enabled bool) *Kuysor {
+
+	p.options.RangeGuard = enabled
+	return p
+
+}
+
+// WithLocking adds the row-locking clause of mode after the ORDER BY and LIMIT of
+// the paginated statement, or of the CTE body when WithCTETarget is used, e.g.
+// "... ORDER BY id ASC LIMIT ? FOR UPDATE SKIP LOCKED" for job workers claiming
+// rows in keyset order. Cursor pages then fetch exactly the limit, so no extra
+// row is locked, and the next cursor returned by SanitizeMap / SanitizeStruct
+// resumes after the last claimed row. Build fails when the dialect does not
+// support the mode, and for previous-page cursors.
+func (p *Kuysor) WithLocking(mode LockMode) *Kuysor {
+
+	if p.uTabling == nil {
+		p.uTabling = &uTabling{}
+	}
+
+	if p.uTabling.uPaging == nil {
+		p.uTabling.uPaging = &uPaging{}
+	}
+
+	p.uTabling.uPaging.Locking = mode
+	return p
+
+}
+
+// WithClausePolicy sets what happens to the ORDER BY, LIMIT, OFFSET and FETCH
+// clauses of the query when kuysor sets its own.
+// It is useful when you want to override the instance options or the global options.
+// See Options.ClausePolicy.
+func (p *Kuysor) WithClausePolicy(policy ClausePolicy) *Kuysor {
+
+	p.options.ClausePolicy = policy
+	return p
+
+}
+
+// WithFormat sets the layout of the generated SQL for the query.
+// It is useful when you want to override the instance options or the global options.
+// See Options.Format.
+func (p *Kuysor) WithFormat(format Format) *Kuysor {
+
+	p.options.Format = format
+	return p
+
+}
+
+// WithStableShape enables or disables the stable shape mode for the query.
+// It is useful when you want to override the instance options or the global options.
+// See Options.StableShape.
+func (p *Kuysor) WithStableShape(enabled bool) *Kuysor {
+
+	p.options.StableShape = enabled
+	return p
+
+}
+
+// WithUnionPushDown enables or disables pushing the page down into the branches of
+// a main-level UNION for the query.
+// It is useful when you want to override the instance options or the global options.
+// See Options.UnionPushDown.
+func (p *Kuysor) WithUnionPushDown(enabled bool) *Kuysor {
+
+	p.options.UnionPushDown = enabled
+	return p
+
+}
+
+// WithExpandSlices enables or disables the expansion of slice args for the query.
+// It is useful when you want to override the instance options or the global options.
+// See Options.ExpandSlices.
+func (p *Kuysor) WithExpandSlices(enabled bool) *Kuysor {
+
+	p.options.ExpandSlices = enabled
+	return p
+
+}
+
+// WithDialect sets the SQL dialect for the query.
+// It is useful when you want to override the instance options or the global options.
+func (p *Kuysor) WithDialect(dialect Dialect) *Kuysor {
+
+	p.options.Dialect = dialect
+	return p
+
+}
+
+// WithTotalCountMaxAge enables carrying the total count inside the cursor for the query.
+// It is useful when you want to override the instance options or the global options.
+// See Result.SetTotal and Result.CachedTotal.
+func (p *Kuysor) WithTotalCountMaxAge(maxAge time.Duration) *Kuysor {
+
+	p.options.TotalCountMaxAge = maxAge
 	return p
 
 }
@@ -220,6 +421,7 @@ func (p *Kuysor) build() (*Result, error) {
 		sql      string
 		result   *Result
 		uTabling = p.uTabling
+		err      error
 	)
 
 	// validate user input
@@ -229,32 +431,117 @@ func (p *Kuysor) build() (*Result, error) {
 	if uTabling.uPaging != nil && uTabling.uPaging.PaginationType == Cursor && uTabling.uSort == nil {
 		return result, errors.New("sort is required for cursor pagination")
 	}
-	if uTabling.uPaging != nil && uTabling.uPaging.CTETarget != "" && !strings.Contains(strings.ToUpper(p.sql), "WITH") {
+	if uTabling.uPaging != nil && uTabling.uPaging.CTETarget != "" && !uTabling.uPaging.SubqueryTarget && !strings.Contains(lexer.Mask(p.sql), "WITH") {
 		return result, errors.New("CTETarget requires a query with a WITH clause")
 	}
 	if p.uArgs == nil {
 		p.uArgs = make([]any, 0)
 	}
+	if p.namedArgs != nil {
+		if len(p.uArgs) > 0 {
+			return result, errors.New("WithArgs cannot be combined with WithNamedArgs")
+		}
+		if p.marked, err = bindNamedArgs(p.sql, p.namedArgs); err != nil {
+			return result, fmt.Errorf("failed to bind named args: %v", err)
+		}
+	} else {
+		expected, err := countUserArgs(p.sql)
+		if err != nil {
+			return result, err
+		}
+		if expected != len(p.uArgs) {
+			return result, &ArgCountError{Expected: expected, Actual: len(p.uArgs)}
+		}
+		query, err := markUserPlaceholders(p.sql)
+		if err != nil {
+			return result, err
+		}
+		p.marked = &markedQuery{query: query, args: p.uArgs}
+	}
 
 	// prepare vTabling
-	err := p.prepareVTabling()
+	err = p.prepareVTabling()
 	if err != nil {
 		return result, fmt.Errorf("failed to prepare vTabling: %v", err)
 	}
+	if err = p.validateLocking(); err != nil {
+		return result, err
+	}
 
 	// build the query
 	sql, err = newBuilder(p).build()
 	if err != nil {
-		return result, fmt.Errorf("failed to build query: %v", err)
+		return result, fmt.Errorf("failed to build query: %w", err)
 	}
 
 	return &Result{
 		Query: sql,
-		Args:  p.uArgs,
+		Args:  p.args,
 		ks:    p,
 	}, nil
 }
 
+// validateLocking checks that the lock mode set by WithLocking is supported by the
+// dialect and that the cursor, if any, is not a previous-page cursor. The locked
+// statement, the target body or the main query, must not be a UNION, group its
+// rows, or be sorted by an aggregate, which wraps it in a derived table: the
+// databases reject a locking clause there.
+func (p *Kuysor) validateLocking() error {
+
+	up := p.uTabling.uPaging
+	if up == nil || up.Locking == NoLock {
+		return nil
+	}
+
+	mode := up.Locking
+	if mode.clause() == "" {
+		return fmt.Errorf("unsupported lock mode: %d", mode)
+	}
+	if d := p.options.Dialect; d != nil && !d.SupportsLocking(mode) {
+		return fmt.Errorf("dialect %s does not support %s", d.Name(), mode.clause())
+	}
+	if c := p.vTabling.vCursor; c != nil && c.Prefix.isPrev() {
+		return errors.New("locking does not support previous-page cursors")
+	}
+	if s := p.vTabling.vSorts; s != nil && s.hasAggregate() {
+		return errors.New("locking does not support sorting by an aggregate")
+	}
+
+	mod := modifier.NewSQLModifier(p.query())
+	if d := p.options.Dialect; d != nil {
+		mod.SetGrammar(d.Clauses())
+	}
+	switch {
+	case up.CTETarget == "":
+		if mod.HasMainUnion() {
+			return errors.New("locking does not support a UNION query")
+		}
+	case up.SubqueryTarget:
+		mod.SetSubqueryTarget(up.CTETarget)
+	default:
+		mod.SetCTETarget(up.CTETarget)
+	}
+	grouped, err := mod.HasGroupBy()
+	if err != nil {
+		return err
+	}
+	if grouped {
+		return errors.New("locking does not support a GROUP BY query")
+	}
+	return nil
+
+}
+
+// query returns the query to paginate: the user query, with its placeholders
+// replaced by markers so that the args of the clauses replaced by kuysor are
+// dropped.
+func (p *Kuysor) query() string {
+	if p.marked != nil {
+		return p.marked.query
+	}
+	return p.sql
+}
+
 // prepareVTabling prepares the vTabling data.
 // vTabling is the parsed version of uTabling, it is used internally to build the query.
 func (p *Kuysor) prepareVTabling() (err error) {
@@ -324,12 +611,16 @@ func (p *Kuysor) prepareVTablingSort() (err error) {
 	)
 
 	// parse sort
-	p.vTabling.vSorts = parseSort(p.uTabling.uSort.Sorts, p.options.NullSortMethod)
+	p.vTabling.vSorts = parseSort(p.uTabling.uSort.Sorts, p.options.nullSortMethod())
 
-	for _, vSort := range *p.vTabling.vSorts {
+	for i, vSort := range *p.vTabling.vSorts {
 		if vSort.isNullable() {
 			counterNullable++
 		}
+		if e, ok := p.uTabling.sortExprs[vSort.column]; ok {
+			(*p.vTabling.vSorts)[i].expr = e.expr
+			(*p.vTabling.vSorts)[i].aggregate = e.aggregate
+		}
 	}
 	if counterNullable > 1 {
 		return errors.New("only one nullable sort is allowed")
@@ -1,8 +1,12 @@
 package kuysor
 
 import (
+	"database/sql"
+	"errors"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestCursorFirstPageQuestion(t *testing.T) {
@@ -183,6 +187,31 @@ func TestCursorFirstPageColon(t *testing.T) {
 	}
 }
 
+func TestQueryOverridesDoNotLeak(t *testing.T) {
+
+	global := getGlobalOptions()
+	placeHolderType, nullSortMethod := global.PlaceHolderType, global.NullSortMethod
+
+	NewQuery("SELECT * FROM `table`", Cursor).
+		WithPlaceHolderType(Dollar).
+		WithNullSortMethod(CaseWhen)
+
+	if global.PlaceHolderType != placeHolderType || global.NullSortMethod != nullSortMethod {
+		t.Errorf("global options changed: got %+v", *global)
+	}
+
+	i := NewInstance(Options{PlaceHolderType: Question, NullSortMethod: BoolSort})
+
+	i.NewQuery("SELECT * FROM `table`", Cursor).
+		WithPlaceHolderType(At).
+		WithNullSortMethod(FirstLast)
+
+	if i.options.PlaceHolderType != Question || i.options.NullSortMethod != BoolSort {
+		t.Errorf("instance options changed: got %+v", *i.options)
+	}
+
+}
+
 func TestCursorSecondPage(t *testing.T) {
 	var testCases = []struct {
 		in        string
@@ -198,7 +227,7 @@ func TestCursorSecondPage(t *testing.T) {
 			paramsIn:  []any{1},
 			paramsOut: []any{1, "01KCR6ET11CM8M45GNQQHJS7K0", 11},
 			cursor:    "eyJwcmVmaXgiOiJuZXh0IiwiY29scyI6eyJpZCI6IjAxS0NSNkVUMTFDTThNNDVHTlFRSEpTN0swIn19",
-			out:       `WITH last_activity_log AS ( SELECT object_instance, MAX(created_at) AS created_at FROM activity_log WHERE kind = 'internal-ticket-activity-log' AND JSON_TYPE(JSON_EXTRACT(attribute, '$.log')) = 'OBJECT' AND JSON_LENGTH(JSON_EXTRACT(attribute, '$.log')) > 0 GROUP BY object_instance ) select it.id, it.code, it.name, it.stage, lal.created_at as stage_changed_at, it.assigned_to_id, it.total_awb, it.complaining_hub_id, it.team_id, team.name as team_name, team.code as team_code, it.assigned_to_timestamp, it.attribute, it.created_at, it.updated_at, branch.indexed_property_1 as complaining_hub__id, branch.code as complaining_hub__code, branch.name as complaining_hub__name from internal_ticket it left join account team on team.id = it.team_id LEFT JOIN account branch ON branch.indexed_property_1 = it.complaining_hub_id left join account assigned_to on assigned_to.id = it.assigned_to_id left join last_activity_log lal ON lal.object_instance = it.id where it.deleted_at = 0 and it.assigned_to_id in (?) and (it.id < ?) ORDER BY it.id DESC LIMIT ?`,
+			out:       `WITH last_activity_log AS ( SELECT object_instance, MAX(created_at) AS created_at FROM activity_log WHERE kind = 'internal-ticket-activity-log' AND JSON_TYPE(JSON_EXTRACT(attribute, '$.log')) = 'OBJECT' AND JSON_LENGTH(JSON_EXTRACT(attribute, '$.log')) > 0 GROUP BY object_instance ) select it.id, it.code, it.name, it.stage, lal.created_at as stage_changed_at, it.assigned_to_id, it.total_awb, it.complaining_hub_id, it.team_id, team.name as team_name, team.code as team_code, it.assigned_to_timestamp, it.attribute, it.created_at, it.updated_at, branch.indexed_property_1 as complaining_hub__id, branch.code as complaining_hub__code, branch.name as complaining_hub__name from internal_ticket it left join account team on team.id = it.team_id LEFT JOIN account branch ON branch.indexed_property_1 = it.complaining_hub_id left join account assigned_to on assigned_to.id = it.assigned_to_id left join last_activity_log lal ON lal.object_instance = it.id where (it.deleted_at = 0 and it.assigned_to_id in (?)) and (it.id < ?) ORDER BY it.id DESC LIMIT ?`,
 		},
 	}
 
@@ -729,7 +758,8 @@ func TestCTETargetOptions(t *testing.T) {
 			cursor:         base64Encode(`{"prefix":"next","cols":{"id":"100"}}`),
 			wantCTENotHas:  []string{"t.id >"},
 			wantMainHas:    []string{"t.id >"},
-			wantArgs:       []any{"active", "100", 11},
+			// placeholder string order: CTE LIMIT → main WHERE
+			wantArgs: []any{"active", 11, "100"},
 		},
 		{
 			name: "cursor WHERE both — WHERE in CTE and main",
@@ -1229,3 +1259,1675 @@ func TestCTEDualTargetOwnedAndFiltered(t *testing.T) {
 		}
 	}
 }
+
+// TestTotalCountInCursor verifies that a total set on the first page is carried
+// in the generated cursors, reused by later pages while fresh, and reported as
+// stale once it is older than the max age.
+func TestTotalCountInCursor(t *testing.T) {
+	defer func() { now = time.Now }()
+	start := time.Unix(1700000000, 0)
+	now = func() time.Time { return start }
+
+	rows := func(from int) *[]map[string]any {
+		data := make([]map[string]any, 0, 11)
+		for i := from; i < from+11; i++ {
+			data = append(data, map[string]any{"id": i})
+		}
+		return &data
+	}
+
+	// first page: no cached total yet
+	res, err := NewQuery("SELECT id FROM account", Cursor).
+		WithOrderBy("id").
+		WithLimit(10).
+		WithTotalCountMaxAge(time.Minute).
+		Build()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := res.CachedTotal(); ok {
+		t.Fatal("expected no cached total on the first page")
+	}
+	res.SetTotal(42)
+	next, _, err := res.SanitizeMap(rows(1))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// second page within the max age: total reused and carried forward
+	now = func() time.Time { return start.Add(30 * time.Second) }
+	res, err = NewQuery("SELECT id FROM account", Cursor).
+		WithOrderBy("id").
+		WithLimit(10).
+		WithTotalCountMaxAge(time.Minute).
+		WithCursor(next).
+		Build()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	total, ok := res.CachedTotal()
+	if !ok || total != 42 {
+		t.Fatalf("expected cached total 42, got %d (ok=%v)", total, ok)
+	}
+	next, prev, err := res.SanitizeMap(rows(11))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, c := range []string{next, prev} {
+		vc, err := cursorBase64(c).parse()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if vc.Total == nil || *vc.Total != 42 || vc.CountedAt != start.Unix() {
+			t.Errorf("expected total 42 counted at %d, got %v at %d", start.Unix(), vc.Total, vc.CountedAt)
+		}
+	}
+
+	// third page past the max age: kuysor signals a recount
+	now = func() time.Time { return start.Add(2 * time.Minute) }
+	res, err = NewQuery("SELECT id FROM account", Cursor).
+		WithOrderBy("id").
+		WithLimit(10).
+		WithTotalCountMaxAge(time.Minute).
+		WithCursor(next).
+		Build()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := res.CachedTotal(); ok {
+		t.Error("expected stale cached total to be reported as not ok")
+	}
+}
+
+// TestTotalCountDisabledByDefault verifies cursors carry no total unless a max age is set.
+func TestTotalCountDisabledByDefault(t *testing.T) {
+	res, err := NewQuery("SELECT id FROM account", Cursor).WithOrderBy("id").WithLimit(1).Build()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	res.SetTotal(42)
+	data := []map[string]any{{"id": 1}, {"id": 2}}
+	next, _, err := res.SanitizeMap(&data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	vc, err := cursorBase64(next).parse()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if vc.Total != nil {
+		t.Errorf("expected no total in cursor, got %d", *vc.Total)
+	}
+}
+
+func TestDialect(t *testing.T) {
+	var testCases = []struct {
+		name    string
+		dialect Dialect
+		opts    Options
+		setup   func(p *Kuysor)
+		out     string
+	}{
+		{
+			name:    "postgres placeholders and null ordering",
+			dialect: PostgreSQL,
+			out:     "SELECT * FROM account ORDER BY code ASC NULLS LAST, id ASC LIMIT $1",
+		},
+		{
+			name:    "mysql placeholders and null ordering",
+			dialect: MySQL,
+			out:     "SELECT * FROM account ORDER BY code IS NULL ASC, code ASC, id ASC LIMIT ?",
+		},
+		{
+			name:    "sqlite placeholders and null ordering",
+			dialect: SQLite,
+			out:     "SELECT * FROM account ORDER BY code IS NULL ASC, code ASC, id ASC LIMIT ?",
+		},
+		{
+			name:    "explicit options win over the dialect",
+			dialect: PostgreSQL,
+			opts:    Options{PlaceHolderType: Colon, NullSortMethod: CaseWhen},
+			out:     "SELECT * FROM account ORDER BY CASE WHEN code IS NULL THEN 1 ELSE 0 END ASC, code ASC, id ASC LIMIT :1",
+		},
+		{
+			name:    "zero-value options set with Options methods win over the dialect",
+			dialect: PostgreSQL,
+			opts:    Options{}.WithPlaceHolderType(Question).WithNullSortMethod(BoolSort),
+			out:     "SELECT * FROM account ORDER BY code IS NULL ASC, code ASC, id ASC LIMIT ?",
+		},
+		{
+			name:    "query-level overrides win over the dialect",
+			dialect: PostgreSQL,
+			setup: func(p *Kuysor) {
+				p.WithPlaceHolderType(Question).WithNullSortMethod(BoolSort)
+			},
+			out: "SELECT * FROM account ORDER BY code IS NULL ASC, code ASC, id ASC LIMIT ?",
+		},
+		{
+			name: "query-level dialect",
+			setup: func(p *Kuysor) {
+				p.WithDialect(PostgreSQL)
+			},
+			out: "SELECT * FROM account ORDER BY code ASC NULLS LAST, id ASC LIMIT $1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := tc.opts
+			if opts.Dialect == nil {
+				opts.Dialect = tc.dialect
+			}
+			p := NewInstance(opts).NewQuery("SELECT * FROM account", Cursor).
+				WithOrderBy("code null", "id").WithLimit(10)
+			if tc.setup != nil {
+				tc.setup(p)
+			}
+			res, err := p.Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.out {
+				t.Errorf("expected %s, got %s", tc.out, res.Query)
+			}
+		})
+	}
+}
+
+func TestSQLServerDialect(t *testing.T) {
+	var (
+		i         = NewInstance(Options{Dialect: SQLServer})
+		cteQuery  = "WITH c AS (SELECT t.id FROM ticket t WHERE t.s = @p1) SELECT t.id FROM c JOIN ticket t ON t.id = c.id"
+		nextPage  = base64Encode(`{"prefix":"next","cols":{"id":"100"}}`)
+		testCases = []struct {
+			name string
+			ks   *Kuysor
+			out  string
+			args []any
+		}{
+			{
+				name: "first cursor page uses TOP after DISTINCT",
+				ks:   i.NewQuery("SELECT DISTINCT a.id, a.code FROM account a WHERE a.status = @p1", Cursor).WithOrderBy("a.code null", "a.id").WithLimit(10).WithArgs("active"),
+				out:  "SELECT DISTINCT TOP (@p1) a.id, a.code FROM account a WHERE a.status = @p2 ORDER BY CASE WHEN a.code IS NULL THEN 1 ELSE 0 END ASC, a.code ASC, a.id ASC",
+				args: []any{11, "active"},
+			},
+			{
+				name: "next cursor page keeps the TOP arg first",
+				ks:   i.NewQuery("SELECT a.id, a.code FROM account a WHERE a.status = @p1", Cursor).WithOrderBy("-a.id").WithLimit(10).WithArgs("active").WithCursor(nextPage),
+				out:  "SELECT TOP (@p1) a.id, a.code FROM account a WHERE a.status = @p2 AND (a.id < @p3) ORDER BY a.id DESC",
+				args: []any{11, "active", "100"},
+			},
+			{
+				name: "offset page uses OFFSET FETCH",
+				ks:   i.NewQuery("SELECT a.id FROM account a WHERE a.status = @p1", Offset).WithOrderBy("a.id").WithLimit(10).WithOffset(20).WithArgs("active"),
+				out:  "SELECT a.id FROM account a WHERE a.status = @p1 ORDER BY a.id ASC OFFSET @p2 ROWS FETCH NEXT @p3 ROWS ONLY",
+				args: []any{"active", 20, 10},
+			},
+			{
+				name: "cursor page inside a CTE target",
+				ks:   i.NewQuery(cteQuery, Cursor).WithCTETarget("c").WithOrderBy("t.id").WithLimit(10).WithArgs("active").WithCursor(nextPage),
+				out:  "WITH c AS (SELECT TOP (@p1) t.id FROM ticket t WHERE t.s = @p2 AND (t.id > @p3) ORDER BY t.id ASC) SELECT t.id FROM c JOIN ticket t ON t.id = c.id ORDER BY t.id ASC",
+				args: []any{11, "active", "100"},
+			},
+			{
+				name: "offset page in both CTE and main query",
+				ks:   i.NewQuery(cteQuery, Offset).WithCTETarget("c", CTEOptions{LimitOffset: CTETargetModeBoth}).WithOrderBy("t.id").WithLimit(10).WithOffset(5).WithArgs("active"),
+				out:  "WITH c AS (SELECT t.id FROM ticket t WHERE t.s = @p1 ORDER BY t.id ASC OFFSET @p2 ROWS FETCH NEXT @p3 ROWS ONLY) SELECT t.id FROM c JOIN ticket t ON t.id = c.id ORDER BY t.id ASC OFFSET @p4 ROWS FETCH NEXT @p5 ROWS ONLY",
+				args: []any{"active", 5, 10, 5, 10},
+			},
+		}
+	)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := tc.ks.Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.out {
+				t.Errorf("expected %s, got %s", tc.out, res.Query)
+			}
+			if !reflect.DeepEqual(res.Args, tc.args) {
+				t.Errorf("expected args %v, got %v", tc.args, res.Args)
+			}
+		})
+	}
+}
+
+func TestResultNamedArgs(t *testing.T) {
+	res, err := NewInstance(Options{Dialect: SQLServer}).
+		NewQuery("SELECT id FROM account WHERE status = @p1", Cursor).
+		WithOrderBy("id").WithLimit(10).WithArgs("active").Build()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []any{sql.Named("p1", 11), sql.Named("p2", "active")}
+	if got := res.NamedArgs(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestOracleDialect(t *testing.T) {
+	var (
+		cteQuery  = "WITH c AS (SELECT t.id FROM ticket t WHERE t.s = :1) SELECT t.id FROM c JOIN ticket t ON t.id = c.id"
+		nextPage  = base64Encode(`{"prefix":"next","cols":{"id":"100"}}`)
+		testCases = []struct {
+			name    string
+			dialect Dialect
+			ks      func(i *Instance) *Kuysor
+			out     string
+			args    []any
+		}{
+			{
+				name:    "cursor page uses FETCH FIRST and NULLS LAST",
+				dialect: Oracle,
+				ks: func(i *Instance) *Kuysor {
+					return i.NewQuery("SELECT a.id, a.code FROM account a WHERE a.status = :1", Cursor).WithOrderBy("a.code null", "a.id").WithLimit(10).WithArgs("active")
+				},
+				out:  "SELECT a.id, a.code FROM account a WHERE a.status = :1 ORDER BY a.code ASC NULLS LAST, a.id ASC FETCH FIRST :2 ROWS ONLY",
+				args: []any{"active", 11},
+			},
+			{
+				name:    "offset page uses OFFSET and FETCH FIRST",
+				dialect: Oracle,
+				ks: func(i *Instance) *Kuysor {
+					return i.NewQuery("SELECT a.id FROM account a WHERE a.status = :1", Offset).WithOrderBy("a.id").WithLimit(10).WithOffset(20).WithArgs("active")
+				},
+				out:  "SELECT a.id FROM account a WHERE a.status = :1 ORDER BY a.id ASC OFFSET :2 ROWS FETCH FIRST :3 ROWS ONLY",
+				args: []any{"active", 20, 10},
+			},
+			{
+				name:    "cursor page inside a CTE target",
+				dialect: Oracle,
+				ks: func(i *Instance) *Kuysor {
+					return i.NewQuery(cteQuery, Cursor).WithCTETarget("c").WithOrderBy("t.id").WithLimit(10).WithArgs("active").WithCursor(nextPage)
+				},
+				out:  "WITH c AS (SELECT t.id FROM ticket t WHERE t.s = :1 AND (t.id > :2) ORDER BY t.id ASC FETCH FIRST :3 ROWS ONLY) SELECT t.id FROM c JOIN ticket t ON t.id = c.id ORDER BY t.id ASC",
+				args: []any{"active", "100", 11},
+			},
+			{
+				name:    "rownum cursor page",
+				dialect: Oracle11,
+				ks: func(i *Instance) *Kuysor {
+					return i.NewQuery("SELECT a.id FROM account a WHERE a.status = :1", Cursor).WithOrderBy("a.id").WithLimit(10).WithArgs("active").WithCursor(nextPage)
+				},
+				out:  "SELECT * FROM (SELECT a.id FROM account a WHERE a.status = :1 AND (a.id > :2) ORDER BY a.id ASC) WHERE ROWNUM <= :3",
+				args: []any{"active", "100", 11},
+			},
+			{
+				name:    "rownum offset page",
+				dialect: Oracle11,
+				ks: func(i *Instance) *Kuysor {
+					return i.NewQuery("SELECT a.id FROM account a WHERE a.status = :1", Offset).WithOrderBy("a.id").WithLimit(10).WithOffset(20).WithArgs("active")
+				},
+				out:  "SELECT id FROM (SELECT kuysor_rownum.*, ROWNUM kuysor_rn FROM (SELECT a.id FROM account a WHERE a.status = :1 ORDER BY a.id ASC) kuysor_rownum WHERE ROWNUM <= :2 + :3) WHERE kuysor_rn > :4",
+				args: []any{"active", 20, 10, 20},
+			},
+			{
+				// the offset is bound twice, and the args of the main query follow both
+				name:    "rownum offset page inside a CTE target",
+				dialect: Oracle11,
+				ks: func(i *Instance) *Kuysor {
+					return i.NewQuery(cteQuery+" WHERE t.k = :2", Offset).WithCTETarget("c").WithOrderBy("t.id").WithLimit(10).WithOffset(20).WithArgs("active", "k")
+				},
+				out:  "WITH c AS (SELECT id FROM (SELECT kuysor_rownum.*, ROWNUM kuysor_rn FROM (SELECT t.id FROM ticket t WHERE t.s = :1 ORDER BY t.id ASC) kuysor_rownum WHERE ROWNUM <= :2 + :3) WHERE kuysor_rn > :4) SELECT t.id FROM c JOIN ticket t ON t.id = c.id WHERE t.k = :5 ORDER BY t.id ASC",
+				args: []any{"active", 20, 10, 20, "k"},
+			},
+			{
+				name:    "rownum cursor page inside a CTE target",
+				dialect: Oracle11,
+				ks: func(i *Instance) *Kuysor {
+					return i.NewQuery(cteQuery, Cursor).WithCTETarget("c").WithOrderBy("t.id").WithLimit(10).WithArgs("active").WithCursor(nextPage)
+				},
+				out:  "WITH c AS (SELECT * FROM (SELECT t.id FROM ticket t WHERE t.s = :1 AND (t.id > :2) ORDER BY t.id ASC) WHERE ROWNUM <= :3) SELECT t.id FROM c JOIN ticket t ON t.id = c.id ORDER BY t.id ASC",
+				args: []any{"active", "100", 11},
+			},
+		}
+	)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := tc.ks(NewInstance(Options{Dialect: tc.dialect})).Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.out {
+				t.Errorf("expected %s, got %s", tc.out, res.Query)
+			}
+			if !reflect.DeepEqual(res.Args, tc.args) {
+				t.Errorf("expected args %v, got %v", tc.args, res.Args)
+			}
+		})
+	}
+}
+
+func TestRowValueKeyset(t *testing.T) {
+	var (
+		next      = base64Encode(`{"prefix":"next","cols":{"id":"100","code":"c"}}`)
+		testCases = []struct {
+			name    string
+			dialect Dialect
+			query   string
+			orderBy []string
+			cteOpts *CTEOptions
+			out     string
+			args    []any
+		}{
+			{
+				name:    "same direction renders a row value",
+				dialect: PostgreSQL,
+				query:   "SELECT a.id, a.code FROM account a WHERE a.status = $1",
+				orderBy: []string{"a.code", "a.id"},
+				out:     "SELECT a.id, a.code FROM account a WHERE a.status = $1 AND (a.code, a.id) > ($2, $3) ORDER BY a.code ASC, a.id ASC LIMIT $4",
+				args:    []any{"active", "c", "100", 11},
+			},
+			{
+				name:    "descending sort on mysql",
+				dialect: MySQL,
+				query:   "SELECT a.id, a.code FROM account a WHERE a.status = ?",
+				orderBy: []string{"-a.code", "-a.id"},
+				out:     "SELECT a.id, a.code FROM account a WHERE a.status = ? AND (a.code, a.id) < (?, ?) ORDER BY a.code DESC, a.id DESC LIMIT ?",
+				args:    []any{"active", "c", "100", 11},
+			},
+			{
+				name:    "mixed directions fall back to the expansion",
+				dialect: PostgreSQL,
+				query:   "SELECT a.id, a.code FROM account a WHERE a.status = $1",
+				orderBy: []string{"a.code", "-a.id"},
+				out:     "SELECT a.id, a.code FROM account a WHERE a.status = $1 AND ((a.code > $2) OR (a.code = $3 AND a.id < $4)) ORDER BY a.code ASC, a.id DESC LIMIT $5",
+				args:    []any{"active", "c", "c", "100", 11},
+			},
+			{
+				name:    "nullable column falls back to the expansion",
+				dialect: SQLite,
+				query:   "SELECT a.id, a.code FROM account a WHERE a.status = ?",
+				orderBy: []string{"a.code null", "a.id"},
+				out:     "SELECT a.id, a.code FROM account a WHERE a.status = ? AND (a.code IS NULL OR (a.code > ?) OR (a.code = ? AND a.id > ?)) ORDER BY a.code IS NULL ASC, a.code ASC, a.id ASC LIMIT ?",
+				args:    []any{"active", "c", "c", "100", 11},
+			},
+			{
+				name:    "dialect without row values falls back to the expansion",
+				dialect: SQLServer,
+				query:   "SELECT a.id, a.code FROM account a WHERE a.status = @p1",
+				orderBy: []string{"a.code", "a.id"},
+				out:     "SELECT TOP (@p1) a.id, a.code FROM account a WHERE a.status = @p2 AND ((a.code > @p3) OR (a.code = @p4 AND a.id > @p5)) ORDER BY a.code ASC, a.id ASC",
+				args:    []any{11, "active", "c", "c", "100"},
+			},
+			{
+				name:    "CTE both mode renders the row value twice",
+				dialect: PostgreSQL,
+				query:   "WITH c AS (SELECT t.id, t.code FROM ticket t WHERE t.s = $1) SELECT c.id, c.code FROM c",
+				orderBy: []string{"id", "code"},
+				cteOpts: &CTEOptions{Where: CTETargetModeBoth},
+				out:     "WITH c AS (SELECT t.id, t.code FROM ticket t WHERE t.s = $1 AND (id, code) > ($2, $3) ORDER BY id ASC, code ASC LIMIT $4) SELECT c.id, c.code FROM c WHERE (id, code) > ($5, $6) ORDER BY id ASC, code ASC",
+				args:    []any{"active", "100", "c", 11, "100", "c"},
+			},
+		}
+	)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ks := NewInstance(Options{Dialect: tc.dialect}).NewQuery(tc.query, Cursor).
+				WithOrderBy(tc.orderBy...).WithLimit(10).WithArgs("active").WithCursor(next)
+			if tc.cteOpts != nil {
+				ks.WithCTETarget("c", *tc.cteOpts)
+			}
+			res, err := ks.Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.out {
+				t.Errorf("expected %s, got %s", tc.out, res.Query)
+			}
+			if !reflect.DeepEqual(res.Args, tc.args) {
+				t.Errorf("expected args %v, got %v", tc.args, res.Args)
+			}
+		})
+	}
+}
+
+func TestRangeGuard(t *testing.T) {
+	var (
+		next      = base64Encode(`{"prefix":"next","cols":{"id":"100","code":"c"}}`)
+		prev      = base64Encode(`{"prefix":"prev","cols":{"id":"100","code":"c"}}`)
+		testCases = []struct {
+			name    string
+			query   string
+			orderBy []string
+			cursor  string
+			cteOpts *CTEOptions
+			dialect Dialect
+			out     string
+			args    []any
+		}{
+			{
+				name:    "ascending next page",
+				query:   "SELECT id, code FROM account WHERE status = ?",
+				orderBy: []string{"code", "id"},
+				cursor:  next,
+				out:     "SELECT id, code FROM account WHERE status = ? AND (code >= ? AND ((code > ?) OR (code = ? AND id > ?))) ORDER BY code ASC, id ASC LIMIT ?",
+				args:    []any{"active", "c", "c", "c", "100", 11},
+			},
+			{
+				name:    "descending next page",
+				query:   "SELECT id, code FROM account WHERE status = ?",
+				orderBy: []string{"-code", "id"},
+				cursor:  next,
+				out:     "SELECT id, code FROM account WHERE status = ? AND (code <= ? AND ((code < ?) OR (code = ? AND id > ?))) ORDER BY code DESC, id ASC LIMIT ?",
+				args:    []any{"active", "c", "c", "c", "100", 11},
+			},
+			{
+				name:    "ascending prev page",
+				query:   "SELECT id, code FROM account WHERE status = ?",
+				orderBy: []string{"code", "id"},
+				cursor:  prev,
+				out:     "SELECT id, code FROM account WHERE status = ? AND (code <= ? AND ((code < ?) OR (code = ? AND id < ?))) ORDER BY code DESC, id DESC LIMIT ?",
+				args:    []any{"active", "c", "c", "c", "100", 11},
+			},
+			{
+				name:    "single column sort has no guard",
+				query:   "SELECT id FROM account WHERE status = ?",
+				orderBy: []string{"id"},
+				cursor:  next,
+				out:     "SELECT id FROM account WHERE status = ? AND (id > ?) ORDER BY id ASC LIMIT ?",
+				args:    []any{"active", "100", 11},
+			},
+			{
+				name:    "nullable first column has no guard",
+				query:   "SELECT id, code FROM account WHERE status = ?",
+				orderBy: []string{"code null", "id"},
+				cursor:  next,
+				out:     "SELECT id, code FROM account WHERE status = ? AND (code IS NULL OR (code > ?) OR (code = ? AND id > ?)) ORDER BY code IS NULL ASC, code ASC, id ASC LIMIT ?",
+				args:    []any{"active", "c", "c", "100", 11},
+			},
+			{
+				name:    "CTE both mode keeps arg order",
+				query:   "WITH c AS (SELECT t.id, t.code FROM ticket t WHERE t.s = ?) SELECT c.id, c.code FROM c",
+				orderBy: []string{"code", "id"},
+				cursor:  next,
+				cteOpts: &CTEOptions{Where: CTETargetModeBoth},
+				out:     "WITH c AS (SELECT t.id, t.code FROM ticket t WHERE t.s = ? AND (code >= ? AND ((code > ?) OR (code = ? AND id > ?))) ORDER BY code ASC, id ASC LIMIT ?) SELECT c.id, c.code FROM c WHERE (code >= ? AND ((code > ?) OR (code = ? AND id > ?))) ORDER BY code ASC, id ASC",
+				args:    []any{"active", "c", "c", "c", "100", 11, "c", "c", "c", "100"},
+			},
+			{
+				name:    "MySQL row values keep the guard",
+				query:   "SELECT id, code FROM account WHERE status = ?",
+				orderBy: []string{"code", "id"},
+				cursor:  next,
+				dialect: MySQL,
+				out:     "SELECT id, code FROM account WHERE status = ? AND (code >= ? AND (code, id) > (?, ?)) ORDER BY code ASC, id ASC LIMIT ?",
+				args:    []any{"active", "c", "c", "100", 11},
+			},
+		}
+	)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ks := NewQuery(tc.query, Cursor).WithRangeGuard(true).
+				WithOrderBy(tc.orderBy...).WithLimit(10).WithArgs("active").WithCursor(tc.cursor)
+			if tc.cteOpts != nil {
+				ks.WithCTETarget("c", *tc.cteOpts)
+			}
+			if tc.dialect != nil {
+				ks.WithDialect(tc.dialect)
+			}
+			res, err := ks.Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.out {
+				t.Errorf("expected %s, got %s", tc.out, res.Query)
+			}
+			if !reflect.DeepEqual(res.Args, tc.args) {
+				t.Errorf("expected args %v, got %v", tc.args, res.Args)
+			}
+		})
+	}
+}
+
+func TestStableShape(t *testing.T) {
+	var (
+		query = "SELECT id, code FROM account WHERE status = ?"
+		build = func(cursor string) (*Result, error) {
+			return NewQuery(query, Cursor).WithStableShape(true).
+				WithOrderBy("code", "id").WithLimit(10).WithArgs("active").WithCursor(cursor).Build()
+		}
+		// every page renders the same statement, the direction is bound
+		stable = "SELECT id, code FROM account WHERE status = ? AND (CAST(? AS DECIMAL) IS NULL OR " +
+			"(CAST(? AS DECIMAL) = 0 AND ((code > ?) OR (code = ? AND id > ?))) OR " +
+			"(CAST(? AS DECIMAL) = 1 AND ((code < ?) OR (code = ? AND id < ?)))) " +
+			"ORDER BY CASE WHEN CAST(? AS DECIMAL) = 1 THEN NULL ELSE code END ASC, CASE WHEN CAST(? AS DECIMAL) = 1 THEN NULL ELSE id END ASC, " +
+			"CASE WHEN CAST(? AS DECIMAL) = 0 THEN NULL ELSE code END DESC, CASE WHEN CAST(? AS DECIMAL) = 0 THEN NULL ELSE id END DESC LIMIT ?"
+	)
+
+	testCases := []struct {
+		name   string
+		cursor string
+		out    string
+		args   []any
+	}{
+		{
+			name: "first page",
+			out:  stable,
+			args: []any{"active", nil, nil, nil, nil, nil, nil, nil, nil, nil, 0, 0, 0, 0, 11},
+		},
+		{
+			name:   "next page",
+			cursor: base64Encode(`{"prefix":"next","cols":{"id":"100","code":"c"}}`),
+			out:    stable,
+			args:   []any{"active", 0, 0, "c", "c", "100", 0, "c", "c", "100", 0, 0, 0, 0, 11},
+		},
+		{
+			name:   "prev page",
+			cursor: base64Encode(`{"prefix":"prev","cols":{"id":"100","code":"c"}}`),
+			out:    stable,
+			args:   []any{"active", 1, 1, "c", "c", "100", 1, "c", "c", "100", 1, 1, 1, 1, 11},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := build(tc.cursor)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.out {
+				t.Errorf("expected %s, got %s", tc.out, res.Query)
+			}
+			if !reflect.DeepEqual(res.Args, tc.args) {
+				t.Errorf("expected args %v, got %v", tc.args, res.Args)
+			}
+		})
+	}
+
+	t.Run("row values", func(t *testing.T) {
+		res, err := NewQuery("SELECT id, code FROM account WHERE status = $1", Cursor).
+			WithDialect(PostgreSQL).WithStableShape(true).
+			WithOrderBy("code", "id").WithLimit(10).WithArgs("active").Build()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := "SELECT id, code FROM account WHERE status = $1 AND (CAST($2 AS DECIMAL) IS NULL OR " +
+			"(CAST($3 AS DECIMAL) = 0 AND (code, id) > ($4, $5)) OR (CAST($6 AS DECIMAL) = 1 AND (code, id) < ($7, $8))) " +
+			"ORDER BY CASE WHEN CAST($9 AS DECIMAL) = 1 THEN NULL ELSE code END ASC, CASE WHEN CAST($10 AS DECIMAL) = 1 THEN NULL ELSE id END ASC, " +
+			"CASE WHEN CAST($11 AS DECIMAL) = 0 THEN NULL ELSE code END DESC, CASE WHEN CAST($12 AS DECIMAL) = 0 THEN NULL ELSE id END DESC LIMIT $13"
+		if res.Query != expected {
+			t.Errorf("expected %s, got %s", expected, res.Query)
+		}
+	})
+
+	t.Run("nullable sort", func(t *testing.T) {
+		res, err := NewQuery(query, Cursor).WithStableShape(true).
+			WithOrderBy("code null", "id").WithLimit(10).WithArgs("active").
+			WithCursor(base64Encode(`{"prefix":"next","cols":{"id":"100","code":null}}`)).Build()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := "SELECT id, code FROM account WHERE status = ? AND (CAST(? AS DECIMAL) IS NULL OR " +
+			"(CAST(? AS DECIMAL) = 0 AND (((code > ? OR (code IS NULL AND CAST(? AS DECIMAL) = 0))) OR " +
+			"((code = ? OR (code IS NULL AND CAST(? AS DECIMAL) = 1)) AND id > ?))) OR " +
+			"(CAST(? AS DECIMAL) = 1 AND (((code < ? OR (code IS NOT NULL AND CAST(? AS DECIMAL) = 1))) OR " +
+			"((code = ? OR (code IS NULL AND CAST(? AS DECIMAL) = 1)) AND id < ?)))) " +
+			"ORDER BY CASE WHEN CAST(? AS DECIMAL) = 1 THEN NULL ELSE code IS NULL END ASC, CASE WHEN CAST(? AS DECIMAL) = 1 THEN NULL ELSE code END ASC, " +
+			"CASE WHEN CAST(? AS DECIMAL) = 1 THEN NULL ELSE id END ASC, CASE WHEN CAST(? AS DECIMAL) = 0 THEN NULL ELSE code IS NULL END DESC, " +
+			"CASE WHEN CAST(? AS DECIMAL) = 0 THEN NULL ELSE code END DESC, CASE WHEN CAST(? AS DECIMAL) = 0 THEN NULL ELSE id END DESC LIMIT ?"
+		if res.Query != expected {
+			t.Errorf("expected %s, got %s", expected, res.Query)
+		}
+		args := []any{"active", 0, 0, nil, 1, nil, 1, "100", 0, nil, 1, nil, 1, "100", 0, 0, 0, 0, 0, 0, 11}
+		if !reflect.DeepEqual(res.Args, args) {
+			t.Errorf("expected args %v, got %v", args, res.Args)
+		}
+	})
+}
+
+func TestNamedArgs(t *testing.T) {
+	type filter struct {
+		Status  string `db:"status"`
+		MinAge  int    `db:"min_age"`
+		Country string
+		Ignored string `db:"-"`
+	}
+
+	var (
+		query    = "SELECT id, age FROM account WHERE status = :status AND age >= :min_age AND (country = :country OR :country = '') AND note <> 'a:b' AND id::text <> ''"
+		nextPage = base64Encode(`{"prefix":"next","cols":{"id":"100"}}`)
+		args     = map[string]any{"status": "active", "min_age": 18, "country": "ID"}
+	)
+
+	testCases := []struct {
+		name string
+		ks   func() *Kuysor
+		out  string
+		args []any
+	}{
+		{
+			name: "map binds positional question placeholders",
+			ks: func() *Kuysor {
+				return NewQuery(query, Cursor).WithOrderBy("id").WithLimit(10).WithNamedArgs(args).WithCursor(nextPage)
+			},
+			out:  "SELECT id, age FROM account WHERE (status = ? AND age >= ? AND (country = ? OR ? = '') AND note <> 'a:b' AND id::text <> '') AND (id > ?) ORDER BY id ASC LIMIT ?",
+			args: []any{"active", 18, "ID", "ID", "100", 11},
+		},
+		{
+			name: "struct binds positional dollar placeholders",
+			ks: func() *Kuysor {
+				return NewQuery(query, Cursor).WithDialect(PostgreSQL).WithOrderBy("id").WithLimit(10).WithCursor(nextPage).
+					WithNamedArgs(&filter{Status: "active", MinAge: 18, Country: "ID"})
+			},
+			out:  "SELECT id, age FROM account WHERE (status = $1 AND age >= $2 AND (country = $3 OR $4 = '') AND note <> 'a:b' AND id::text <> '') AND (id > $5) ORDER BY id ASC LIMIT $6",
+			args: []any{"active", 18, "ID", "ID", "100", 11},
+		},
+		{
+			name: "named output keeps the names",
+			ks: func() *Kuysor {
+				return NewQuery(query, Cursor).WithOrderBy("id").WithLimit(10).WithNamedArgs(args).WithNamedOutput(true).WithCursor(nextPage)
+			},
+			out: "SELECT id, age FROM account WHERE (status = :status AND age >= :min_age AND (country = :country OR :country = '') AND note <> 'a:b' AND id::text <> '') AND (id > :kuysor_1) ORDER BY id ASC LIMIT :kuysor_2",
+			args: []any{
+				sql.Named("status", "active"), sql.Named("min_age", 18), sql.Named("country", "ID"),
+				sql.Named("kuysor_1", "100"), sql.Named("kuysor_2", 11),
+			},
+		},
+		{
+			name: "named output expands slices",
+			ks: func() *Kuysor {
+				return NewQuery("SELECT id FROM account WHERE status = :status AND id IN (:ids) AND :status <> ''", Cursor).
+					WithOrderBy("id").WithLimit(10).WithExpandSlices(true).WithCursor(nextPage).
+					WithNamedArgs(map[string]any{"status": "active", "ids": []int{1, 2}}).WithNamedOutput(true)
+			},
+			out: "SELECT id FROM account WHERE (status = :status AND id IN (:ids_1, :ids_2) AND :status <> '') AND (id > :kuysor_1) ORDER BY id ASC LIMIT :kuysor_2",
+			args: []any{
+				sql.Named("status", "active"), sql.Named("ids_1", 1), sql.Named("ids_2", 2),
+				sql.Named("kuysor_1", "100"), sql.Named("kuysor_2", 11),
+			},
+		},
+		{
+			name: "at-style names on SQL Server",
+			ks: func() *Kuysor {
+				return NewQuery("SELECT id FROM account WHERE status = @status AND @@ROWCOUNT >= 0", Offset).WithDialect(SQLServer).
+					WithOrderBy("id").WithLimit(10).WithOffset(20).WithNamedArgs(args)
+			},
+			out:  "SELECT id FROM account WHERE status = @p1 AND @@ROWCOUNT >= 0 ORDER BY id ASC OFFSET @p2 ROWS FETCH NEXT @p3 ROWS ONLY",
+			args: []any{"active", 20, 10},
+		},
+		{
+			name: "at-style named output with TOP",
+			ks: func() *Kuysor {
+				return NewQuery("SELECT id FROM account WHERE status = @status", Cursor).WithDialect(SQLServer).
+					WithOrderBy("id").WithLimit(10).WithNamedArgs(args).WithNamedOutput(true).WithCursor(nextPage)
+			},
+			out:  "SELECT TOP (@kuysor_1) id FROM account WHERE status = @status AND (id > @kuysor_2) ORDER BY id ASC",
+			args: []any{sql.Named("kuysor_1", 11), sql.Named("status", "active"), sql.Named("kuysor_2", "100")},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := tc.ks().Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.out {
+				t.Errorf("expected %s, got %s", tc.out, res.Query)
+			}
+			if !reflect.DeepEqual(res.Args, tc.args) {
+				t.Errorf("expected args %v, got %v", tc.args, res.Args)
+			}
+		})
+	}
+
+	t.Run("args map", func(t *testing.T) {
+		res, err := NewQuery(query, Offset).WithOrderBy("id").WithLimit(10).WithNamedArgs(args).WithNamedOutput(true).Build()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := map[string]any{"status": "active", "min_age": 18, "country": "ID", "kuysor_1": 10, "kuysor_2": 0}
+		if got := res.ArgsMap(); !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %v, got %v", expected, got)
+		}
+	})
+
+	errorCases := []struct {
+		name string
+		ks   *Kuysor
+	}{
+		{"missing name", NewQuery("SELECT id FROM account WHERE status = :state", Offset).WithLimit(10).WithNamedArgs(args)},
+		{"mixed with WithArgs", NewQuery(query, Offset).WithLimit(10).WithNamedArgs(args).WithArgs("active")},
+		{"mixed with positional placeholders", NewQuery("SELECT id FROM account WHERE status = :status AND age > ?", Offset).WithLimit(10).WithNamedArgs(args)},
+		{"unsupported arg type", NewQuery(query, Offset).WithLimit(10).WithNamedArgs([]any{"active"})},
+		{"empty slice with named output", NewQuery("SELECT id FROM account WHERE id IN (:ids)", Offset).WithLimit(10).
+			WithExpandSlices(true).WithNamedArgs(map[string]any{"ids": []int{}}).WithNamedOutput(true)},
+	}
+	for _, tc := range errorCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := tc.ks.Build(); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestExpandSlices(t *testing.T) {
+	nextPage := base64Encode(`{"prefix":"next","cols":{"id":"100"}}`)
+
+	testCases := []struct {
+		name string
+		ks   func() *Kuysor
+		out  string
+		args []any
+	}{
+		{
+			name: "question placeholders",
+			ks: func() *Kuysor {
+				return NewQuery("SELECT id FROM account WHERE id IN (?) AND status = ?", Cursor).WithExpandSlices(true).
+					WithOrderBy("id").WithLimit(10).WithArgs([]int{1, 2, 3}, "active").WithCursor(nextPage)
+			},
+			out:  "SELECT id FROM account WHERE (id IN (?, ?, ?) AND status = ?) AND (id > ?) ORDER BY id ASC LIMIT ?",
+			args: []any{1, 2, 3, "active", "100", 11},
+		},
+		{
+			name: "dollar placeholders are renumbered",
+			ks: func() *Kuysor {
+				return NewQuery("SELECT id FROM account WHERE status = $1 AND id IN ($2)", Cursor).WithDialect(PostgreSQL).WithExpandSlices(true).
+					WithOrderBy("id").WithLimit(10).WithArgs("active", []string{"a", "b"}).WithCursor(nextPage)
+			},
+			out:  "SELECT id FROM account WHERE (status = $1 AND id IN ($2, $3)) AND (id > $4) ORDER BY id ASC LIMIT $5",
+			args: []any{"active", "a", "b", "100", 11},
+		},
+		{
+			name: "at placeholders with TOP",
+			ks: func() *Kuysor {
+				return NewQuery("SELECT id FROM account WHERE id IN (@p1)", Cursor).WithDialect(SQLServer).WithExpandSlices(true).
+					WithOrderBy("id").WithLimit(10).WithArgs([2]int{1, 2})
+			},
+			out:  "SELECT TOP (@p1) id FROM account WHERE id IN (@p2, @p3) ORDER BY id ASC",
+			args: []any{11, 1, 2},
+		},
+		{
+			name: "named args",
+			ks: func() *Kuysor {
+				return NewQuery("SELECT id FROM account WHERE id IN (:ids)", Offset).WithDialect(Oracle).WithExpandSlices(true).
+					WithOrderBy("id").WithLimit(10).WithNamedArgs(map[string]any{"ids": []int{1, 2}})
+			},
+			out:  "SELECT id FROM account WHERE id IN (:1, :2) ORDER BY id ASC OFFSET :3 ROWS FETCH FIRST :4 ROWS ONLY",
+			args: []any{1, 2, 0, 10},
+		},
+		{
+			name: "bytes are not expanded",
+			ks: func() *Kuysor {
+				return NewQuery("SELECT id FROM file WHERE hash = ?", Offset).WithExpandSlices(true).
+					WithOrderBy("id").WithLimit(10).WithArgs([]byte("abc"))
+			},
+			out:  "SELECT id FROM file WHERE hash = ? ORDER BY id ASC LIMIT ? OFFSET ?",
+			args: []any{[]byte("abc"), 10, 0},
+		},
+		{
+			name: "disabled by default",
+			ks: func() *Kuysor {
+				return NewQuery("SELECT id FROM account WHERE id IN (?)", Offset).
+					WithOrderBy("id").WithLimit(10).WithArgs([]int{1, 2})
+			},
+			out:  "SELECT id FROM account WHERE id IN (?) ORDER BY id ASC LIMIT ? OFFSET ?",
+			args: []any{[]int{1, 2}, 10, 0},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := tc.ks().Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.out {
+				t.Errorf("expected %s, got %s", tc.out, res.Query)
+			}
+			if !reflect.DeepEqual(res.Args, tc.args) {
+				t.Errorf("expected args %v, got %v", tc.args, res.Args)
+			}
+		})
+	}
+
+	t.Run("empty slice", func(t *testing.T) {
+		_, err := NewQuery("SELECT id FROM account WHERE id IN (?)", Offset).WithExpandSlices(true).
+			WithOrderBy("id").WithLimit(10).WithArgs([]int{}).Build()
+		if err == nil {
+			t.Error("expected error, got nil")
+		}
+	})
+}
+
+func TestArgCount(t *testing.T) {
+	testCases := []struct {
+		name     string
+		query    string
+		dialect  Dialect
+		args     []any
+		expected int
+	}{
+		{name: "too few question args", query: "SELECT id FROM account WHERE status = ? AND age > ?", args: []any{"active"}, expected: 2},
+		{name: "too many question args", query: "SELECT id FROM account WHERE status = ?", args: []any{"active", 18}, expected: 1},
+		{name: "reused dollar placeholder counts once", query: "SELECT id FROM account WHERE a = $1 OR b = $1 OR c = $2", dialect: PostgreSQL, args: []any{"x"}, expected: 2},
+		{name: "at placeholders", query: "SELECT id FROM account WHERE a = @p1 AND b = @p2", dialect: SQLServer, args: nil, expected: 2},
+		{name: "placeholders in quotes are ignored", query: "SELECT id FROM account WHERE note = '?' AND a = ?", args: []any{}, expected: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ks := NewQuery(tc.query, Offset).WithOrderBy("id").WithLimit(10).WithArgs(tc.args...)
+			if tc.dialect != nil {
+				ks.WithDialect(tc.dialect)
+			}
+			_, err := ks.Build()
+
+			var argErr *ArgCountError
+			if !errors.As(err, &argErr) {
+				t.Fatalf("expected ArgCountError, got %v", err)
+			}
+			if argErr.Expected != tc.expected || argErr.Actual != len(tc.args) {
+				t.Errorf("expected %d/%d, got %d/%d", tc.expected, len(tc.args), argErr.Expected, argErr.Actual)
+			}
+		})
+	}
+
+	t.Run("reused and reordered numbered placeholders", func(t *testing.T) {
+		res, err := NewQuery("SELECT id FROM account WHERE b = $2 AND (a = $1 OR c = $1)", Cursor).WithDialect(PostgreSQL).
+			WithOrderBy("id").WithLimit(10).WithArgs("x", "y").
+			WithCursor(base64Encode(`{"prefix":"next","cols":{"id":"100"}}`)).Build()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := "SELECT id FROM account WHERE (b = $1 AND (a = $2 OR c = $3)) AND (id > $4) ORDER BY id ASC LIMIT $5"
+		if res.Query != expected {
+			t.Errorf("expected %s, got %s", expected, res.Query)
+		}
+		args := []any{"y", "x", "x", "100", 11}
+		if !reflect.DeepEqual(res.Args, args) {
+			t.Errorf("expected args %v, got %v", args, res.Args)
+		}
+	})
+
+	t.Run("mixed placeholder styles rejected", func(t *testing.T) {
+		_, err := NewQuery("SELECT id FROM account WHERE a = ? AND b = $1", Offset).WithDialect(PostgreSQL).
+			WithOrderBy("id").WithLimit(10).WithArgs("x").Build()
+		if err == nil || !strings.Contains(err.Error(), "mixes placeholder styles") {
+			t.Errorf("expected a mixed placeholder styles error, got %v", err)
+		}
+	})
+
+	t.Run("rebuild uses the new args", func(t *testing.T) {
+		ks := NewQuery("SELECT id FROM account WHERE status = ?", Offset).WithOrderBy("id").WithLimit(10).WithArgs("active")
+		if _, err := ks.Build(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res, err := ks.WithArgs("blocked").Build()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		args := []any{"blocked", 10, 0}
+		if !reflect.DeepEqual(res.Args, args) {
+			t.Errorf("expected args %v, got %v", args, res.Args)
+		}
+
+		var argErr *ArgCountError
+		if _, err := ks.WithArgs("active", 18).Build(); !errors.As(err, &argErr) {
+			t.Errorf("expected ArgCountError, got %v", err)
+		}
+	})
+}
+
+func TestFormat(t *testing.T) {
+	query := "SELECT id\nFROM account -- active only\nWHERE status = ?\nORDER BY id"
+
+	testCases := []struct {
+		name     string
+		format   Format
+		expected string
+	}{
+		{
+			name:     "compact",
+			format:   Compact,
+			expected: "SELECT id FROM account -- active only\nWHERE status = ? ORDER BY id ASC LIMIT ?",
+		},
+		{
+			name:     "preserve",
+			format:   Preserve,
+			expected: "SELECT id\nFROM account -- active only\nWHERE status = ?\nORDER BY id ASC LIMIT ?",
+		},
+		{
+			name:     "pretty",
+			format:   Pretty,
+			expected: "SELECT id\nFROM account -- active only\nWHERE status = ?\nORDER BY id ASC\nLIMIT ?",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := NewQuery(query, Cursor).WithOrderBy("id").WithLimit(10).WithArgs("active").WithFormat(tc.format).Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, res.Query)
+			}
+		})
+	}
+}
+
+func TestClausePolicy(t *testing.T) {
+	testCases := []struct {
+		name     string
+		query    string
+		args     []any
+		ks       func(ks *Kuysor) *Kuysor
+		expected string
+		outArgs  []any
+	}{
+		{
+			name:     "replace drops the args of the replaced clauses",
+			query:    "SELECT id FROM account WHERE status = ? ORDER BY FIELD(kind, ?, ?) LIMIT ? OFFSET ?",
+			args:     []any{"active", "a", "b", 5, 10},
+			ks:       func(ks *Kuysor) *Kuysor { return ks },
+			expected: "SELECT id FROM account WHERE status = ? ORDER BY id ASC LIMIT ?",
+			outArgs:  []any{"active", 11},
+		},
+		{
+			name:  "replace keeps numbered args aligned",
+			query: "SELECT id FROM account WHERE status = $1 LIMIT $2 FOR UPDATE",
+			args:  []any{"active", 5},
+			ks: func(ks *Kuysor) *Kuysor {
+				return ks.WithDialect(PostgreSQL).WithCursor(base64Encode(`{"prefix":"next","cols":{"id":"100"}}`))
+			},
+			expected: "SELECT id FROM account WHERE status = $1 AND (id > $2) ORDER BY id ASC LIMIT $3 FOR UPDATE",
+			outArgs:  []any{"active", "100", 11},
+		},
+		{
+			name:     "keep existing sort as secondary",
+			query:    "SELECT id FROM account WHERE status = ? ORDER BY FIELD(kind, ?, ?), id DESC LIMIT 5",
+			args:     []any{"active", "a", "b"},
+			ks:       func(ks *Kuysor) *Kuysor { return ks.WithClausePolicy(KeepExistingSort) },
+			expected: "SELECT id FROM account WHERE status = ? ORDER BY id ASC, FIELD(kind, ?, ?) LIMIT ?",
+			outArgs:  []any{"active", "a", "b", 11},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := tc.ks(NewQuery(tc.query, Cursor).WithOrderBy("id").WithLimit(10).WithArgs(tc.args...)).Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, res.Query)
+			}
+			if !reflect.DeepEqual(res.Args, tc.outArgs) {
+				t.Errorf("expected args %v, got %v", tc.outArgs, res.Args)
+			}
+		})
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		for _, query := range []string{
+			"SELECT id FROM account ORDER BY name",
+			"SELECT id FROM account LIMIT 5",
+			"WITH a AS (SELECT id FROM account OFFSET 5) SELECT id FROM a",
+		} {
+			ks := NewQuery(query, Offset).WithOrderBy("id").WithLimit(10).WithClausePolicy(RejectClauses)
+			if strings.HasPrefix(query, "WITH") {
+				ks.WithCTETarget("a")
+			}
+			if _, err := ks.Build(); !errors.Is(err, ErrExistingClause) {
+				t.Errorf("%s: expected ErrExistingClause, got %v", query, err)
+			}
+		}
+	})
+}
+
+func TestDialectClauses(t *testing.T) {
+	testCases := []struct {
+		name     string
+		dialect  Dialect
+		query    string
+		expected string
+	}{
+		{
+			name:     "postgres locking variant",
+			dialect:  PostgreSQL,
+			query:    "SELECT id FROM job WHERE status = $1 FOR NO KEY UPDATE SKIP LOCKED",
+			expected: "SELECT id FROM job WHERE status = $1 ORDER BY id ASC LIMIT $2 FOR NO KEY UPDATE SKIP LOCKED",
+		},
+		{
+			name:     "mysql into outfile",
+			dialect:  MySQL,
+			query:    "SELECT id FROM job WHERE status = ? INTO OUTFILE '/tmp/job'",
+			expected: "SELECT id FROM job WHERE status = ? ORDER BY id ASC LIMIT ? INTO OUTFILE '/tmp/job'",
+		},
+		{
+			name:     "sqlserver for json",
+			dialect:  SQLServer,
+			query:    "SELECT id FROM job WHERE status = @p1 FOR JSON PATH",
+			expected: "SELECT TOP (@p1) id FROM job WHERE status = @p2 ORDER BY id ASC FOR JSON PATH",
+		},
+		{
+			name:     "oracle hierarchical query",
+			dialect:  Oracle,
+			query:    "SELECT id FROM job WHERE status = :1 START WITH parent_id IS NULL CONNECT BY PRIOR id = parent_id",
+			expected: "SELECT id FROM job WHERE status = :1 START WITH parent_id IS NULL CONNECT BY PRIOR id = parent_id ORDER BY id ASC FETCH FIRST :2 ROWS ONLY",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := NewQuery(tc.query, Cursor).WithDialect(tc.dialect).WithOrderBy("id").WithLimit(10).WithArgs("queued").Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, res.Query)
+			}
+		})
+	}
+}
+
+func TestLocking(t *testing.T) {
+	testCases := []struct {
+		name     string
+		query    string
+		ks       func(ks *Kuysor) *Kuysor
+		expected string
+		outArgs  []any
+	}{
+		{
+			name:     "first batch fetches exactly the limit",
+			query:    "SELECT id FROM job WHERE status = $1",
+			ks:       func(ks *Kuysor) *Kuysor { return ks },
+			expected: "SELECT id FROM job WHERE status = $1 ORDER BY id ASC LIMIT $2 FOR UPDATE SKIP LOCKED",
+			outArgs:  []any{"queued", 10},
+		},
+		{
+			name:  "resumed batch",
+			query: "SELECT id FROM job WHERE status = $1",
+			ks: func(ks *Kuysor) *Kuysor {
+				return ks.WithCursor(base64Encode(`{"prefix":"next","cols":{"id":"100"}}`))
+			},
+			expected: "SELECT id FROM job WHERE status = $1 AND (id > $2) ORDER BY id ASC LIMIT $3 FOR UPDATE SKIP LOCKED",
+			outArgs:  []any{"queued", "100", 10},
+		},
+		{
+			name:  "inside the cte target",
+			query: "WITH batch AS (SELECT id FROM job WHERE status = $1) UPDATE job SET status = 'running' FROM batch WHERE job.id = batch.id RETURNING job.id",
+			ks: func(ks *Kuysor) *Kuysor {
+				return ks.WithCTETarget("batch", CTEOptions{OrderBy: CTETargetModeCTE})
+			},
+			expected: "WITH batch AS (SELECT id FROM job WHERE status = $1 ORDER BY id ASC LIMIT $2 FOR UPDATE SKIP LOCKED) " +
+				"UPDATE job SET status = 'running' FROM batch WHERE job.id = batch.id RETURNING job.id",
+			outArgs: []any{"queued", 10},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := tc.ks(NewQuery(tc.query, Cursor).
+				WithDialect(PostgreSQL).
+				WithOrderBy("id").
+				WithLimit(10).
+				WithLocking(ForUpdateSkipLocked).
+				WithArgs("queued")).
+				Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, res.Query)
+			}
+			if !reflect.DeepEqual(res.Args, tc.outArgs) {
+				t.Errorf("expected args %v, got %v", tc.outArgs, res.Args)
+			}
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		for _, ks := range []*Kuysor{
+			NewQuery("SELECT id FROM job", Cursor).WithDialect(SQLite),
+			NewQuery("SELECT id FROM job", Cursor).WithDialect(SQLServer),
+			NewQuery("SELECT id FROM job", Cursor).WithDialect(Oracle),
+			NewQuery("SELECT id FROM job", Cursor).WithCursor(base64Encode(`{"prefix":"prev","cols":{"id":"100"}}`)),
+			NewQuery("SELECT id FROM job UNION ALL SELECT id FROM archived_job", Cursor),
+			NewQuery("SELECT id FROM job GROUP BY id", Cursor),
+			NewQuery("WITH batch AS (SELECT id FROM job GROUP BY id) SELECT id FROM batch", Cursor).WithCTETarget("batch"),
+			NewQuery("SELECT id FROM job", Cursor).WithAggregateSort("id", "COUNT(*)"),
+		} {
+			if _, err := ks.WithOrderBy("id").WithLimit(10).WithLocking(ForUpdate).Build(); err == nil {
+				t.Error("expected an error")
+			}
+		}
+	})
+
+	t.Run("resume cursor", func(t *testing.T) {
+		res, err := NewQuery("SELECT id FROM job", Cursor).
+			WithOrderBy("id").
+			WithLimit(10).
+			WithLocking(ForUpdateSkipLocked).
+			Build()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// a partial batch still resumes after its last row
+		data := []map[string]any{{"id": 1}, {"id": 2}, {"id": 3}}
+		next, prev, err := res.SanitizeMap(&data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(data) != 3 {
+			t.Errorf("expected 3 rows, got %d", len(data))
+		}
+		if prev != "" {
+			t.Errorf("expected no prev cursor, got %s", prev)
+		}
+		vc, err := cursorBase64(next).parse()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !vc.Prefix.isNext() || vc.Cols["id"] != 3.0 {
+			t.Errorf("expected a next cursor after id 3, got %+v", vc)
+		}
+
+		empty := []map[string]any{}
+		if next, _, err = res.SanitizeMap(&empty); err != nil || next != "" {
+			t.Errorf("expected no cursor for an empty batch, got %q (%v)", next, err)
+		}
+	})
+}
+
+func TestMainUnion(t *testing.T) {
+	const query = "SELECT a.id, a.created_at FROM article a WHERE a.status = ? UNION ALL SELECT v.id, v.published AS created_at FROM video v"
+	cursor := base64Encode(`{"prefix":"next","cols":{"id":5,"created_at":"2024-01-01"}}`)
+
+	testCases := []struct {
+		name     string
+		ks       func(ks *Kuysor) *Kuysor
+		expected string
+		outArgs  []any
+	}{
+		{
+			name: "first page",
+			ks:   func(ks *Kuysor) *Kuysor { return ks },
+			expected: "SELECT * FROM ( SELECT a.id, a.created_at FROM article a WHERE a.status = ? UNION ALL SELECT v.id, v.published AS created_at FROM video v ) kuysor_union " +
+				"ORDER BY created_at DESC, id ASC LIMIT ?",
+			outArgs: []any{"live", 11},
+		},
+		{
+			name: "next page",
+			ks:   func(ks *Kuysor) *Kuysor { return ks.WithCursor(cursor) },
+			expected: "SELECT * FROM ( SELECT a.id, a.created_at FROM article a WHERE a.status = ? UNION ALL SELECT v.id, v.published AS created_at FROM video v ) kuysor_union " +
+				"WHERE ((created_at < ?) OR (created_at = ? AND id > ?)) ORDER BY created_at DESC, id ASC LIMIT ?",
+			outArgs: []any{"live", "2024-01-01", "2024-01-01", 5.0, 11},
+		},
+		{
+			name: "push down",
+			ks:   func(ks *Kuysor) *Kuysor { return ks.WithCursor(cursor).WithUnionPushDown(true) },
+			expected: "SELECT * FROM ( " +
+				"SELECT * FROM ( SELECT a.id, a.created_at FROM article a WHERE a.status = ? AND ((a.created_at < ?) OR (a.created_at = ? AND a.id > ?)) ORDER BY a.created_at DESC, a.id ASC LIMIT ? ) kuysor_union_1 " +
+				"UNION ALL " +
+				"SELECT * FROM ( SELECT v.id, v.published AS created_at FROM video v WHERE ((v.published < ?) OR (v.published = ? AND v.id > ?)) ORDER BY v.published DESC, v.id ASC LIMIT ? ) kuysor_union_2 " +
+				") kuysor_union WHERE ((created_at < ?) OR (created_at = ? AND id > ?)) ORDER BY created_at DESC, id ASC LIMIT ?",
+			outArgs: []any{
+				"live", "2024-01-01", "2024-01-01", 5.0, 11,
+				"2024-01-01", "2024-01-01", 5.0, 11,
+				"2024-01-01", "2024-01-01", 5.0, 11,
+			},
+		},
+		{
+			name: "sql server top",
+			ks:   func(ks *Kuysor) *Kuysor { return ks.WithDialect(SQLServer) },
+			expected: "SELECT TOP (@p1) * FROM ( SELECT a.id, a.created_at FROM article a WHERE a.status = @p2 UNION ALL SELECT v.id, v.published AS created_at FROM video v ) kuysor_union " +
+				"ORDER BY created_at DESC, id ASC",
+			outArgs: []any{11, "live"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := tc.ks(NewQuery(query, Cursor).WithOrderBy("-a.created_at", "a.id").WithLimit(10).WithArgs("live")).Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, res.Query)
+			}
+			if !reflect.DeepEqual(res.Args, tc.outArgs) {
+				t.Errorf("expected args %v, got %v", tc.outArgs, res.Args)
+			}
+		})
+	}
+
+	t.Run("renamed sort column", func(t *testing.T) {
+		_, err := NewQuery("SELECT a.id AS article_id FROM article a UNION SELECT v.id FROM video v", Cursor).
+			WithOrderBy("a.id").
+			WithLimit(10).
+			Build()
+		if err == nil {
+			t.Error("expected an error for a sort column output under another name")
+		}
+	})
+}
+
+// TestSubqueryTarget verifies that WithSubqueryTarget routes the pagination
+// clauses into a derived table, with the same CTEOptions as WithCTETarget.
+func TestSubqueryTarget(t *testing.T) {
+	const query = "SELECT t.id, t.code FROM (SELECT id FROM ticket WHERE status = ?) p JOIN ticket t ON t.id = p.id"
+	cursor := base64Encode(`{"prefix":"next","cols":{"id":100}}`)
+
+	testCases := []struct {
+		name     string
+		ks       func(ks *Kuysor) *Kuysor
+		expected string
+		outArgs  []any
+	}{
+		{
+			name: "default routing",
+			ks: func(ks *Kuysor) *Kuysor {
+				return ks.WithSubqueryTarget("p", CTEOptions{ColumnMap: map[string]string{"t.id": "id"}})
+			},
+			expected: "SELECT t.id, t.code FROM (SELECT id FROM ticket WHERE status = ? ORDER BY id ASC LIMIT ?) p JOIN ticket t ON t.id = p.id " +
+				"ORDER BY t.id ASC",
+			outArgs: []any{"active", 11},
+		},
+		{
+			name: "next page",
+			ks: func(ks *Kuysor) *Kuysor {
+				return ks.WithCursor(cursor).WithSubqueryTarget("p", CTEOptions{ColumnMap: map[string]string{"t.id": "id"}})
+			},
+			expected: "SELECT t.id, t.code FROM (SELECT id FROM ticket WHERE status = ? AND (id > ?) ORDER BY id ASC LIMIT ?) p JOIN ticket t ON t.id = p.id " +
+				"ORDER BY t.id ASC",
+			outArgs: []any{"active", 100.0, 11},
+		},
+		{
+			name: "limit on the main query",
+			ks: func(ks *Kuysor) *Kuysor {
+				return ks.WithCursor(cursor).WithSubqueryTarget("p", CTEOptions{
+					LimitOffset: CTETargetModeMain,
+					ColumnMap:   map[string]string{"t.id": "id"},
+				})
+			},
+			expected: "SELECT t.id, t.code FROM (SELECT id FROM ticket WHERE status = ? AND (id > ?) ORDER BY id ASC) p JOIN ticket t ON t.id = p.id " +
+				"ORDER BY t.id ASC LIMIT ?",
+			outArgs: []any{"active", 100.0, 11},
+		},
+		{
+			name: "order by in the derived table only",
+			ks: func(ks *Kuysor) *Kuysor {
+				return ks.WithSubqueryTarget("p", CTEOptions{OrderBy: CTETargetModeCTE, ColumnMap: map[string]string{"t.id": "id"}})
+			},
+			expected: "SELECT t.id, t.code FROM (SELECT id FROM ticket WHERE status = ? ORDER BY id ASC LIMIT ?) p JOIN ticket t ON t.id = p.id",
+			outArgs:  []any{"active", 11},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := tc.ks(NewQuery(query, Cursor).WithOrderBy("t.id").WithLimit(10).WithArgs("active")).Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, res.Query)
+			}
+			if !reflect.DeepEqual(res.Args, tc.outArgs) {
+				t.Errorf("expected args %v, got %v", tc.outArgs, res.Args)
+			}
+		})
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		for _, alias := range []string{"q", "t"} {
+			_, err := NewQuery(query, Cursor).WithSubqueryTarget(alias).WithOrderBy("t.id").WithLimit(10).WithArgs("active").Build()
+			if err == nil {
+				t.Errorf("expected an error for alias %s", alias)
+			}
+		}
+	})
+}
+
+func TestInferColumnMap(t *testing.T) {
+	cursor := base64Encode(`{"prefix":"next","cols":{"id":100}}`)
+
+	testCases := []struct {
+		name     string
+		query    string
+		ks       func(ks *Kuysor) *Kuysor
+		expected string
+		outArgs  []any
+	}{
+		{
+			name:  "cte target",
+			query: "WITH p AS (SELECT tk.id FROM ticket tk WHERE tk.status = ?) SELECT t.id, t.code FROM p JOIN ticket t ON t.id = p.id",
+			ks: func(ks *Kuysor) *Kuysor {
+				return ks.WithCTETarget("p", CTEOptions{InferColumnMap: true})
+			},
+			expected: "WITH p AS (SELECT tk.id FROM ticket tk WHERE tk.status = ? AND (tk.id > ?) ORDER BY tk.id ASC LIMIT ?) " +
+				"SELECT t.id, t.code FROM p JOIN ticket t ON t.id = p.id ORDER BY t.id ASC",
+			outArgs: []any{"active", 100.0, 11},
+		},
+		{
+			name:  "subquery target",
+			query: "SELECT t.id, t.code FROM (SELECT * FROM ticket WHERE status = ?) p JOIN ticket t ON t.id = p.id",
+			ks: func(ks *Kuysor) *Kuysor {
+				return ks.WithSubqueryTarget("p", CTEOptions{InferColumnMap: true})
+			},
+			expected: "SELECT t.id, t.code FROM (SELECT * FROM ticket WHERE status = ? AND (id > ?) ORDER BY id ASC LIMIT ?) p JOIN ticket t ON t.id = p.id " +
+				"ORDER BY t.id ASC",
+			outArgs: []any{"active", 100.0, 11},
+		},
+		{
+			name:  "explicit entries win",
+			query: "WITH p AS (SELECT tk.id FROM ticket tk WHERE tk.status = ?) SELECT t.id, t.code FROM p JOIN ticket t ON t.id = p.id",
+			ks: func(ks *Kuysor) *Kuysor {
+				return ks.WithCTETarget("p", CTEOptions{InferColumnMap: true, ColumnMap: map[string]string{"t.id": "id"}})
+			},
+			expected: "WITH p AS (SELECT tk.id FROM ticket tk WHERE tk.status = ? AND (id > ?) ORDER BY id ASC LIMIT ?) " +
+				"SELECT t.id, t.code FROM p JOIN ticket t ON t.id = p.id ORDER BY t.id ASC",
+			outArgs: []any{"active", 100.0, 11},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := tc.ks(NewQuery(tc.query, Cursor).WithCursor(cursor).WithOrderBy("t.id").WithLimit(10).WithArgs("active")).Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, res.Query)
+			}
+			if !reflect.DeepEqual(res.Args, tc.outArgs) {
+				t.Errorf("expected args %v, got %v", tc.outArgs, res.Args)
+			}
+		})
+	}
+
+	t.Run("ambiguous", func(t *testing.T) {
+		const query = "WITH p AS (SELECT * FROM ticket tk JOIN team m ON m.id = tk.team_id) SELECT t.* FROM p JOIN ticket t ON t.id = p.id"
+		_, err := NewQuery(query, Cursor).
+			WithCTETarget("p", CTEOptions{InferColumnMap: true}).
+			WithOrderBy("t.id").
+			WithLimit(10).
+			Build()
+		if !errors.Is(err, ErrAmbiguousColumn) {
+			t.Errorf("expected ErrAmbiguousColumn, got %v", err)
+		}
+	})
+}
+
+// TestInjectedArgOrder verifies that the injected args bind by placeholder
+// position, whatever the order the clauses were injected in.
+func TestInjectedArgOrder(t *testing.T) {
+	cursor := base64Encode(`{"prefix":"next","cols":{"id":100}}`)
+
+	testCases := []struct {
+		name     string
+		query    string
+		ks       func(ks *Kuysor) *Kuysor
+		expected string
+		outArgs  []any
+	}{
+		{
+			name: "secondary defined after the primary",
+			query: "WITH p AS (SELECT id FROM ticket WHERE status = ?), s AS (SELECT id FROM archive WHERE owner = ?) " +
+				"SELECT t.* FROM p JOIN s ON s.id = p.id JOIN ticket t ON t.id = p.id",
+			ks: func(ks *Kuysor) *Kuysor {
+				return ks.WithCTETarget("p", CTEOptions{OrderBy: CTETargetModeCTE, ColumnMap: map[string]string{"t.id": "id"}}).
+					WithCTESecondaryTarget("s", CTEOptions{ColumnMap: map[string]string{"t.id": "id"}})
+			},
+			expected: "WITH p AS (SELECT id FROM ticket WHERE status = ? AND (id > ?) ORDER BY id ASC LIMIT ?), " +
+				"s AS (SELECT id FROM archive WHERE owner = ? AND (id > ?) ORDER BY id ASC LIMIT ?) " +
+				"SELECT t.* FROM p JOIN s ON s.id = p.id JOIN ticket t ON t.id = p.id",
+			outArgs: []any{"active", 100.0, 11, "ACC1", 100.0, 11},
+		},
+		{
+			name:  "where and limit on both",
+			query: "WITH p AS (SELECT id FROM ticket WHERE status = ?) SELECT p.id FROM p WHERE p.id <> ?",
+			ks: func(ks *Kuysor) *Kuysor {
+				return ks.WithCTETarget("p", CTEOptions{
+					Where:       CTETargetModeBoth,
+					LimitOffset: CTETargetModeBoth,
+					ColumnMap:   map[string]string{"t.id": "id"},
+				})
+			},
+			expected: "WITH p AS (SELECT id FROM ticket WHERE status = ? AND (id > ?) ORDER BY id ASC LIMIT ?) " +
+				"SELECT p.id FROM p WHERE p.id <> ? AND (t.id > ?) ORDER BY t.id ASC LIMIT ?",
+			outArgs: []any{"active", 100.0, 11, "ACC1", 100.0, 11},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := tc.ks(NewQuery(tc.query, Cursor).WithCursor(cursor).WithOrderBy("t.id").WithLimit(10).WithArgs("active", "ACC1")).Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, res.Query)
+			}
+			if !reflect.DeepEqual(res.Args, tc.outArgs) {
+				t.Errorf("expected args %v, got %v", tc.outArgs, res.Args)
+			}
+		})
+	}
+}
+
+func TestAggregateSort(t *testing.T) {
+	const report = "SELECT c.id, SUM(o.amount) AS total FROM customer c JOIN orders o ON o.customer_id = c.id WHERE c.active = ? GROUP BY c.id"
+	cursor := base64Encode(`{"prefix":"next","cols":{"total":500,"id":7}}`)
+
+	testCases := []struct {
+		name     string
+		query    string
+		ks       func(ks *Kuysor) *Kuysor
+		expected string
+		outArgs  []any
+	}{
+		{
+			name:  "first page",
+			query: report,
+			ks:    func(ks *Kuysor) *Kuysor { return ks },
+			expected: "SELECT c.id, SUM(o.amount) AS total FROM customer c JOIN orders o ON o.customer_id = c.id WHERE c.active = ? GROUP BY c.id " +
+				"ORDER BY SUM(o.amount) DESC, c.id ASC LIMIT ?",
+			outArgs: []any{true, 11},
+		},
+		{
+			name:  "next page",
+			query: report,
+			ks:    func(ks *Kuysor) *Kuysor { return ks.WithCursor(cursor) },
+			expected: "SELECT c.id, SUM(o.amount) AS total FROM customer c JOIN orders o ON o.customer_id = c.id WHERE c.active = ? GROUP BY c.id " +
+				"HAVING ((SUM(o.amount) < ?) OR (SUM(o.amount) = ? AND c.id > ?)) ORDER BY SUM(o.amount) DESC, c.id ASC LIMIT ?",
+			outArgs: []any{true, 500.0, 500.0, 7.0, 11},
+		},
+		{
+			name:  "existing having",
+			query: report + " HAVING COUNT(*) > ?",
+			ks:    func(ks *Kuysor) *Kuysor { return ks.WithCursor(cursor).WithArgs(true, 1) },
+			expected: "SELECT c.id, SUM(o.amount) AS total FROM customer c JOIN orders o ON o.customer_id = c.id WHERE c.active = ? GROUP BY c.id " +
+				"HAVING COUNT(*) > ? AND ((SUM(o.amount) < ?) OR (SUM(o.amount) = ? AND c.id > ?)) ORDER BY SUM(o.amount) DESC, c.id ASC LIMIT ?",
+			outArgs: []any{true, 1, 500.0, 500.0, 7.0, 11},
+		},
+		{
+			name:  "no group by",
+			query: "SELECT c.id, SUM(c.amount) OVER (PARTITION BY c.region) AS total FROM customer c WHERE c.active = ? ORDER BY c.id",
+			ks:    func(ks *Kuysor) *Kuysor { return ks.WithCursor(cursor) },
+			expected: "SELECT * FROM ( SELECT c.id, SUM(c.amount) OVER (PARTITION BY c.region) AS total FROM customer c WHERE c.active = ? ) kuysor_main " +
+				"WHERE ((total < ?) OR (total = ? AND id > ?)) ORDER BY total DESC, id ASC LIMIT ?",
+			outArgs: []any{true, 500.0, 500.0, 7.0, 11},
+		},
+		{
+			name:  "cte target",
+			query: "WITH r AS (" + report + ") SELECT r.id, r.total FROM r",
+			ks: func(ks *Kuysor) *Kuysor {
+				return ks.WithCursor(cursor).WithCTETarget("r", CTEOptions{OrderBy: CTETargetModeCTE})
+			},
+			expected: "WITH r AS (SELECT c.id, SUM(o.amount) AS total FROM customer c JOIN orders o ON o.customer_id = c.id WHERE c.active = ? GROUP BY c.id " +
+				"HAVING ((SUM(o.amount) < ?) OR (SUM(o.amount) = ? AND c.id > ?)) ORDER BY SUM(o.amount) DESC, c.id ASC LIMIT ?) SELECT r.id, r.total FROM r",
+			outArgs: []any{true, 500.0, 500.0, 7.0, 11},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ks := NewQuery(tc.query, Cursor).WithAggregateSort("total", "SUM(o.amount)").WithOrderBy("-total", "c.id").WithLimit(10).WithArgs(true)
+			res, err := tc.ks(ks).Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, res.Query)
+			}
+			if !reflect.DeepEqual(res.Args, tc.outArgs) {
+				t.Errorf("expected args %v, got %v", tc.outArgs, res.Args)
+			}
+		})
+	}
+
+	t.Run("cte target without group by", func(t *testing.T) {
+		_, err := NewQuery("WITH r AS (SELECT id, amount AS total FROM orders) SELECT * FROM r", Cursor).
+			WithCTETarget("r").
+			WithAggregateSort("total", "SUM(amount)").
+			WithOrderBy("-total").
+			WithLimit(10).
+			Build()
+		if err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("next cursor", func(t *testing.T) {
+		res, err := NewQuery(report, Cursor).
+			WithAggregateSort("total", "SUM(o.amount)").
+			WithOrderBy("-total", "c.id").
+			WithLimit(1).
+			WithCursor(cursor).
+			WithArgs(true).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []map[string]any{{"id": 3, "total": 900}, {"id": 4, "total": 800}}
+		next, _, err := res.SanitizeMap(&data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vc, err := cursorBase64(next).parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vc.Cols["total"] != 900.0 || vc.Cols["id"] != 3.0 {
+			t.Errorf("unexpected cursor values: %v", vc.Cols)
+		}
+	})
+}
+
+func TestSortExpr(t *testing.T) {
+	const query = "SELECT a.id, LOWER(a.name) AS name FROM account a WHERE a.status = ?"
+
+	testCases := []struct {
+		name     string
+		query    string
+		ks       func(ks *Kuysor) *Kuysor
+		expected string
+		outArgs  []any
+	}{
+		{
+			name:     "first page",
+			query:    query,
+			ks:       func(ks *Kuysor) *Kuysor { return ks.WithSortExpr("name", "LOWER(a.name)").WithOrderBy("name", "a.id") },
+			expected: "SELECT a.id, LOWER(a.name) AS name FROM account a WHERE a.status = ? ORDER BY LOWER(a.name) ASC, a.id ASC LIMIT ?",
+			outArgs:  []any{"active", 11},
+		},
+		{
+			name:  "next page",
+			query: query,
+			ks: func(ks *Kuysor) *Kuysor {
+				return ks.WithSortExpr("name", "LOWER(a.name)").WithOrderBy("name", "a.id").
+					WithCursor(base64Encode(`{"prefix":"next","cols":{"name":"bob","id":7}}`))
+			},
+			expected: "SELECT a.id, LOWER(a.name) AS name FROM account a WHERE a.status = ? " +
+				"AND ((LOWER(a.name) > ?) OR (LOWER(a.name) = ? AND a.id > ?)) ORDER BY LOWER(a.name) ASC, a.id ASC LIMIT ?",
+			outArgs: []any{"active", "bob", "bob", 7.0, 11},
+		},
+		{
+			name:  "select alias on the previous page",
+			query: "SELECT a.id, a.likes * 2 + a.views AS score FROM account a WHERE a.status = ?",
+			ks: func(ks *Kuysor) *Kuysor {
+				return ks.WithSortExpr("score", "a.likes * 2 + a.views").WithOrderBy("-score", "-a.id").
+					WithCursor(base64Encode(`{"prefix":"prev","cols":{"score":40,"id":7}}`))
+			},
+			expected: "SELECT a.id, a.likes * 2 + a.views AS score FROM account a WHERE a.status = ? " +
+				"AND ((a.likes * 2 + a.views > ?) OR (a.likes * 2 + a.views = ? AND a.id > ?)) ORDER BY a.likes * 2 + a.views ASC, a.id ASC LIMIT ?",
+			outArgs: []any{"active", 40.0, 40.0, 7.0, 11},
+		},
+		{
+			name:  "json path with row values",
+			query: "SELECT a.id, a.profile->>'city' AS city FROM account a WHERE a.status = ?",
+			ks: func(ks *Kuysor) *Kuysor {
+				return ks.WithDialect(PostgreSQL).WithSortExpr("city", "a.profile->>'city'").WithOrderBy("city", "a.id").
+					WithCursor(base64Encode(`{"prefix":"next","cols":{"city":"Oslo","id":7}}`))
+			},
+			expected: "SELECT a.id, a.profile->>'city' AS city FROM account a WHERE a.status = $1 " +
+				"AND (a.profile->>'city', a.id) > ($2, $3) ORDER BY a.profile->>'city' ASC, a.id ASC LIMIT $4",
+			outArgs: []any{"active", "Oslo", 7.0, 11},
+		},
+		{
+			name:  "cte target",
+			query: "WITH f AS (" + query + ") SELECT f.id, f.name FROM f",
+			ks: func(ks *Kuysor) *Kuysor {
+				return ks.WithCTETarget("f").WithSortExpr("name", "LOWER(a.name)").WithOrderBy("name", "id").
+					WithCursor(base64Encode(`{"prefix":"next","cols":{"name":"bob","id":7}}`))
+			},
+			expected: "WITH f AS (SELECT a.id, LOWER(a.name) AS name FROM account a WHERE a.status = ? " +
+				"AND ((LOWER(a.name) > ?) OR (LOWER(a.name) = ? AND id > ?)) ORDER BY LOWER(a.name) ASC, id ASC LIMIT ?) " +
+				"SELECT f.id, f.name FROM f ORDER BY name ASC, id ASC",
+			outArgs: []any{"active", "bob", "bob", 7.0, 11},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := tc.ks(NewQuery(tc.query, Cursor).WithLimit(10).WithArgs("active")).Build()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Query != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, res.Query)
+			}
+			if !reflect.DeepEqual(res.Args, tc.outArgs) {
+				t.Errorf("expected args %v, got %v", tc.outArgs, res.Args)
+			}
+		})
+	}
+
+	t.Run("next cursor", func(t *testing.T) {
+		res, err := NewQuery(query, Cursor).
+			WithSortExpr("name", "LOWER(a.name)").
+			WithOrderBy("name", "a.id").
+			WithLimit(1).
+			WithCursor(base64Encode(`{"prefix":"next","cols":{"name":"bob","id":7}}`)).
+			WithArgs("active").
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []map[string]any{{"id": 3, "name": "carol"}, {"id": 4, "name": "dave"}}
+		next, _, err := res.SanitizeMap(&data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vc, err := cursorBase64(next).parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vc.Cols["name"] != "carol" || vc.Cols["id"] != 3.0 {
+			t.Errorf("unexpected cursor values: %v", vc.Cols)
+		}
+	})
+}
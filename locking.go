@@ -0,0 +1,41 @@
+package kuysor
+
+// LockMode is the row-locking clause added to the paginated statement by
+// WithLocking, e.g. to let job workers claim rows in keyset order.
+type LockMode uint8
+
+const (
+	// NoLock adds no locking clause.
+	NoLock LockMode = iota
+	// ForUpdate renders "FOR UPDATE".
+	ForUpdate
+	// ForUpdateNoWait renders "FOR UPDATE NOWAIT".
+	ForUpdateNoWait
+	// ForUpdateSkipLocked renders "FOR UPDATE SKIP LOCKED".
+	ForUpdateSkipLocked
+	// ForShare renders "FOR SHARE".
+	ForShare
+	// ForShareNoWait renders "FOR SHARE NOWAIT".
+	ForShareNoWait
+	// ForShareSkipLocked renders "FOR SHARE SKIP LOCKED".
+	ForShareSkipLocked
+)
+
+// clause returns the locking clause of the mode, or "" for NoLock.
+func (m LockMode) clause() string {
+	switch m {
+	case ForUpdate:
+		return "FOR UPDATE"
+	case ForUpdateNoWait:
+		return "FOR UPDATE NOWAIT"
+	case ForUpdateSkipLocked:
+		return "FOR UPDATE SKIP LOCKED"
+	case ForShare:
+		return "FOR SHARE"
+	case ForShareNoWait:
+		return "FOR SHARE NOWAIT"
+	case ForShareSkipLocked:
+		return "FOR SHARE SKIP LOCKED"
+	}
+	return ""
+}
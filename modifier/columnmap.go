@@ -0,0 +1,133 @@
+package modifier
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrAmbiguousColumn is returned by InferColumnMap when a column matches several
+// columns of the target body.
+var ErrAmbiguousColumn = errors.New("ambiguous column")
+
+// InferColumnMap maps each of columns, sort columns as written in the main query,
+// to the expression that selects it inside the body of the CTE or derived table
+// targeted by SetCTETarget or SetSubqueryTarget:
+//   - a column the body selects as is, with a qualifier of the body, is kept;
+//   - otherwise the item of the body's SELECT list named like the column is
+//     used, e.g. "t.id" maps to "tk.id" in "SELECT tk.id FROM ticket tk";
+//   - otherwise a "*" or "x.*" item of the body selects it, qualified with x.
+//
+// A UNION body is wrapped in a derived table by the modifier, so its columns map
+// to the names the union outputs them as. A column that matches several items,
+// or a "*" over several tables, returns an error wrapping ErrAmbiguousColumn.
+func (m *SQLModifier) InferColumnMap(columns ...string) (map[string]string, error) {
+	if m.cteTarget == "" {
+		return nil, fmt.Errorf("no CTE or derived table is targeted")
+	}
+	start, end, err := m.targetBodyBounds()
+	if err != nil {
+		return nil, err
+	}
+
+	body := &SQLModifier{query: strings.TrimSpace(m.query[start:end])}
+	if body.HasMainUnion() {
+		output, _, err := body.UnionColumns(columns...)
+		return output, err
+	}
+
+	var (
+		items   = selectList(body.query)
+		aliases = body.fromAliases()
+		colMap  = make(map[string]string, len(columns))
+	)
+	for _, column := range columns {
+		mapped, err := inferColumn(column, items, aliases, body.hasSingleTable())
+		if err != nil {
+			return nil, fmt.Errorf("cannot infer the column of %s in %s: %w", column, m.cteTarget, err)
+		}
+		colMap[column] = mapped
+	}
+	return colMap, nil
+}
+
+// inferColumn returns the expression selecting column among items, the SELECT
+// list of a body whose FROM and JOIN clauses have aliases (uppercased). single
+// reports whether the body reads a single table.
+func inferColumn(column string, items []selectItem, aliases map[string]bool, single bool) (string, error) {
+	var (
+		name      = unqualified(column)
+		qualifier = strings.TrimSuffix(column[:len(column)-len(name)], ".")
+		own       = qualifier == "" || aliases[strings.ToUpper(unquote(qualifier))]
+	)
+
+	// selected as is
+	for _, item := range items {
+		if own && sameExpr(item.expr, column) {
+			return column, nil
+		}
+	}
+
+	// selected under its name
+	var named []string
+	for _, item := range items {
+		if item.name != "" && strings.EqualFold(unquote(item.name), unquote(name)) {
+			named = append(named, item.expr)
+		}
+	}
+	switch {
+	case len(named) == 1:
+		return named[0], nil
+	case len(named) > 1:
+		return "", fmt.Errorf("%w: %s is selected by %s", ErrAmbiguousColumn, name, strings.Join(named, ", "))
+	}
+
+	// selected by a star
+	var starred []string
+	for _, item := range items {
+		switch star := strings.TrimSpace(item.expr); {
+		case star == "*" && own && qualifier != "":
+			return column, nil
+		case star == "*" && single:
+			starred = append(starred, name)
+		case star == "*":
+			return "", fmt.Errorf("%w: * reads several tables", ErrAmbiguousColumn)
+		case strings.HasSuffix(star, ".*"):
+			starred = append(starred, strings.TrimSuffix(star, "*")+name)
+		}
+	}
+	switch {
+	case len(starred) == 1:
+		return starred[0], nil
+	case len(starred) > 1:
+		return "", fmt.Errorf("%w: %s may be selected by %s", ErrAmbiguousColumn, name, strings.Join(starred, ", "))
+	}
+
+	return "", fmt.Errorf("%s is not selected", name)
+}
+
+// fromAliases returns the uppercased table names and aliases of the main FROM and
+// JOIN clauses, derived tables included.
+func (m *SQLModifier) fromAliases() map[string]bool {
+	joins := m.findMainJoins(anyJoinRe)
+
+	aliases := make(map[string]bool)
+	for alias := range m.mainTableAliases(joins) {
+		aliases[alias] = true
+	}
+	for _, e := range joins {
+		aliases[strings.ToUpper(e.alias)] = true
+	}
+	return aliases
+}
+
+// hasSingleTable reports whether the main FROM clause reads a single table, with
+// no JOIN.
+func (m *SQLModifier) hasSingleTable() bool {
+	fromPos := m.findMainClausePosition("FROM")
+	if fromPos == -1 || m.findMainClauseAfter("JOIN", fromPos) != -1 {
+		return false
+	}
+	end := m.clauseEnd("FROM", fromPos)
+	return len(splitOnTopLevelComma(m.query[fromPos+4:end])) == 1
+}
@@ -0,0 +1,102 @@
+package modifier
+
+// Grammar lists the clauses that can follow FROM in a statement of a dialect, in
+// the order the dialect accepts them. Each clause is listed by the keyword
+// sequences that start it, the first one naming it, e.g. {"FOR UPDATE", "FOR
+// SHARE"} for a locking clause. A clause is inserted before the first clause of
+// the query that follows it in the grammar, and an existing clause ends there.
+//
+// A clause set by the modifier that is missing from the grammar is placed as in
+// DefaultGrammar.
+type Grammar [][]string
+
+// DefaultGrammar is the grammar used when none is set. It accepts the clauses of
+// all the supported databases.
+var DefaultGrammar = Grammar{
+	{"WHERE"},
+	{"START WITH", "CONNECT BY"},
+	{"GROUP BY"},
+	{"HAVING"},
+	{"WINDOW"},
+	{"QUALIFY"},
+	{"ORDER BY"},
+	{"LIMIT"},
+	{"OFFSET"},
+	{"FETCH"},
+	lockingClause,
+	{"INTO"},
+	{"RETURNING"},
+}
+
+// lockingClause lists the keywords that start a row-locking clause.
+var lockingClause = []string{"FOR UPDATE", "FOR NO KEY UPDATE", "FOR SHARE", "FOR KEY SHARE", "LOCK IN SHARE MODE"}
+
+// clausesAfter returns the keywords of the clauses that follow the clause name in
+// g, or of all its clauses when name is "FROM". ok is false when g has no clause
+// named name.
+func (g Grammar) clausesAfter(name string) (keywords []string, ok bool) {
+	i := 0
+	if name != "FROM" {
+		for i < len(g) && (len(g[i]) == 0 || g[i][0] != name) {
+			i++
+		}
+		if i == len(g) {
+			return nil, false
+		}
+		i++
+	}
+
+	for _, clause := range g[i:] {
+		keywords = append(keywords, clause...)
+	}
+	return keywords, true
+}
+
+// SetGrammar sets the clause order of the dialect of the query. See Grammar.
+func (m *SQLModifier) SetGrammar(grammar Grammar) {
+	m.grammar = grammar
+}
+
+// nextClause returns the position of the first main-level clause that starts
+// after from and follows the clause name in the grammar, or -1 when there is none.
+func (m *SQLModifier) nextClause(name string, from int) int {
+	grammar := m.grammar
+	if grammar == nil {
+		grammar = DefaultGrammar
+	}
+	keywords, ok := grammar.clausesAfter(name)
+	if !ok {
+		keywords, _ = DefaultGrammar.clausesAfter(name)
+	}
+
+	next := -1
+	for _, keyword := range keywords {
+		pos := m.findMainClauseAfter(keyword, from)
+		if pos != -1 && (next == -1 || pos < next) {
+			next = pos
+		}
+	}
+	return next
+}
+
+// clauseEnd returns the end of the clause name starting at pos: the start of the
+// next clause, or the end of the query.
+func (m *SQLModifier) clauseEnd(name string, pos int) int {
+	if next := m.nextClause(name, pos); next != -1 {
+		return next
+	}
+	return len(m.query)
+}
+
+// clauseInsertPos returns where the missing clause name goes: before the first
+// clause that follows it in the grammar, or at the end of the query. Clauses
+// before the main FROM, such as the INTO of "INSERT INTO t SELECT ...", are not
+// considered.
+func (m *SQLModifier) clauseInsertPos(name string) int {
+	return m.clauseEnd(name, m.findMainClausePosition("FROM"))
+}
+
+// insertMainClause inserts clause, the clause name, where the grammar puts it.
+func (m *SQLModifier) insertMainClause(name, clause string) {
+	m.insertClause(m.clauseInsertPos(name), clause)
+}
@@ -1,18 +1,75 @@
 package modifier
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 	"sort"
 	"strings"
+	"unicode"
+
+	"github.com/redhajuanda/kuysor/internal/lexer"
 )
 
 // SQLModifier handles parsing and modifying SQL queries
 type SQLModifier struct {
-	query     string
-	cteTarget string // when set, modifications target this named CTE's body
+	query       string
+	cteTarget   string      // when set, modifications target this named CTE's body
+	subquery    bool        // cteTarget is the alias of a derived table, see SetSubqueryTarget
+	limitSyntax LimitSyntax // how SetLimit / SetOffset render row limiting
+	preserve    bool        // keep the layout of the query in Build, see SetPreserveFormatting
+	policy      ClausePolicy
+	grammar     Grammar         // clause order, DefaultGrammar when nil
+	claimed     map[string]bool // statements whose existing clauses the policy was applied to, see claim
+	keepBound   bool            // keep clauses that bind placeholders, see SetKeepPlaceholders
+
+	mask       string // lexer.Mask of maskSource, see masked
+	maskSource string
 }
 
+// LimitSyntax selects how SetLimit and SetOffset render row limiting.
+type LimitSyntax uint8
+
+const (
+	// LimitOffset renders "LIMIT n OFFSET m".
+	LimitOffset LimitSyntax = iota
+	// OffsetFetch renders "OFFSET m ROWS FETCH NEXT n ROWS ONLY". OFFSET is always
+	// present (as "OFFSET 0 ROWS" when no offset is set), as SQL Server requires it.
+	OffsetFetch
+	// Top renders the limit as "SELECT TOP (n) ..." and an offset as "OFFSET m ROWS".
+	// Use OffsetFetch when both a limit and an offset are needed.
+	Top
+	// FetchFirst renders "[OFFSET m ROWS] FETCH FIRST n ROWS ONLY".
+	FetchFirst
+	// RowNum wraps the statement the limit applies to in ROWNUM filters at Build
+	// time: "SELECT * FROM (...) WHERE ROWNUM <= n", or with an offset
+	// "SELECT * FROM (SELECT kuysor_rownum.*, ROWNUM kuysor_rn FROM (...) kuysor_rownum
+	// WHERE ROWNUM <= m + n) WHERE kuysor_rn > m". The limit and offset placeholders
+	// are repeated as needed, so offset placeholders appear twice.
+	RowNum
+)
+
+// ClausePolicy selects what SetOrderBy, SetLimit and SetOffset do with an ORDER BY
+// or a row-limiting clause (LIMIT, OFFSET or FETCH) that the statement already had
+// before the modifier changed it.
+type ClausePolicy uint8
+
+const (
+	// ReplaceClause replaces an existing ORDER BY, and removes all the existing
+	// row-limiting clauses of a statement before its first limit or offset is set.
+	ReplaceClause ClausePolicy = iota
+	// RejectClause makes SetOrderBy, SetLimit and SetOffset return an error wrapping
+	// ErrExistingClause.
+	RejectClause
+	// KeepOrderBy keeps the terms of an existing ORDER BY after the new ones, as a
+	// secondary sort. Row-limiting clauses are replaced as with ReplaceClause.
+	KeepOrderBy
+)
+
+// ErrExistingClause is returned under RejectClause when the statement already has
+// the clause being set.
+var ErrExistingClause = errors.New("query already has the clause")
+
 // NewSQLModifier creates a new SQLModifier instance
 func NewSQLModifier(query string) *SQLModifier {
 	return &SQLModifier{
@@ -20,10 +77,98 @@ func NewSQLModifier(query string) *SQLModifier {
 	}
 }
 
+// masked returns lexer.Mask(m.query): the query uppercased, with comments,
+// literals and quoted identifiers blanked, so that keywords and parentheses are
+// only found in SQL text. It is cached until the query changes.
+func (m *SQLModifier) masked() string {
+	if m.maskSource != m.query {
+		m.mask = lexer.Mask(m.query)
+		m.maskSource = m.query
+	}
+	return m.mask
+}
+
+// SetLimitSyntax sets how SetLimit and SetOffset render row limiting.
+func (m *SQLModifier) SetLimitSyntax(syntax LimitSyntax) {
+	m.limitSyntax = syntax
+}
+
+// SetClausePolicy sets what happens to the ORDER BY, LIMIT, OFFSET and FETCH
+// clauses the query already has. See ClausePolicy.
+func (m *SQLModifier) SetClausePolicy(policy ClausePolicy) {
+	m.policy = policy
+}
+
+// SetPreserveFormatting makes Build keep the layout of the query: clauses are
+// spliced into the original text and whitespace is not collapsed.
+func (m *SQLModifier) SetPreserveFormatting(preserve bool) {
+	m.preserve = preserve
+}
+
+// SetKeepPlaceholders makes StripRedundantInnerJoins, StripUnusedCTEs and
+// ConvertToCountExpr keep the joins, CTEs and SELECT items that bind
+// placeholders, so the args of a query stay aligned when they cannot be
+// dropped along with the clause.
+func (m *SQLModifier) SetKeepPlaceholders(keep bool) {
+	m.keepBound = keep
+}
+
 // SetCTETarget configures the modifier to apply WHERE / ORDER BY / LIMIT
 // modifications inside the named CTE's body instead of the main query.
 func (m *SQLModifier) SetCTETarget(name string) {
 	m.cteTarget = name
+	m.subquery = false
+}
+
+// SetSubqueryTarget configures the modifier to apply WHERE / ORDER BY / LIMIT
+// modifications inside the body of the derived table of the main query aliased
+// alias, e.g. "p" in "SELECT ... FROM (SELECT ...) p JOIN ...", instead of the main
+// query. It replaces any CTE target.
+func (m *SQLModifier) SetSubqueryTarget(alias string) {
+	m.cteTarget = alias
+	m.subquery = true
+}
+
+// findSubqueryBodyBounds returns the start and end byte positions of the content
+// inside the parentheses of the main-level derived table aliased alias.
+// Returns (-1, -1, err) when there is no such derived table.
+func (m *SQLModifier) findSubqueryBodyBounds(alias string) (start, end int, err error) {
+	queryUpper := m.masked()
+	re := regexp.MustCompile(`\)\s*(?:AS\s+)?` + regexp.QuoteMeta(strings.ToUpper(alias)) + `\b`)
+	fromPos := m.findMainClausePosition("FROM")
+	if fromPos == -1 {
+		return -1, -1, fmt.Errorf("derived table %q not found in query", alias)
+	}
+
+matches:
+	for _, loc := range re.FindAllStringIndex(queryUpper[fromPos:], -1) {
+		end = fromPos + loc[0]
+		if strings.Count(queryUpper[:end], "(")-strings.Count(queryUpper[:end], ")") != 1 {
+			continue
+		}
+
+		// walk back to the matching '(', and skip the match when it doesn't
+		// enclose a SELECT, e.g. "JOIN (a JOIN b ON ...) x"
+		depth := 0
+		for i := end - 1; i >= fromPos; i-- {
+			switch queryUpper[i] {
+			case ')':
+				depth++
+			case '(':
+				if depth > 0 {
+					depth--
+					continue
+				}
+				body := strings.TrimSpace(queryUpper[i+1 : end])
+				if strings.HasPrefix(body, "SELECT") || strings.HasPrefix(body, "WITH") {
+					return i + 1, end, nil
+				}
+				continue matches
+			}
+		}
+	}
+
+	return -1, -1, fmt.Errorf("derived table %q not found in query", alias)
 }
 
 // findCTEBodyBounds returns the start and end byte positions of the content
@@ -32,7 +177,7 @@ func (m *SQLModifier) SetCTETarget(name string) {
 // positions of " SELECT id FROM t WHERE x=1 " (exclusive of the parens).
 // Returns (-1, -1, err) when the CTE is not found or parens are unmatched.
 func (m *SQLModifier) findCTEBodyBounds(cteName string) (start, end int, err error) {
-	queryUpper := strings.ToUpper(m.query)
+	queryUpper := m.masked()
 	cteNameUpper := regexp.QuoteMeta(strings.ToUpper(cteName))
 
 	// Match: <cteName> followed by optional whitespace, AS, optional whitespace, then (
@@ -49,8 +194,8 @@ func (m *SQLModifier) findCTEBodyBounds(cteName string) (start, end int, err err
 	// Walk forward tracking depth to find the matching closing ')'
 	depth := 1
 	i := start
-	for i < len(m.query) {
-		switch m.query[i] {
+	for i < len(queryUpper) {
+		switch queryUpper[i] {
 		case '(':
 			depth++
 		case ')':
@@ -66,15 +211,17 @@ func (m *SQLModifier) findCTEBodyBounds(cteName string) (start, end int, err err
 	return -1, -1, fmt.Errorf("unmatched parentheses for CTE %q", cteName)
 }
 
-// applyToCTEBody extracts the named CTE's body, applies fn to a sub-modifier
-// of that body, then splices the modified body back into the full query.
-func (m *SQLModifier) applyToCTEBody(fn func(sub *SQLModifier)) error {
-	start, end, err := m.findCTEBodyBounds(m.cteTarget)
+// applyToCTEBody extracts the body of the named CTE, or of the derived table with
+// SetSubqueryTarget, applies fn to a sub-modifier of that body, then splices the
+// modified body back into the full query.
+func (m *SQLModifier) applyToCTEBody(fn func(sub *SQLModifier) error) error {
+	start, end, err := m.targetBodyBounds()
 	if err != nil {
 		return err
 	}
 
-	sub := &SQLModifier{query: strings.TrimSpace(m.query[start:end])}
+	body := m.query[start:end]
+	sub := &SQLModifier{query: strings.TrimSpace(body), limitSyntax: m.limitSyntax, preserve: m.preserve, grammar: m.grammar}
 
 	// When the CTE body is a top-level UNION, a directly-appended WHERE would only
 	// attach to the first branch, and a trailing ORDER BY/LIMIT can only reference
@@ -83,16 +230,34 @@ func (m *SQLModifier) applyToCTEBody(fn func(sub *SQLModifier)) error {
 	// After this wrap the body is no longer a top-level union, so repeated calls
 	// (one per clause) wrap at most once.
 	if sub.hasMainUnion() {
-		sub.query = "SELECT * FROM ( " + sub.query + " ) " + cteUnionWrapAlias
+		sub.query = "SELECT * FROM ( " + endLine(sub.query) + " ) " + cteUnionWrapAlias
 	}
 
-	fn(sub)
+	if err := fn(sub); err != nil {
+		return err
+	}
 
-	// splice the modified body back (preserve surrounding whitespace layout)
-	m.query = m.query[:start] + sub.query + m.query[end:]
+	// splice the modified body back, keeping the whitespace around it when the
+	// layout is preserved
+	if m.preserve && strings.TrimSpace(body) != "" {
+		lead := body[:strings.Index(body, strings.TrimSpace(body))]
+		trail := body[len(lead)+len(strings.TrimSpace(body)):]
+		m.query = m.query[:start] + lead + sub.query + trail + m.query[end:]
+		return nil
+	}
+	m.query = m.query[:start] + endLine(sub.query) + m.query[end:]
 	return nil
 }
 
+// targetBodyBounds returns the bounds of the body of the target, the named CTE or
+// the derived table with SetSubqueryTarget.
+func (m *SQLModifier) targetBodyBounds() (start, end int, err error) {
+	if m.subquery {
+		return m.findSubqueryBodyBounds(m.cteTarget)
+	}
+	return m.findCTEBodyBounds(m.cteTarget)
+}
+
 // cteUnionWrapAlias is the derived-table alias used when a UNION CTE body is
 // wrapped so that injected clauses apply to the union result as a whole.
 const cteUnionWrapAlias = "kuysor_cte_union"
@@ -100,10 +265,17 @@ const cteUnionWrapAlias = "kuysor_cte_union"
 // findMainClausePosition finds the position of a main clause (not in subqueries/CTEs)
 // Returns the position of the clause keyword, or -1 if not found
 func (m *SQLModifier) findMainClausePosition(clauseKeyword string) int {
-	queryUpper := strings.ToUpper(m.query)
-	clauseKeywordUpper := strings.ToUpper(clauseKeyword)
+	return m.findMainClauseAfter(clauseKeyword, -1)
+}
+
+// findMainClauseAfter is findMainClausePosition for the clauses starting after
+// position from.
+func (m *SQLModifier) findMainClauseAfter(clauseKeyword string, from int) int {
+	queryUpper := m.masked()
+	clauseKeywordUpper := strings.Join(strings.Fields(strings.ToUpper(clauseKeyword)), `\s+`)
 
-	// Create a regex pattern for the clause keyword with word boundaries
+	// Create a regex pattern for the clause keyword with word boundaries; words
+	// may be separated by any whitespace, e.g. "ORDER\n BY"
 	re := regexp.MustCompile(`\b` + clauseKeywordUpper + `\b`)
 	matches := re.FindAllStringIndex(queryUpper, -1)
 
@@ -117,13 +289,13 @@ func (m *SQLModifier) findMainClausePosition(clauseKeyword string) int {
 		pos := match[0]
 
 		// If we have a CTE and this clause is before the main SELECT, skip it
-		if mainSelectPos != -1 && pos < mainSelectPos {
+		if pos <= from || mainSelectPos != -1 && pos < mainSelectPos {
 			continue
 		}
 
 		// Check if this position is inside parentheses
 		// Count open and close parentheses before this position
-		queryBefore := m.query[:pos]
+		queryBefore := queryUpper[:pos]
 		openCount := strings.Count(queryBefore, "(")
 		closeCount := strings.Count(queryBefore, ")")
 
@@ -138,7 +310,7 @@ func (m *SQLModifier) findMainClausePosition(clauseKeyword string) int {
 
 // findMainSelectPosition finds the position of the main SELECT clause (not in subqueries/CTEs)
 func (m *SQLModifier) findMainSelectPosition() int {
-	queryUpper := strings.ToUpper(m.query)
+	queryUpper := m.masked()
 
 	// Find all SELECT positions
 	re := regexp.MustCompile(`\bSELECT\b`)
@@ -148,14 +320,14 @@ func (m *SQLModifier) findMainSelectPosition() int {
 		pos := match[0]
 
 		// Check if this position is inside parentheses
-		queryBefore := m.query[:pos]
+		queryBefore := queryUpper[:pos]
 		openCount := strings.Count(queryBefore, "(")
 		closeCount := strings.Count(queryBefore, ")")
 
 		// If open and close counts match, it's not in parentheses (subquery)
 		if openCount == closeCount {
 			// Check if it's after WITH clause (main query after CTE)
-			withPos := strings.LastIndex(strings.ToUpper(queryBefore), "WITH")
+			withPos := strings.LastIndex(queryBefore, "WITH")
 			if withPos != -1 {
 				// Check if there's a closing parenthesis after WITH but before this SELECT
 				// This would indicate the end of CTE definitions
@@ -218,36 +390,19 @@ func (m *SQLModifier) ConvertToCountExpr(expr string) error {
 	// Queries with GROUP BY, DISTINCT, or UNION must be wrapped in a subquery;
 	// otherwise COUNT would return multiple rows or lose distinctness.
 	if m.hasMainGroupBy() || m.hasMainDistinct() || m.hasMainUnion() {
-		// Strip ORDER BY / LIMIT / OFFSET — meaningless inside a counting subquery.
-		m.stripMainOrderByAndLimit()
-
-		// Re-find selectPos after stripping (positions before the cut are unchanged,
-		// but re-finding is safer in case future stripping changes that).
-		selectPos = m.findMainSelectPosition()
-
-		// Extract WITH clause if present so it stays at the statement level
-		// (CTEs must be accessible to the inner subquery).
-		var withClause string
-		if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(m.query)), "WITH") {
-			withPos := strings.Index(strings.ToUpper(m.query), "WITH")
-			if withPos != -1 && withPos < selectPos {
-				withClause = strings.TrimSpace(m.query[withPos:selectPos])
-			}
-		}
-
-		innerQuery := strings.TrimSpace(m.query[selectPos:])
-		if withClause != "" {
-			m.query = fmt.Sprintf("%s SELECT %s FROM (%s) kuysor_count", withClause, countExpr, innerQuery)
-		} else {
-			m.query = fmt.Sprintf("SELECT %s FROM (%s) kuysor_count", countExpr, innerQuery)
+		// Scalar subqueries in the SELECT list of a grouped query do not change the
+		// number of groups, so they are dropped instead of evaluated per group.
+		if m.hasMainGroupBy() && !m.hasMainDistinct() && !m.hasMainUnion() {
+			m.stripSelectSubqueries()
 		}
+		m.wrapMainInCount(countExpr)
 		return nil
 	}
 
 	// Simple case: replace SELECT columns with COUNT expression.
 	var withClause string
-	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(m.query)), "WITH") {
-		withPos := strings.Index(strings.ToUpper(m.query), "WITH")
+	if strings.HasPrefix(strings.TrimSpace(m.masked()), "WITH") {
+		withPos := strings.Index(m.masked(), "WITH")
 		if withPos != -1 && withPos < selectPos {
 			withClause = strings.TrimSpace(m.query[withPos:selectPos])
 			if !strings.HasSuffix(withClause, " ") {
@@ -269,14 +424,310 @@ func (m *SQLModifier) ConvertToCountExpr(expr string) error {
 	return nil
 }
 
+// wrapMainInCount strips ORDER BY / LIMIT / OFFSET from the main query and wraps
+// it as "SELECT <countExpr> FROM (<main query>) kuysor_count". A leading WITH
+// clause is kept at the statement level so the inner query can still reference
+// its CTEs.
+func (m *SQLModifier) wrapMainInCount(countExpr string) {
+	m.wrapMainWith(func(inner string) string {
+		return fmt.Sprintf("SELECT %s FROM (%s) kuysor_count", countExpr, inner)
+	})
+}
+
+// wrapMainWith strips ORDER BY / LIMIT / OFFSET from the main query and replaces
+// it with wrap(<main query>), keeping a leading WITH clause at the statement level.
+func (m *SQLModifier) wrapMainWith(wrap func(inner string) string) {
+	// Strip ORDER BY / LIMIT / OFFSET — meaningless inside a counting subquery.
+	m.stripMainOrderByAndLimit()
+
+	// Re-find selectPos after stripping (positions before the cut are unchanged,
+	// but re-finding is safer in case future stripping changes that).
+	selectPos := m.findMainSelectPosition()
+
+	// Extract WITH clause if present so it stays at the statement level
+	// (CTEs must be accessible to the inner subquery).
+	var withClause string
+	if strings.HasPrefix(strings.TrimSpace(m.masked()), "WITH") {
+		withPos := strings.Index(m.masked(), "WITH")
+		if withPos != -1 && withPos < selectPos {
+			withClause = strings.TrimSpace(m.query[withPos:selectPos])
+		}
+	}
+
+	innerQuery := endLine(strings.TrimSpace(m.query[selectPos:]))
+	if withClause != "" {
+		m.query = withClause + " " + wrap(innerQuery)
+	} else {
+		m.query = wrap(innerQuery)
+	}
+}
+
+// ConvertToCountDistinct converts the main query's SELECT to a count of the
+// distinct values of cols.
+//
+// A single column on a plain query becomes COUNT(DISTINCT col). Multiple columns,
+// or a query that already uses DISTINCT, have the main SELECT list replaced by
+// "SELECT DISTINCT cols" and are wrapped in a counting subquery, which every
+// database supports. A query with GROUP BY is kept whole, so its select list and
+// HAVING aliases stay valid, and wrapped as a derived table; cols are then
+// resolved to the names of the output columns that select them, and a column
+// that is not selected under a unique name is an error. A main-level UNION is
+// rejected because its branches do not share the qualifiers used by cols.
+func (m *SQLModifier) ConvertToCountDistinct(cols ...string) error {
+	if len(cols) == 0 {
+		return m.ConvertToCountExpr("*")
+	}
+
+	selectPos := m.findMainSelectPosition()
+	if selectPos == -1 {
+		return fmt.Errorf("could not find main SELECT clause")
+	}
+	if m.findMainClausePosition("FROM") == -1 {
+		return fmt.Errorf("query must contain a FROM clause")
+	}
+	if m.hasMainUnion() {
+		return fmt.Errorf("COUNT(DISTINCT ...) is not supported on a main-level UNION")
+	}
+
+	// A grouped select list can't be replaced: columns outside GROUP BY are
+	// invalid on strict databases and HAVING may refer to its aliases. Count the
+	// distinct output columns of the whole grouped query instead.
+	if m.hasMainGroupBy() {
+		outputs, err := m.groupedOutputs(cols)
+		if err != nil {
+			return err
+		}
+		if len(outputs) == 1 {
+			m.wrapMainInCount("COUNT(DISTINCT " + outputs[0] + ")")
+			return nil
+		}
+		m.wrapMainWith(func(inner string) string {
+			return fmt.Sprintf("SELECT COUNT(*) FROM (SELECT DISTINCT %s FROM (%s) kuysor_distinct) kuysor_count", strings.Join(outputs, ", "), inner)
+		})
+		return nil
+	}
+
+	if len(cols) == 1 && !m.hasMainDistinct() {
+		return m.ConvertToCountExpr("DISTINCT " + cols[0])
+	}
+
+	// Replace the main SELECT list with the distinct columns. Distinct rows of an
+	// already-DISTINCT result project to the same distinct column values, so the
+	// original DISTINCT semantics are preserved.
+	fromPos := m.findMainClausePosition("FROM")
+	m.query = m.query[:selectPos] + "SELECT DISTINCT " + strings.Join(cols, ", ") + " " + m.query[fromPos:]
+	m.wrapMainInCount("COUNT(*)")
+	return nil
+}
+
+// groupedOutputs maps each of cols, as written in the query, to the name of the
+// main SELECT list column that selects it, by expression or by name, as
+// UnionColumns does. A column that is not selected, is an unnamed expression,
+// or shares its output name with another item is an error.
+func (m *SQLModifier) groupedOutputs(cols []string) ([]string, error) {
+	items := selectList(m.query[m.findMainSelectPosition():])
+	outputs := make([]string, len(cols))
+	for i, col := range cols {
+		pos := findSelectItem(items, col)
+		switch {
+		case pos == -1:
+			return nil, fmt.Errorf("distinct column %s is not selected by the grouped query", col)
+		case items[pos].name == "":
+			return nil, fmt.Errorf("distinct column %s must have an alias in the grouped query", col)
+		}
+		for j, item := range items {
+			if j != pos && strings.EqualFold(unquote(item.name), unquote(items[pos].name)) {
+				return nil, fmt.Errorf("distinct column %s shares the output name %s with another column of the grouped query", col, items[pos].name)
+			}
+		}
+		outputs[i] = items[pos].name
+	}
+	return outputs, nil
+}
+
+// ConvertToExists converts the query into an existence check:
+// "SELECT EXISTS(SELECT 1 FROM ... LIMIT 1)". The main SELECT list is replaced by
+// "1", unless the query has a HAVING clause that may refer to its aliases, and
+// ORDER BY, LIMIT, OFFSET, and row-locking clauses are stripped. A leading WITH
+// clause stays at the statement level, and a main-level UNION is wrapped in a
+// derived table.
+// Databases without LIMIT (any limit syntax other than LimitOffset) get
+// "SELECT CASE WHEN EXISTS(SELECT 1 FROM ...) THEN 1 ELSE 0 END" instead, with
+// "FROM DUAL" for the Oracle syntaxes (FetchFirst and RowNum).
+func (m *SQLModifier) ConvertToExists() error {
+	selectPos := m.findMainSelectPosition()
+	if selectPos == -1 {
+		return fmt.Errorf("could not find main SELECT clause")
+	}
+	if m.findMainClausePosition("FROM") == -1 {
+		return fmt.Errorf("query must contain a FROM clause")
+	}
+
+	m.stripMainOrderByAndLimit()
+	m.stripMainLocking()
+	selectPos = m.findMainSelectPosition()
+
+	var withClause string
+	if strings.HasPrefix(strings.TrimSpace(m.masked()), "WITH") {
+		withClause = strings.TrimSpace(m.query[:selectPos]) + " "
+	}
+
+	var inner string
+	if m.hasMainUnion() {
+		inner = fmt.Sprintf("SELECT 1 FROM (%s) kuysor_exists", endLine(strings.TrimSpace(m.query[selectPos:])))
+	} else if m.findMainClausePosition("HAVING") != -1 {
+		inner = endLine(strings.TrimSpace(m.query[selectPos:]))
+	} else {
+		inner = endLine("SELECT 1 " + strings.TrimSpace(m.query[m.findMainClausePosition("FROM"):]))
+	}
+
+	switch m.limitSyntax {
+	case FetchFirst, RowNum:
+		m.query = fmt.Sprintf("%sSELECT CASE WHEN EXISTS(%s) THEN 1 ELSE 0 END FROM DUAL", withClause, inner)
+		return nil
+	case OffsetFetch, Top:
+		m.query = fmt.Sprintf("%sSELECT CASE WHEN EXISTS(%s) THEN 1 ELSE 0 END", withClause, inner)
+		return nil
+	}
+
+	m.query = fmt.Sprintf("%sSELECT EXISTS(%s LIMIT 1)", withClause, inner)
+	return nil
+}
+
+// ConvertToFacetCount converts the main query into a per-value count of column:
+// "SELECT column, COUNT(*) FROM ... GROUP BY column". WITH, JOIN, and WHERE are
+// preserved; ORDER BY, LIMIT, and OFFSET are stripped. Queries that already use
+// GROUP BY, DISTINCT, or UNION at the main level are rejected because their rows
+// are no longer the rows the facet should count.
+func (m *SQLModifier) ConvertToFacetCount(column string) error {
+	column = strings.TrimSpace(column)
+	if column == "" {
+		return fmt.Errorf("facet column cannot be empty")
+	}
+
+	selectPos := m.findMainSelectPosition()
+	if selectPos == -1 {
+		return fmt.Errorf("could not find main SELECT clause")
+	}
+	if m.findMainClausePosition("FROM") == -1 {
+		return fmt.Errorf("query must contain a FROM clause")
+	}
+	if m.hasMainGroupBy() || m.hasMainDistinct() || m.hasMainUnion() {
+		return fmt.Errorf("facet counts are not supported on queries with a main-level GROUP BY, DISTINCT, or UNION")
+	}
+
+	m.stripMainOrderByAndLimit()
+
+	fromPos := m.findMainClausePosition("FROM")
+	m.query = m.query[:selectPos] + fmt.Sprintf("SELECT %s, COUNT(*) ", column) + m.query[fromPos:]
+
+	// GROUP BY goes after WHERE and before any HAVING / locking clause.
+	m.insertMainClause("GROUP BY", fmt.Sprintf("GROUP BY %s", column))
+	return nil
+}
+
+// RemoveWhereConditions removes the top-level AND conjuncts of the main WHERE
+// clause for which match returns true, and reports how many were removed. The
+// WHERE keyword is dropped when no conjunct is left. A WHERE clause with a
+// top-level OR cannot be split into conjuncts safely and returns an error.
+func (m *SQLModifier) RemoveWhereConditions(match func(condition string) bool) (int, error) {
+	wherePos := m.findMainClausePosition("WHERE")
+	if wherePos == -1 {
+		return 0, nil
+	}
+
+	end := m.clauseEnd("WHERE", wherePos)
+
+	conjuncts, hasOr := splitOnTopLevelAnd(m.query[wherePos+5 : end]) // +5 to skip "WHERE"
+	if hasOr {
+		return 0, fmt.Errorf("cannot remove a condition from a WHERE clause with a top-level OR")
+	}
+
+	var (
+		kept    []string
+		removed int
+	)
+	for _, c := range conjuncts {
+		if match(c) {
+			removed++
+			continue
+		}
+		kept = append(kept, c)
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	if len(kept) == 0 {
+		m.query = strings.TrimSpace(m.query[:wherePos] + m.query[end:])
+		return removed, nil
+	}
+	for i := range kept[:len(kept)-1] {
+		kept[i] = endLine(kept[i])
+	}
+	m.replaceClause(wherePos, end, "WHERE "+strings.Join(kept, " AND "))
+	return removed, nil
+}
+
+// splitOnTopLevelAnd splits a boolean expression on the AND operators that are
+// not inside parentheses, quotes, or a BETWEEN ... AND ... range. hasOr reports
+// whether a top-level OR was seen, in which case the split does not describe
+// the expression's conjuncts.
+func splitOnTopLevelAnd(s string) (parts []string, hasOr bool) {
+	var (
+		depth          int
+		start          int
+		pendingBetween int
+	)
+	isWordByte := func(c byte) bool {
+		return c == '_' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z'
+	}
+	masked := lexer.Mask(s)
+	for i := 0; i < len(masked); i++ {
+		c := masked[i]
+		switch {
+		case c == '(':
+			depth++
+			continue
+		case c == ')':
+			depth--
+			continue
+		case depth != 0 || !isWordByte(c) || i > 0 && isWordByte(masked[i-1]):
+			continue
+		}
+		j := i
+		for j < len(masked) && isWordByte(masked[j]) {
+			j++
+		}
+		switch masked[i:j] {
+		case "BETWEEN":
+			pendingBetween++
+		case "OR":
+			hasOr = true
+		case "AND":
+			if pendingBetween > 0 {
+				pendingBetween--
+				break
+			}
+			parts = append(parts, strings.TrimSpace(s[start:i]))
+			start = j
+		}
+		i = j - 1
+	}
+	if trimmed := strings.TrimSpace(s[start:]); trimmed != "" {
+		parts = append(parts, trimmed)
+	}
+	return parts, hasOr
+}
+
 // hasMainDistinct returns true if the main SELECT uses the DISTINCT keyword.
 func (m *SQLModifier) hasMainDistinct() bool {
 	selectPos := m.findMainSelectPosition()
 	if selectPos == -1 {
 		return false
 	}
-	afterSelect := strings.TrimSpace(m.query[selectPos+6:]) // skip "SELECT"
-	return strings.HasPrefix(strings.ToUpper(afterSelect), "DISTINCT")
+	afterSelect := strings.TrimSpace(m.masked()[selectPos+6:]) // skip "SELECT"
+	return strings.HasPrefix(afterSelect, "DISTINCT")
 }
 
 // hasMainGroupBy returns true if the main query has a GROUP BY clause at the top level.
@@ -287,12 +738,12 @@ func (m *SQLModifier) hasMainGroupBy() bool {
 // hasMainUnion returns true if the query has a UNION or UNION ALL clause at the top
 // level (not inside subqueries or CTEs).
 func (m *SQLModifier) hasMainUnion() bool {
-	queryUpper := strings.ToUpper(m.query)
+	queryUpper := m.masked()
 	re := regexp.MustCompile(`\bUNION\b`)
 	matches := re.FindAllStringIndex(queryUpper, -1)
 	for _, match := range matches {
 		pos := match[0]
-		queryBefore := m.query[:pos]
+		queryBefore := queryUpper[:pos]
 		if strings.Count(queryBefore, "(") == strings.Count(queryBefore, ")") {
 			return true
 		}
@@ -305,7 +756,7 @@ func (m *SQLModifier) hasMainUnion() bool {
 // wrong results (e.g. LIMIT caps the count to 1 row, ORDER BY wastes resources).
 func (m *SQLModifier) stripMainOrderByAndLimit() {
 	cutPos := -1
-	for _, clause := range []string{"ORDER BY", "LIMIT", "OFFSET"} {
+	for _, clause := range []string{"ORDER BY", "LIMIT", "OFFSET", "FETCH"} {
 		pos := m.findMainClausePosition(clause)
 		if pos != -1 && (cutPos == -1 || pos < cutPos) {
 			cutPos = pos
@@ -316,13 +767,31 @@ func (m *SQLModifier) stripMainOrderByAndLimit() {
 	}
 }
 
+// stripMainLocking removes a row-locking clause (e.g. FOR UPDATE) and anything
+// after it from the main query. A locking clause is invalid or pointless once the
+// query is wrapped in EXISTS(...) or an aggregate.
+func (m *SQLModifier) stripMainLocking() {
+	fromPos := m.findMainClausePosition("FROM")
+	cutPos := -1
+	for _, keyword := range lockingClause {
+		pos := m.findMainClauseAfter(keyword, fromPos)
+		if pos != -1 && (cutPos == -1 || pos < cutPos) {
+			cutPos = pos
+		}
+	}
+	if cutPos != -1 {
+		m.query = strings.TrimSpace(m.query[:cutPos])
+	}
+}
+
 // AppendWhere appends a condition to the WHERE clause.
 // When cteTarget is set it targets the CTE body; otherwise it targets the main query.
 // Returns an error only when cteTarget is set and the CTE cannot be found.
 func (m *SQLModifier) AppendWhere(condition string) error {
 	if m.cteTarget != "" {
-		return m.applyToCTEBody(func(sub *SQLModifier) {
+		return m.applyToCTEBody(func(sub *SQLModifier) error {
 			sub.appendWhereInternal(condition)
+			return nil
 		})
 	}
 	m.appendWhereInternal(condition)
@@ -331,89 +800,94 @@ func (m *SQLModifier) AppendWhere(condition string) error {
 
 // appendWhereInternal performs the WHERE append on m.query without any CTE targeting.
 func (m *SQLModifier) appendWhereInternal(condition string) {
-	wherePos := m.findMainClausePosition("WHERE")
-
-	if wherePos == -1 {
-		// No WHERE clause found, add one before GROUP BY, HAVING, ORDER BY, LIMIT, etc.
-		clauses := []string{"GROUP BY", "HAVING", "ORDER BY", "LIMIT", "OFFSET", "FETCH", "FOR UPDATE", "FOR SHARE", "LOCK IN SHARE MODE", "INTO"}
-		minPos := -1
+	m.appendCondition("WHERE", condition)
+}
 
-		for _, clause := range clauses {
-			clausePos := m.findMainClausePosition(clause)
-			if clausePos != -1 && (minPos == -1 || clausePos < minPos) {
-				minPos = clausePos
-			}
-		}
+// AppendHaving appends a condition to the HAVING clause, e.g. a condition on an
+// aggregate, which cannot go into WHERE.
+// When cteTarget is set it targets the CTE body; otherwise it targets the main query.
+// Returns an error only when cteTarget is set and the CTE cannot be found.
+func (m *SQLModifier) AppendHaving(condition string) error {
+	if m.cteTarget != "" {
+		return m.applyToCTEBody(func(sub *SQLModifier) error {
+			sub.appendCondition("HAVING", condition)
+			return nil
+		})
+	}
+	m.appendCondition("HAVING", condition)
+	return nil
+}
 
-		if minPos != -1 {
-			m.query = strings.TrimSpace(m.query[:minPos]) + fmt.Sprintf(" WHERE %s ", condition) + m.query[minPos:]
-			return
-		}
+// appendCondition ANDs condition to the clause, WHERE or HAVING, of m.query, or
+// adds the clause where the grammar puts it.
+func (m *SQLModifier) appendCondition(clause, condition string) {
+	clausePos := m.findMainClausePosition(clause)
 
-		// No other clauses found
-		m.query = m.query + fmt.Sprintf(" WHERE %s", condition)
+	if clausePos == -1 {
+		// No such clause found, add one before the clauses that follow it (GROUP BY,
+		// ORDER BY, LIMIT, etc.)
+		m.insertMainClause(clause, fmt.Sprintf("%s %s", clause, condition))
 		return
 
 	} else {
-		// Find the end of the WHERE clause (next clause or end of query)
-		clauses := []string{"GROUP BY", "HAVING", "ORDER BY", "LIMIT", "OFFSET", "FETCH", "FOR UPDATE", "FOR SHARE", "LOCK IN SHARE MODE", "INTO"}
-		nextClausePos := -1
-
-		for _, clause := range clauses {
-			pos := m.findMainClausePosition(clause)
-			if pos != -1 && (nextClausePos == -1 || pos < nextClausePos) {
-				nextClausePos = pos
-			}
-		}
-
-		// Extract the existing WHERE condition
-		var existingCondition string
+		// Find the end of the clause (next clause or end of query)
+		nextClausePos := m.nextClause(clause, clausePos)
 		if nextClausePos == -1 {
-			existingCondition = strings.TrimSpace(m.query[wherePos+5:]) // +5 to skip "WHERE"
-		} else {
-			existingCondition = strings.TrimSpace(m.query[wherePos+5 : nextClausePos])
+			nextClausePos = len(m.query)
 		}
+		start := clausePos + len(clause)
+
+		// Extract the existing condition
+		existingCondition := strings.TrimSpace(m.query[start:nextClausePos])
 
 		// Check if the existing condition has multiple conditions (contains AND or OR operators)
+		existingMasked := m.masked()[start:nextClausePos]
 		reMultipleConditions := regexp.MustCompile(`\b(AND|OR)\b`)
-		needsParentheses := reMultipleConditions.MatchString(existingCondition)
+		needsParentheses := reMultipleConditions.MatchString(existingMasked)
 
-		var newWhere string
+		var newCondition string
 		if needsParentheses {
-			newWhere = fmt.Sprintf("WHERE (%s) AND %s", existingCondition, condition)
+			newCondition = fmt.Sprintf("%s (%s) AND %s", clause, endLine(existingCondition), condition)
 		} else {
-			newWhere = fmt.Sprintf("WHERE %s AND %s", existingCondition, condition)
+			newCondition = fmt.Sprintf("%s %s AND %s", clause, endLine(existingCondition), condition)
 		}
 
-		if nextClausePos == -1 {
-			m.query = m.query[:wherePos] + newWhere
-			return
-		} else {
-			m.query = m.query[:wherePos] + newWhere + " " + m.query[nextClausePos:]
-			return
-		}
+		m.replaceClause(clausePos, nextClausePos, newCondition)
+		return
 	}
 }
 
+// HasGroupBy reports whether the statement has a GROUP BY clause: the body of the
+// target when cteTarget is set, the main query otherwise.
+func (m *SQLModifier) HasGroupBy() (bool, error) {
+	if m.cteTarget == "" {
+		return m.findMainClausePosition("GROUP BY") != -1, nil
+	}
+	start, end, err := m.targetBodyBounds()
+	if err != nil {
+		return false, err
+	}
+	body := &SQLModifier{query: m.query[start:end]}
+	return body.findMainClausePosition("GROUP BY") != -1, nil
+}
+
 // SetOrderBy sets the ORDER BY clause.
 // When cteTarget is set it targets the CTE body; otherwise it targets the main query.
 // Returns an error only when cteTarget is set and the CTE cannot be found.
 func (m *SQLModifier) SetOrderBy(orderBy ...string) error {
 	if m.cteTarget != "" {
-		return m.applyToCTEBody(func(sub *SQLModifier) {
-			sub.setOrderByInternal(orderBy...)
+		return m.applyToCTEBody(func(sub *SQLModifier) error {
+			return m.setOrderBy(sub, m.cteTarget, orderBy)
 		})
 	}
-	m.setOrderByInternal(orderBy...)
-	return nil
+	return m.setOrderBy(m, "", orderBy)
 }
 
 // SetMainOrderBy always sets the ORDER BY on the main query, regardless of cteTarget.
 // Used when WithCTETarget is active to mirror the effective sort order on the outer
 // SELECT so the joined result set is returned in the correct order.
 func (m *SQLModifier) SetMainOrderBy(orderBy ...string) error {
-	m.setOrderByInternal(orderBy...)
-	return nil
+	return m.setOrderBy(m, "", orderBy)
 }
 
 // AppendWhereMain appends a WHERE condition to the main query, regardless of cteTarget.
@@ -424,106 +898,218 @@ func (m *SQLModifier) AppendWhereMain(condition string) error {
 
 // SetLimitMain sets the LIMIT clause on the main query, regardless of cteTarget.
 func (m *SQLModifier) SetLimitMain(newLimit string) error {
+	if err := m.applyRowLimitingPolicy(m, ""); err != nil {
+		return err
+	}
 	m.setLimitInternal(newLimit)
 	return nil
 }
 
 // SetOffsetMain sets the OFFSET clause on the main query, regardless of cteTarget.
 func (m *SQLModifier) SetOffsetMain(newOffset string) error {
+	if err := m.applyRowLimitingPolicy(m, ""); err != nil {
+		return err
+	}
 	m.setOffsetInternal(newOffset)
 	return nil
 }
 
-// setOrderByInternal performs the ORDER BY set on m.query without any CTE targeting.
-func (m *SQLModifier) setOrderByInternal(orderBy ...string) {
-	newOrderBy := strings.Join(orderBy, ", ")
-
-	orderByPos := m.findMainClausePosition("ORDER BY")
-
-	if orderByPos == -1 {
-		clauses := []string{"LIMIT", "OFFSET", "FETCH", "FOR UPDATE", "FOR SHARE", "LOCK IN SHARE MODE", "INTO"}
-		minPos := -1
-
-		for _, clause := range clauses {
-			clausePos := m.findMainClausePosition(clause)
-			if clausePos != -1 && (minPos == -1 || clausePos < minPos) {
-				minPos = clausePos
-			}
-		}
+// SetLock adds the row-locking clause lock, e.g. "FOR UPDATE SKIP LOCKED", where
+// the grammar puts "FOR UPDATE": after ORDER BY and the row-limiting clauses.
+// When cteTarget is set it targets the CTE body. A statement that already has a
+// locking clause returns an error.
+func (m *SQLModifier) SetLock(lock string) error {
+	if m.cteTarget != "" {
+		return m.applyToCTEBody(func(sub *SQLModifier) error {
+			return sub.setLockInternal(lock)
+		})
+	}
+	return m.setLockInternal(lock)
+}
 
-		if minPos != -1 {
-			m.query = strings.TrimSpace(m.query[:minPos]) + fmt.Sprintf(" ORDER BY %s ", newOrderBy) + m.query[minPos:]
-			return
+// setLockInternal performs SetLock on m.query without any CTE targeting.
+func (m *SQLModifier) setLockInternal(lock string) error {
+	for _, keyword := range lockingClause {
+		if m.findMainClauseAfter(keyword, m.findMainClausePosition("FROM")) != -1 {
+			return fmt.Errorf("query already has a locking clause: %s", keyword)
 		}
+	}
+	m.insertMainClause("FOR UPDATE", lock)
+	return nil
+}
 
-		m.query = m.query + fmt.Sprintf(" ORDER BY %s", newOrderBy)
-		return
-	} else {
-		clauses := []string{"LIMIT", "OFFSET", "FETCH", "FOR UPDATE", "FOR SHARE", "LOCK IN SHARE MODE", "INTO"}
-		nextClausePos := -1
+// claim reports whether the clause policy has yet to be applied to the clause
+// group (ORDER BY or the row-limiting clauses) of the statement named target, the
+// main query when empty, and records that it now is. Only the clauses the query
+// had before the modifier set its own are subject to the policy.
+func (m *SQLModifier) claim(target, group string) bool {
+	key := target + "\x00" + group
+	if m.claimed[key] {
+		return false
+	}
+	if m.claimed == nil {
+		m.claimed = make(map[string]bool)
+	}
+	m.claimed[key] = true
+	return true
+}
 
-		for _, clause := range clauses {
-			pos := m.findMainClausePosition(clause)
-			if pos != -1 && (nextClausePos == -1 || pos < nextClausePos) {
-				nextClausePos = pos
+// setOrderBy sets the ORDER BY of sub, the statement named target, applying the
+// clause policy to an existing one.
+func (m *SQLModifier) setOrderBy(sub *SQLModifier, target string, orderBy []string) error {
+	if m.claim(target, "ORDER BY") {
+		if existing := sub.mainOrderByTerms(); len(existing) > 0 {
+			switch m.policy {
+			case RejectClause:
+				return fmt.Errorf("%w: ORDER BY", ErrExistingClause)
+			case KeepOrderBy:
+				orderBy = appendSecondarySort(orderBy, existing)
 			}
 		}
+	}
+	sub.setOrderByInternal(orderBy...)
+	return nil
+}
 
-		if nextClausePos == -1 {
-			m.query = m.query[:orderByPos] + fmt.Sprintf("ORDER BY %s", newOrderBy)
-			return
-		} else {
-			m.query = m.query[:orderByPos] + fmt.Sprintf("ORDER BY %s ", newOrderBy) + m.query[nextClausePos:]
-			return
+// applyRowLimitingPolicy applies the clause policy to the LIMIT, OFFSET and FETCH
+// clauses of sub, the statement named target, before its first limit or offset is
+// set.
+func (m *SQLModifier) applyRowLimitingPolicy(sub *SQLModifier, target string) error {
+	if !m.claim(target, "LIMIT") {
+		return nil
+	}
+	for _, clause := range rowLimitingClauses {
+		if sub.findMainClausePosition(clause) == -1 {
+			continue
+		}
+		if m.policy == RejectClause {
+			return fmt.Errorf("%w: %s", ErrExistingClause, clause)
 		}
+		sub.stripRowLimiting()
+		break
 	}
+	return nil
 }
 
-// SetLimit sets the LIMIT clause.
+var (
+	// rowLimitingClauses are the clauses set by SetLimit and SetOffset.
+	rowLimitingClauses = []string{"LIMIT", "OFFSET", "FETCH"}
+)
+
+// stripRowLimiting removes the main-level LIMIT, OFFSET and FETCH clauses, keeping
+// the locking clauses that follow them.
+func (m *SQLModifier) stripRowLimiting() {
+	var starts []int
+	for _, clause := range rowLimitingClauses {
+		if pos := m.findMainClausePosition(clause); pos != -1 {
+			starts = append(starts, pos)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(starts)))
+
+	for _, start := range starts {
+		// the row-limiting clauses follow ORDER BY in any order
+		end := m.clauseEnd("ORDER BY", start)
+		// at the end of the query the whitespace before the clause is kept, so
+		// a clause inserted in its place keeps the layout
+		m.query = m.query[:start] + m.query[end:]
+	}
+}
+
+// mainOrderByTerms returns the terms of the main-level ORDER BY, or nil when there
+// is none.
+func (m *SQLModifier) mainOrderByTerms() []string {
+	pos := m.findMainClausePosition("ORDER BY")
+	if pos == -1 {
+		return nil
+	}
+	start := pos + strings.Index(m.masked()[pos:], "BY") + 2
+
+	end := m.clauseEnd("ORDER BY", pos)
+
+	var terms []string
+	for _, term := range splitOnTopLevelComma(m.query[start:end]) {
+		if term = strings.TrimSpace(term); term != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// sortDirectionRe matches the direction and null ordering at the end of an ORDER
+// BY term.
+var sortDirectionRe = regexp.MustCompile(`(?i)(?:\s+(?:ASC|DESC))?(?:\s+NULLS\s+(?:FIRST|LAST))?\s*$`)
+
+// appendSecondarySort returns orderBy followed by the existing terms whose
+// expression is not already sorted on by orderBy.
+func appendSecondarySort(orderBy, existing []string) []string {
+	sortExpr := func(term string) string {
+		return strings.Join(strings.Fields(strings.ToUpper(sortDirectionRe.ReplaceAllString(term, ""))), " ")
+	}
+
+	sorted := make(map[string]bool, len(orderBy))
+	for _, term := range orderBy {
+		sorted[sortExpr(term)] = true
+	}
+
+	out := append([]string(nil), orderBy...)
+	for _, term := range existing {
+		if !sorted[sortExpr(term)] {
+			out = append(out, endLine(term))
+		}
+	}
+	return out
+}
+
+// setOrderByInternal performs the ORDER BY set on m.query without any CTE targeting.
+func (m *SQLModifier) setOrderByInternal(orderBy ...string) {
+	newOrderBy := strings.Join(orderBy, ", ")
+
+	orderByPos := m.findMainClausePosition("ORDER BY")
+
+	if orderByPos == -1 {
+		m.insertMainClause("ORDER BY", fmt.Sprintf("ORDER BY %s", newOrderBy))
+		return
+	} else {
+		m.replaceClause(orderByPos, m.clauseEnd("ORDER BY", orderByPos), fmt.Sprintf("ORDER BY %s", newOrderBy))
+		return
+	}
+}
+
+// SetLimit sets the LIMIT clause.
 // When cteTarget is set it targets the CTE body; otherwise it targets the main query.
 // Returns an error only when cteTarget is set and the CTE cannot be found.
 func (m *SQLModifier) SetLimit(newLimit string) error {
 	if m.cteTarget != "" {
-		return m.applyToCTEBody(func(sub *SQLModifier) {
+		return m.applyToCTEBody(func(sub *SQLModifier) error {
+			if err := m.applyRowLimitingPolicy(sub, m.cteTarget); err != nil {
+				return err
+			}
 			sub.setLimitInternal(newLimit)
+			return nil
 		})
 	}
-	m.setLimitInternal(newLimit)
-	return nil
+	return m.SetLimitMain(newLimit)
 }
 
 // setLimitInternal performs the LIMIT set on m.query without any CTE targeting.
 func (m *SQLModifier) setLimitInternal(newLimit string) {
+	switch m.limitSyntax {
+	case OffsetFetch, FetchFirst:
+		m.setFetchInternal(newLimit)
+		return
+	case Top:
+		m.setTopInternal(newLimit)
+		return
+	}
+
 	limitPos := m.findMainClausePosition("LIMIT")
 
 	if limitPos == -1 {
-		clauses := []string{"OFFSET", "FETCH", "FOR UPDATE", "FOR SHARE", "LOCK IN SHARE MODE", "INTO"}
-		minPos := -1
-
-		for _, clause := range clauses {
-			clausePos := m.findMainClausePosition(clause)
-			if clausePos != -1 && (minPos == -1 || clausePos < minPos) {
-				minPos = clausePos
-			}
-		}
-
-		if minPos != -1 {
-			m.query = strings.TrimSpace(m.query[:minPos]) + fmt.Sprintf(" LIMIT %s ", newLimit) + m.query[minPos:]
-			return
-		}
-
-		m.query = m.query + fmt.Sprintf(" LIMIT %s", newLimit)
+		m.insertMainClause("LIMIT", fmt.Sprintf("LIMIT %s", newLimit))
 		return
 	} else {
-		clauses := []string{"OFFSET", "FETCH", "FOR UPDATE", "FOR SHARE", "LOCK IN SHARE MODE", "INTO"}
-		nextClausePos := -1
-
-		for _, clause := range clauses {
-			pos := m.findMainClausePosition(clause)
-			if pos != -1 && pos > limitPos && (nextClausePos == -1 || pos < nextClausePos) {
-				nextClausePos = pos
-			}
-		}
+		nextClausePos := m.nextClause("LIMIT", limitPos)
 
 		if nextClausePos == -1 {
 			queryAfterLimit := m.query[limitPos+5:] // +5 to skip "LIMIT"
@@ -535,11 +1121,11 @@ func (m *SQLModifier) setLimitInternal(newLimit string) {
 				m.query = m.query[:limitPos] + fmt.Sprintf("LIMIT %s", newLimit) + m.query[limitEndPos:]
 				return
 			} else {
-				m.query = m.query[:limitPos] + fmt.Sprintf("LIMIT %s", newLimit)
+				m.replaceClause(limitPos, len(m.query), fmt.Sprintf("LIMIT %s", newLimit))
 				return
 			}
 		} else {
-			m.query = m.query[:limitPos] + fmt.Sprintf("LIMIT %s ", newLimit) + m.query[nextClausePos:]
+			m.replaceClause(limitPos, nextClausePos, fmt.Sprintf("LIMIT %s", newLimit))
 			return
 		}
 	}
@@ -550,207 +1136,245 @@ func (m *SQLModifier) setLimitInternal(newLimit string) {
 // Returns an error only when cteTarget is set and the CTE cannot be found.
 func (m *SQLModifier) SetOffset(newOffset string) error {
 	if m.cteTarget != "" {
-		return m.applyToCTEBody(func(sub *SQLModifier) {
+		return m.applyToCTEBody(func(sub *SQLModifier) error {
+			if err := m.applyRowLimitingPolicy(sub, m.cteTarget); err != nil {
+				return err
+			}
 			sub.setOffsetInternal(newOffset)
+			return nil
 		})
 	}
-	m.setOffsetInternal(newOffset)
-	return nil
+	return m.SetOffsetMain(newOffset)
 }
 
 // setOffsetInternal performs the OFFSET set on m.query without any CTE targeting.
 func (m *SQLModifier) setOffsetInternal(newOffset string) {
+	switch m.limitSyntax {
+	case OffsetFetch, FetchFirst, Top:
+		m.setOffsetRowsInternal(newOffset)
+		return
+	}
+
 	offsetPos := m.findMainClausePosition("OFFSET")
 
 	if offsetPos == -1 {
-		clauses := []string{"FETCH", "FOR UPDATE", "FOR SHARE", "LOCK IN SHARE MODE", "INTO"}
-		minPos := -1
+		m.insertMainClause("OFFSET", fmt.Sprintf("OFFSET %s", newOffset))
+		return
+	} else {
+		m.replaceClause(offsetPos, m.clauseEnd("OFFSET", offsetPos), fmt.Sprintf("OFFSET %s", newOffset))
+		return
+	}
+}
 
-		for _, clause := range clauses {
-			clausePos := m.findMainClausePosition(clause)
-			if clausePos != -1 && (minPos == -1 || clausePos < minPos) {
-				minPos = clausePos
-			}
+var (
+	// offsetRowsRe matches an OFFSET clause at the start of the input, with or
+	// without the trailing ROWS keyword.
+	offsetRowsRe = regexp.MustCompile(`(?i)^OFFSET\s+[^\s()]+(?:\s+ROWS?\b)?`)
+	// fetchRowsRe matches a FETCH FIRST/NEXT clause at the start of the input.
+	fetchRowsRe = regexp.MustCompile(`(?i)^FETCH\s+(?:FIRST|NEXT)\s+[^\s()]+\s+ROWS?\s+ONLY\b`)
+	// selectHeadRe matches "SELECT" and an optional DISTINCT / ALL at the start of
+	// the input; TOP goes right after it.
+	selectHeadRe = regexp.MustCompile(`(?i)^SELECT(?:\s+(?:DISTINCT|ALL)\b)?`)
+	// existingTopRe matches a TOP clause at the start of the input.
+	existingTopRe = regexp.MustCompile(`(?i)^\s+TOP\s*(?:\([^)]*\)|\S+)`)
+)
+
+// setFetchInternal sets "FETCH NEXT n ROWS ONLY", adding "OFFSET 0 ROWS" in front
+// of it when the query has no OFFSET clause yet. The FetchFirst syntax sets
+// "FETCH FIRST n ROWS ONLY" and needs no OFFSET.
+func (m *SQLModifier) setFetchInternal(newLimit string) {
+	fetch := fmt.Sprintf("FETCH NEXT %s ROWS ONLY", newLimit)
+	if m.limitSyntax == FetchFirst {
+		fetch = fmt.Sprintf("FETCH FIRST %s ROWS ONLY", newLimit)
+	}
+
+	if fetchPos := m.findMainClausePosition("FETCH"); fetchPos != -1 {
+		if loc := fetchRowsRe.FindStringIndex(m.query[fetchPos:]); loc != nil {
+			m.query = m.query[:fetchPos] + fetch + m.query[fetchPos+loc[1]:]
+			return
 		}
+	}
 
-		if minPos != -1 {
-			m.query = strings.TrimSpace(m.query[:minPos]) + fmt.Sprintf(" OFFSET %s ", newOffset) + m.query[minPos:]
+	if offsetPos := m.findMainClausePosition("OFFSET"); offsetPos != -1 {
+		if loc := offsetRowsRe.FindStringIndex(m.query[offsetPos:]); loc != nil {
+			end := offsetPos + loc[1]
+			m.query = m.query[:end] + " " + fetch + m.query[end:]
 			return
 		}
+	}
 
-		m.query = m.query + fmt.Sprintf(" OFFSET %s", newOffset)
+	if m.limitSyntax == FetchFirst {
+		m.insertMainClause("FETCH", fetch)
 		return
-	} else {
-		clauses := []string{"FETCH", "FOR UPDATE", "FOR SHARE", "LOCK IN SHARE MODE", "INTO"}
-		nextClausePos := -1
+	}
 
-		for _, clause := range clauses {
-			pos := m.findMainClausePosition(clause)
-			if pos != -1 && pos > offsetPos && (nextClausePos == -1 || pos < nextClausePos) {
-				nextClausePos = pos
-			}
-		}
+	m.insertMainClause("OFFSET", "OFFSET 0 ROWS "+fetch)
+}
 
-		if nextClausePos == -1 {
-			m.query = m.query[:offsetPos] + fmt.Sprintf("OFFSET %s", newOffset)
-			return
-		} else {
-			m.query = m.query[:offsetPos] + fmt.Sprintf("OFFSET %s ", newOffset) + m.query[nextClausePos:]
+// setOffsetRowsInternal sets "OFFSET m ROWS", replacing an existing OFFSET clause
+// or inserting it before FETCH.
+func (m *SQLModifier) setOffsetRowsInternal(newOffset string) {
+	offset := fmt.Sprintf("OFFSET %s ROWS", newOffset)
+
+	if offsetPos := m.findMainClausePosition("OFFSET"); offsetPos != -1 {
+		if loc := offsetRowsRe.FindStringIndex(m.query[offsetPos:]); loc != nil {
+			m.query = m.query[:offsetPos] + offset + m.query[offsetPos+loc[1]:]
 			return
 		}
 	}
-}
 
-// StripUnusedLeftJoins removes main-level LEFT JOIN clauses whose table/alias
-// is not referenced in the WHERE, GROUP BY, or HAVING clauses. LEFT JOINs that
-// are transitively needed (referenced in ON clauses of other needed LEFT JOINs)
-// are kept. SELECT columns referencing removed aliases are also cleaned up.
-func (m *SQLModifier) StripUnusedLeftJoins() {
-	// Collect clause texts that determine whether a LEFT JOIN alias is "needed".
-	// An alias is needed if it appears in WHERE, GROUP BY, or HAVING.
-	var clauseTextsUpper []string
-	for _, clause := range []struct {
-		keyword    string
-		terminators []string
-	}{
-		{"WHERE", []string{"GROUP BY", "HAVING", "ORDER BY", "LIMIT", "OFFSET"}},
-		{"GROUP BY", []string{"HAVING", "ORDER BY", "LIMIT", "OFFSET"}},
-		{"HAVING", []string{"ORDER BY", "LIMIT", "OFFSET"}},
-	} {
-		pos := m.findMainClausePosition(clause.keyword)
-		if pos == -1 {
-			continue
-		}
-		end := len(m.query)
-		for _, kw := range clause.terminators {
-			if p := m.findMainClausePosition(kw); p != -1 && p > pos && p < end {
-				end = p
-			}
-		}
-		clauseTextsUpper = append(clauseTextsUpper, strings.ToUpper(m.query[pos:end]))
+	if fetchPos := m.findMainClausePosition("FETCH"); fetchPos != -1 {
+		m.query = m.query[:fetchPos] + offset + " " + m.query[fetchPos:]
+		return
 	}
 
-	// Find all main-level LEFT [OUTER] JOIN positions.
-	ljRe := regexp.MustCompile(`(?i)\bLEFT\s+(?:OUTER\s+)?JOIN\b`)
-	allMatches := ljRe.FindAllStringIndex(m.query, -1)
-	mainSelectPos := m.findMainSelectPosition()
-
-	type ljEntry struct {
-		start     int      // position of "LEFT" keyword
-		kwEnd     int      // end of "LEFT [OUTER] JOIN" keyword
-		end       int      // end of the entire LEFT JOIN clause (ON condition inclusive)
-		tableName string   // table name (e.g. "ticket" in "LEFT JOIN ticket t")
-		alias     string   // alias if present, otherwise same as tableName
-		idents    []string // all identifiers to check (uppercase): [alias] or [tableName, alias]
-		onUpper   string   // ON clause text (uppercase) for dependency analysis
-	}
+	m.insertMainClause("OFFSET", offset)
+}
 
-	var entries []ljEntry
-	for _, match := range allMatches {
-		pos := match[0]
-		if mainSelectPos != -1 && pos < mainSelectPos {
-			continue
-		}
-		before := m.query[:pos]
-		if strings.Count(before, "(") != strings.Count(before, ")") {
-			continue
-		}
-		entries = append(entries, ljEntry{start: pos, kwEnd: match[1]})
+// setTopInternal sets "TOP (n)" right after the main SELECT [DISTINCT | ALL],
+// replacing an existing TOP. Queries whose main SELECT cannot be located, or that
+// already skip rows with OFFSET, get "FETCH NEXT n ROWS ONLY" instead.
+func (m *SQLModifier) setTopInternal(newLimit string) {
+	selectPos := m.findMainSelectPosition()
+	if selectPos == -1 || m.findMainClausePosition("OFFSET") != -1 {
+		m.setFetchInternal(newLimit)
+		return
 	}
 
-	if len(entries) == 0 {
+	loc := selectHeadRe.FindStringIndex(m.query[selectPos:])
+	if loc == nil {
+		m.setFetchInternal(newLimit)
 		return
 	}
 
-	// Find all main-level clause boundary positions to determine ON clause extents.
-	joinRe := regexp.MustCompile(`(?i)\b(?:(?:LEFT|RIGHT|FULL)\s+(?:OUTER\s+)?|INNER\s+|CROSS\s+)?JOIN\b`)
-	clauseRe := regexp.MustCompile(`(?i)\b(?:WHERE|GROUP\s+BY|HAVING|ORDER\s+BY|LIMIT|OFFSET|UNION(?:\s+ALL)?)\b`)
-	var boundaries []int
-	for _, re := range []*regexp.Regexp{joinRe, clauseRe} {
-		for _, match := range re.FindAllStringIndex(m.query, -1) {
-			pos := match[0]
-			if mainSelectPos != -1 && pos < mainSelectPos {
-				continue
-			}
-			before := m.query[:pos]
-			if strings.Count(before, "(") == strings.Count(before, ")") {
-				boundaries = append(boundaries, pos)
-			}
-		}
+	insertAt := selectPos + loc[1]
+	rest := m.query[insertAt:]
+	if top := existingTopRe.FindStringIndex(rest); top != nil {
+		rest = rest[top[1]:]
 	}
-	sort.Ints(boundaries)
 
-	// For each LEFT JOIN, find its alias and ON clause extent.
-	onRe := regexp.MustCompile(`(?i)\bON\b`)
-	validCount := 0
-	for i := range entries {
-		// Find the ON keyword after this LEFT JOIN keyword.
-		onMatches := onRe.FindAllStringIndex(m.query[entries[i].kwEnd:], -1)
-		onAbsPos := -1
-		for _, om := range onMatches {
-			candidate := entries[i].kwEnd + om[0]
-			before := m.query[:candidate]
-			if strings.Count(before, "(") == strings.Count(before, ")") {
-				onAbsPos = candidate
-				break
-			}
-		}
-		if onAbsPos == -1 {
-			continue
-		}
+	m.query = m.query[:insertAt] + fmt.Sprintf(" TOP (%s)", newLimit) + rest
+}
 
-		// Extract table name and alias between LEFT JOIN keyword end and ON.
-		// Patterns: "table alias", "table AS alias", "table" (no alias),
-		//           "(subquery) alias", "(subquery) AS alias"
-		between := strings.TrimSpace(m.query[entries[i].kwEnd:onAbsPos])
-		words := strings.Fields(between)
-		if len(words) == 0 {
-			continue
-		}
+// rowNumLimitRe matches a LIMIT clause with its optional OFFSET, as written by
+// SetLimit / SetOffset under the RowNum syntax.
+var rowNumLimitRe = regexp.MustCompile(`(?i)\s*\bLIMIT\s+([^\s()]+)(?:\s+OFFSET\s+([^\s()]+))?`)
 
-		alias := strings.Trim(words[len(words)-1], "`\"[]")
-		tableName := strings.Trim(words[0], "`\"[]")
+// applyRowNum rewrites every LIMIT [OFFSET] clause of query into ROWNUM filters
+// around the statement it belongs to (the main query or a parenthesized body such
+// as a CTE), keeping the statement's ORDER BY inside the wrapped subquery. Clauses
+// are rewritten from last to first, and found again after each rewrite, as
+// wrapping a statement moves the clauses nested in it.
+//
+// An offset is filtered on a kuysor_rn column, which the outer query leaves out
+// by selecting the output columns of the statement by name. When the statement
+// selects "*" or an unnamed expression they can't be listed, so the outer query
+// selects "*" and returns kuysor_rn as well.
+func applyRowNum(query string) string {
+	for {
+		matches := rowNumLimitRe.FindAllStringSubmatchIndex(lexer.Mask(query), -1)
+		if len(matches) == 0 {
+			return query
+		}
 
-		// For subqueries, the first word starts with "(" — skip table name tracking.
-		if strings.HasPrefix(words[0], "(") {
-			tableName = ""
+		match := matches[len(matches)-1]
+		limit := query[match[2]:match[3]]
+		masked := lexer.Mask(query)
+
+		// the statement starts after the unmatched '(' before the clause, or at the
+		// main SELECT for a top-level clause
+		start, depth := -1, 0
+		for j := match[0] - 1; j >= 0 && start == -1; j-- {
+			switch masked[j] {
+			case ')':
+				depth++
+			case '(':
+				if depth == 0 {
+					start = j + 1
+				}
+				depth--
+			}
+		}
+		if start == -1 {
+			start = 0
+			if pos := (&SQLModifier{query: query}).findMainSelectPosition(); pos != -1 {
+				start = pos
+			}
 		}
 
-		// Build list of identifiers to match against clauses.
-		var idents []string
-		aliasUpper := strings.ToUpper(alias)
-		tableUpper := strings.ToUpper(tableName)
-		idents = append(idents, aliasUpper)
-		if tableUpper != "" && tableUpper != aliasUpper {
-			idents = append(idents, tableUpper)
+		// and ends at the unmatched ')' after the clause, or at the end of the query
+		end := len(query)
+		depth = 0
+		for j := match[1]; j < len(query); j++ {
+			if masked[j] == '(' {
+				depth++
+			} else if masked[j] == ')' {
+				if depth == 0 {
+					end = j
+					break
+				}
+				depth--
+			}
 		}
 
-		// Find end of this LEFT JOIN clause: next boundary after onAbsPos
-		// that is not this LEFT JOIN's own start position.
-		clauseEnd := len(m.query)
-		for _, bp := range boundaries {
-			if bp > onAbsPos && bp != entries[i].start {
-				clauseEnd = bp
-				break
+		inner := endLine(strings.TrimSpace(query[start:match[0]] + query[match[1]:end]))
+		var wrapped string
+		if match[4] == -1 {
+			wrapped = fmt.Sprintf("SELECT * FROM (%s) WHERE ROWNUM <= %s", inner, limit)
+		} else {
+			offset := query[match[4]:match[5]]
+			columns := "*"
+			if names, ok := outputNames(inner); ok {
+				columns = strings.Join(names, ", ")
 			}
+			wrapped = fmt.Sprintf("SELECT %s FROM (SELECT kuysor_rownum.*, ROWNUM kuysor_rn FROM (%s) kuysor_rownum WHERE ROWNUM <= %s + %s) WHERE kuysor_rn > %s", columns, inner, offset, limit, offset)
 		}
 
-		entries[i].end = clauseEnd
-		entries[i].tableName = tableName
-		entries[i].alias = alias
-		entries[i].idents = idents
-		entries[i].onUpper = strings.ToUpper(m.query[onAbsPos:clauseEnd])
-		validCount++
+		query = query[:start] + wrapped + query[end:]
 	}
+}
 
-	// Filter out entries that couldn't be parsed.
-	valid := make([]ljEntry, 0, validCount)
-	for _, e := range entries {
-		if e.alias != "" {
-			valid = append(valid, e)
+// outputNames returns the names of the columns output by the SELECT list of
+// query, or false when an item is "*", "x.*" or an unnamed expression, or when two
+// items share a name, as the outer query could not select them by name.
+func outputNames(query string) ([]string, bool) {
+	items := selectList(query)
+	if len(items) == 0 {
+		return nil, false
+	}
+	var (
+		names = make([]string, 0, len(items))
+		seen  = make(map[string]bool, len(items))
+	)
+	for _, item := range items {
+		key := strings.ToUpper(unquote(item.name))
+		if item.name == "" || seen[key] {
+			return nil, false
 		}
+		seen[key] = true
+		names = append(names, item.name)
 	}
+	return names, true
+}
 
+// StripUnusedLeftJoins removes main-level LEFT JOIN clauses whose table/alias
+// is not referenced in the WHERE, GROUP BY, or HAVING clauses. LEFT JOINs that
+// are transitively needed (referenced in ON clauses of other needed LEFT JOINs)
+// are kept. SELECT columns referencing removed aliases are also cleaned up.
+//
+// referenced lists extra expressions (e.g. the columns of a COUNT(DISTINCT ...))
+// that will survive the rewrite; LEFT JOINs they reference are kept as well.
+func (m *SQLModifier) StripUnusedLeftJoins(referenced ...string) {
+	// Collect clause texts that determine whether a LEFT JOIN alias is "needed".
+	// An alias is needed if it appears in WHERE, GROUP BY, HAVING, or referenced.
+	var clauseTextsUpper []string
+	for _, expr := range referenced {
+		clauseTextsUpper = append(clauseTextsUpper, strings.ToUpper(expr))
+	}
+	clauseTextsUpper = append(clauseTextsUpper, m.mainFilterClauseTexts()...)
+
+	// Find all main-level LEFT [OUTER] JOIN clauses.
+	valid := m.findMainJoins(leftJoinRe)
 	if len(valid) == 0 {
 		return
 	}
@@ -825,6 +1449,608 @@ func (m *SQLModifier) StripUnusedLeftJoins() {
 	m.cleanSelectForRemovedAliases(removedAliases)
 }
 
+// mainFilterClauseTexts returns the uppercased texts of the main WHERE, GROUP BY,
+// and HAVING clauses — the clauses whose references keep a JOIN alias needed
+// when the SELECT list is rewritten. With a HAVING clause the SELECT list is
+// included too, since HAVING may refer to its aliases.
+func (m *SQLModifier) mainFilterClauseTexts() []string {
+	var texts []string
+	for _, clause := range []string{"WHERE", "GROUP BY", "HAVING"} {
+		pos := m.findMainClausePosition(clause)
+		if pos == -1 {
+			continue
+		}
+		texts = append(texts, strings.ToUpper(m.query[pos:m.clauseEnd(clause, pos)]))
+		if clause == "HAVING" {
+			if selectPos, fromPos := m.findMainSelectPosition(), m.findMainClausePosition("FROM"); selectPos != -1 && fromPos > selectPos {
+				texts = append(texts, strings.ToUpper(m.query[selectPos:fromPos]))
+			}
+		}
+	}
+	return texts
+}
+
+// ForeignKey declares that Table.Column is a foreign key referencing the unique
+// key RefColumn of RefTable. When NotNull is set, every Table row matches exactly
+// one RefTable row on those columns.
+type ForeignKey struct {
+	Table     string
+	Column    string
+	RefTable  string
+	RefColumn string
+	NotNull   bool
+}
+
+// StripRedundantInnerJoins removes main-level INNER JOINs that cannot change the
+// number of rows. A join is removed when its ON condition is a single equality
+// that follows one of the NotNull fks from the child table to the referenced
+// unique key, and
+// the joined alias is not referenced in WHERE, GROUP BY, HAVING, or the ON clause
+// of a kept join. SELECT columns referencing removed aliases are cleaned up; when
+// the main SELECT is DISTINCT or the query is a UNION, the SELECT list counts as a
+// reference because dropping its columns would change the result.
+func (m *SQLModifier) StripRedundantInnerJoins(fks []ForeignKey) {
+	if len(fks) == 0 {
+		return
+	}
+
+	joins := m.findMainJoins(anyJoinRe)
+	if len(joins) == 0 {
+		return
+	}
+	tables := m.mainTableAliases(joins)
+
+	texts := m.mainFilterClauseTexts()
+	if m.hasMainDistinct() || m.hasMainUnion() {
+		if selectPos, fromPos := m.findMainSelectPosition(), m.findMainClausePosition("FROM"); selectPos != -1 && fromPos > selectPos {
+			texts = append(texts, strings.ToUpper(m.query[selectPos:fromPos]))
+		}
+	}
+
+	// A join is needed unless it is a redundant INNER JOIN that nothing references.
+	needed := make([]bool, len(joins))
+	for i, e := range joins {
+		kind := strings.ToUpper(strings.Fields(e.keyword)[0])
+		if kind != "JOIN" && kind != "INNER" || !e.followsForeignKey(fks, tables) || m.bindsPlaceholders(m.query[e.start:e.end]) {
+			needed[i] = true
+			continue
+		}
+		for _, text := range texts {
+			if referencesAny(text, e.idents) {
+				needed[i] = true
+				break
+			}
+		}
+	}
+
+	// Propagate: a join referenced by the ON clause of a needed join is needed.
+	for changed := true; changed; {
+		changed = false
+		for i := range joins {
+			if !needed[i] {
+				continue
+			}
+			for j, e := range joins {
+				if needed[j] || i == j {
+					continue
+				}
+				if referencesAny(joins[i].onUpper, e.idents) {
+					needed[j] = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	removedAliases := make(map[string]bool)
+	for i := len(joins) - 1; i >= 0; i-- {
+		if needed[i] {
+			continue
+		}
+		for _, id := range joins[i].idents {
+			removedAliases[id] = true
+		}
+		m.query = m.query[:joins[i].start] + m.query[joins[i].end:]
+	}
+	if len(removedAliases) == 0 {
+		return
+	}
+	m.query = strings.TrimSpace(m.query)
+	m.cleanSelectForRemovedAliases(removedAliases)
+}
+
+// referencesAny reports whether the uppercased text references any of idents
+// as a whole word.
+func referencesAny(textUpper string, idents []string) bool {
+	for _, id := range idents {
+		if regexp.MustCompile(`\b` + regexp.QuoteMeta(id) + `\b`).MatchString(textUpper) {
+			return true
+		}
+	}
+	return false
+}
+
+var onEqualityRe = regexp.MustCompile("^ON\\s+([\\w.`\"\\[\\]]+)\\s*=\\s*([\\w.`\"\\[\\]]+)$")
+
+// followsForeignKey reports whether the join condition is a single equality that
+// follows one of the NotNull fks into this join's table through its referenced
+// unique key. A nullable foreign key drops the rows whose column is NULL, so it
+// never qualifies.
+// tables maps each main-level alias (uppercase) to its table name (uppercase).
+func (e joinEntry) followsForeignKey(fks []ForeignKey, tables map[string]string) bool {
+	if e.tableName == "" {
+		return false
+	}
+
+	on := strings.TrimSpace(e.onUpper)
+	on = "ON " + strings.TrimSpace(strings.TrimPrefix(on, "ON"))
+	for strings.HasPrefix(on, "ON (") && strings.HasSuffix(on, ")") {
+		on = "ON " + strings.TrimSpace(on[4:len(on)-1])
+	}
+	match := onEqualityRe.FindStringSubmatch(on)
+	if match == nil {
+		return false
+	}
+
+	split := func(side string) (qualifier, column string) {
+		parts := strings.Split(side, ".")
+		if len(parts) < 2 {
+			return "", ""
+		}
+		unquote := func(s string) string { return strings.Trim(s, "`\"[]") }
+		return unquote(parts[len(parts)-2]), unquote(parts[len(parts)-1])
+	}
+
+	joinTable := strings.ToUpper(e.tableName)
+	joinAlias := strings.ToUpper(e.alias)
+	for _, sides := range [][2]string{{match[1], match[2]}, {match[2], match[1]}} {
+		refQualifier, refColumn := split(sides[0])
+		childQualifier, childColumn := split(sides[1])
+		if refQualifier != joinAlias || childQualifier == joinAlias {
+			continue
+		}
+		for _, fk := range fks {
+			if fk.NotNull &&
+				strings.ToUpper(fk.RefTable) == joinTable &&
+				strings.ToUpper(fk.RefColumn) == refColumn &&
+				tables[childQualifier] == strings.ToUpper(fk.Table) &&
+				strings.ToUpper(fk.Column) == childColumn {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mainTableAliases maps every main-level table alias (and table name) to its
+// table name, all uppercase, from the main FROM list and the given joins.
+func (m *SQLModifier) mainTableAliases(joins []joinEntry) map[string]string {
+	tables := make(map[string]string)
+
+	fromPos := m.findMainClausePosition("FROM")
+	if fromPos != -1 {
+		end := len(m.query)
+		if len(joins) > 0 {
+			end = joins[0].start
+		}
+		if p := m.nextClause("FROM", fromPos); p != -1 && p < end {
+			end = p
+		}
+		for _, item := range splitOnTopLevelComma(m.query[fromPos+4 : end]) {
+			words := strings.Fields(item)
+			if len(words) == 0 || strings.HasPrefix(words[0], "(") {
+				continue
+			}
+			table := strings.ToUpper(strings.Trim(words[0], "`\"[]"))
+			alias := strings.ToUpper(strings.Trim(words[len(words)-1], "`\"[]"))
+			tables[table] = table
+			tables[alias] = table
+		}
+	}
+
+	for _, e := range joins {
+		if e.tableName == "" {
+			continue
+		}
+		table := strings.ToUpper(e.tableName)
+		tables[table] = table
+		tables[strings.ToUpper(e.alias)] = table
+	}
+
+	return tables
+}
+
+// StripUnusedCTEs removes the CTEs of the leading WITH clause that are not
+// referenced by the main query or by another kept CTE, e.g. after the SELECT
+// list that used them was replaced by a count. The WITH keyword is dropped when
+// no CTE is left. The query is left unchanged when the WITH clause cannot be parsed.
+func (m *SQLModifier) StripUnusedCTEs() {
+	ctes, mainStart, recursive, ok := parseWithClause(m.query)
+	if !ok || len(ctes) == 0 {
+		return
+	}
+
+	refersTo := func(text, name string) bool {
+		return regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(name) + `\b`).MatchString(text)
+	}
+
+	keep := make([]bool, len(ctes))
+	for i, c := range ctes {
+		keep[i] = refersTo(m.query[mainStart:], c.name) || m.bindsPlaceholders(m.query[c.bodyStart:c.bodyEnd])
+	}
+	for changed := true; changed; {
+		changed = false
+		for j, user := range ctes {
+			if !keep[j] {
+				continue
+			}
+			for i, c := range ctes {
+				if !keep[i] && i != j && refersTo(m.query[user.bodyStart:user.bodyEnd], c.name) {
+					keep[i] = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	var defs []string
+	for i, c := range ctes {
+		if keep[i] {
+			defs = append(defs, m.query[c.start:c.end])
+		}
+	}
+	if len(defs) == len(ctes) {
+		return
+	}
+
+	mainQuery := strings.TrimSpace(m.query[mainStart:])
+	if len(defs) == 0 {
+		m.query = mainQuery
+		return
+	}
+	with := "WITH "
+	if recursive {
+		with = "WITH RECURSIVE "
+	}
+	m.query = with + strings.Join(defs, ", ") + " " + mainQuery
+}
+
+// cteDefinition is a single "name [(cols)] AS [[NOT] MATERIALIZED] (body)" entry
+// of a WITH clause.
+type cteDefinition struct {
+	name      string // unquoted CTE name
+	start     int    // position of the name
+	end       int    // position just past the body's closing parenthesis
+	bodyStart int    // position just past the body's opening parenthesis
+	bodyEnd   int    // position of the body's closing parenthesis
+}
+
+// parseWithClause parses the leading WITH clause of query. It returns the CTE
+// definitions, the position where the main query starts, and whether the clause
+// is WITH RECURSIVE. ok is false when query does not start with a WITH clause
+// that can be parsed.
+func parseWithClause(query string) (ctes []cteDefinition, mainStart int, recursive bool, ok bool) {
+	// the structure is read from the mask, where comments are blank and literals
+	// hold no parentheses; names are read from query
+	masked := lexer.Mask(query)
+	i := 0
+	skipSpace := func() {
+		for i < len(masked) && (masked[i] == ' ' || masked[i] == '\t' || masked[i] == '\n' || masked[i] == '\r') {
+			i++
+		}
+	}
+	isWordByte := func(c byte) bool {
+		return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z'
+	}
+	word := func() string {
+		start := i
+		for i < len(masked) && isWordByte(masked[i]) {
+			i++
+		}
+		return query[start:i]
+	}
+	peekWord := func() string {
+		saved := i
+		w := word()
+		i = saved
+		return strings.ToUpper(w)
+	}
+	// matchParen advances i past the parenthesis group starting at masked[i].
+	matchParen := func() bool {
+		depth := 0
+		for ; i < len(masked); i++ {
+			switch masked[i] {
+			case '(':
+				depth++
+			case ')':
+				depth--
+				if depth == 0 {
+					i++
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	skipSpace()
+	if peekWord() != "WITH" {
+		return nil, 0, false, false
+	}
+	word()
+	skipSpace()
+	if peekWord() == "RECURSIVE" {
+		recursive = true
+		word()
+	}
+
+	for {
+		skipSpace()
+		var c cteDefinition
+		c.start = i
+		if i < len(masked) && (masked[i] == '"' || masked[i] == '`') {
+			quote := masked[i]
+			end := strings.IndexByte(masked[i+1:], quote)
+			if end == -1 {
+				return nil, 0, false, false
+			}
+			c.name = query[i+1 : i+1+end]
+			i += end + 2
+		} else {
+			c.name = word()
+		}
+		if c.name == "" {
+			return nil, 0, false, false
+		}
+
+		skipSpace()
+		if i < len(masked) && masked[i] == '(' { // column list
+			if !matchParen() {
+				return nil, 0, false, false
+			}
+			skipSpace()
+		}
+		if peekWord() != "AS" {
+			return nil, 0, false, false
+		}
+		word()
+		skipSpace()
+		if peekWord() == "NOT" {
+			word()
+			skipSpace()
+		}
+		if peekWord() == "MATERIALIZED" {
+			word()
+			skipSpace()
+		}
+		if i >= len(masked) || masked[i] != '(' {
+			return nil, 0, false, false
+		}
+		c.bodyStart = i + 1
+		if !matchParen() {
+			return nil, 0, false, false
+		}
+		c.bodyEnd = i - 1
+		c.end = i
+		ctes = append(ctes, c)
+
+		skipSpace()
+		if i < len(masked) && masked[i] == ',' {
+			i++
+			continue
+		}
+		return ctes, i, recursive, true
+	}
+}
+
+// stripSelectSubqueries removes scalar subquery items ("(SELECT ...) [AS] alias")
+// from the main SELECT list. It is only safe for a grouped, non-DISTINCT query
+// being counted, where the SELECT list does not affect the number of groups.
+// Items whose alias is referenced by GROUP BY or HAVING are kept.
+func (m *SQLModifier) stripSelectSubqueries() {
+	selectPos := m.findMainSelectPosition()
+	fromPos := m.findMainClausePosition("FROM")
+	if selectPos == -1 || fromPos == -1 {
+		return
+	}
+
+	texts := m.mainFilterClauseTexts()
+	cols := splitOnTopLevelComma(strings.TrimSpace(m.query[selectPos+6 : fromPos]))
+
+	var kept []string
+	for _, col := range cols {
+		alias, isSubquery := scalarSubqueryAlias(col)
+		if !isSubquery || alias != "" && referencesAny(strings.Join(texts, " "), []string{strings.ToUpper(alias)}) || m.bindsPlaceholders(col) {
+			kept = append(kept, col)
+		}
+	}
+	if len(kept) == len(cols) {
+		return
+	}
+	if len(kept) == 0 {
+		kept = []string{"1"}
+	}
+
+	m.query = m.query[:selectPos] + "SELECT " + strings.Join(kept, ", ") + " " + m.query[fromPos:]
+}
+
+// bindsPlaceholders reports whether text contains a placeholder and the
+// modifier was told to keep such clauses, see SetKeepPlaceholders.
+func (m *SQLModifier) bindsPlaceholders(text string) bool {
+	if !m.keepBound {
+		return false
+	}
+	for _, t := range lexer.Tokenize(text) {
+		if t.Kind == lexer.Placeholder || t.Kind == lexer.Named {
+			return true
+		}
+	}
+	return false
+}
+
+// scalarSubqueryAlias reports whether the SELECT item is a parenthesized
+// subquery with an optional alias, and returns that alias.
+func scalarSubqueryAlias(item string) (alias string, ok bool) {
+	item = strings.TrimSpace(item)
+	if !strings.HasPrefix(item, "(") || !strings.HasPrefix(strings.ToUpper(strings.TrimSpace(item[1:])), "SELECT") {
+		return "", false
+	}
+
+	depth := 0
+	masked := lexer.Mask(item)
+	for i := 0; i < len(masked); i++ {
+		switch masked[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth != 0 {
+				continue
+			}
+			words := strings.Fields(item[i+1:])
+			switch {
+			case len(words) == 0:
+				return "", true
+			case len(words) == 1:
+				return strings.Trim(words[0], "`\"[]"), true
+			case len(words) == 2 && strings.EqualFold(words[0], "AS"):
+				return strings.Trim(words[1], "`\"[]"), true
+			}
+			return "", false
+		}
+	}
+	return "", false
+}
+
+var (
+	leftJoinRe   = regexp.MustCompile(`(?i)\bLEFT\s+(?:OUTER\s+)?JOIN\b`)
+	anyJoinRe    = regexp.MustCompile(`(?i)\b(?:(?:LEFT|RIGHT|FULL)\s+(?:OUTER\s+)?|INNER\s+|CROSS\s+)?JOIN\b`)
+	joinClauseRe = regexp.MustCompile(`(?i)\b(?:WHERE|GROUP\s+BY|HAVING|ORDER\s+BY|LIMIT|OFFSET|UNION(?:\s+ALL)?)\b`)
+	onKeywordRe  = regexp.MustCompile(`(?i)\bON\b`)
+)
+
+// joinEntry describes a main-level JOIN clause found by findMainJoins.
+type joinEntry struct {
+	start     int      // position of the first join keyword (e.g. "LEFT")
+	kwEnd     int      // end of the join keyword (e.g. "LEFT [OUTER] JOIN")
+	end       int      // end of the entire JOIN clause (ON condition inclusive)
+	keyword   string   // join keyword as written, e.g. "LEFT JOIN"
+	tableName string   // table name (e.g. "ticket" in "LEFT JOIN ticket t"); empty for subqueries
+	alias     string   // alias if present, otherwise same as tableName
+	idents    []string // all identifiers to check (uppercase): [alias] or [alias, tableName]
+	onStart   int      // position of the ON keyword
+	onUpper   string   // ON clause text (uppercase) for dependency analysis
+}
+
+// findMainJoins returns the main-level JOIN clauses whose keyword matches re and
+// that have an ON condition, in query order. Joins inside subqueries and CTE
+// bodies are ignored.
+func (m *SQLModifier) findMainJoins(re *regexp.Regexp) []joinEntry {
+	masked := m.masked()
+	allMatches := re.FindAllStringIndex(masked, -1)
+	mainSelectPos := m.findMainSelectPosition()
+
+	var entries []joinEntry
+	for _, match := range allMatches {
+		pos := match[0]
+		if mainSelectPos != -1 && pos < mainSelectPos {
+			continue
+		}
+		before := masked[:pos]
+		if strings.Count(before, "(") != strings.Count(before, ")") {
+			continue
+		}
+		entries = append(entries, joinEntry{start: pos, kwEnd: match[1], keyword: m.query[pos:match[1]]})
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// Find all main-level clause boundary positions to determine ON clause extents.
+	var boundaries []int
+	for _, re := range []*regexp.Regexp{anyJoinRe, joinClauseRe} {
+		for _, match := range re.FindAllStringIndex(masked, -1) {
+			pos := match[0]
+			if mainSelectPos != -1 && pos < mainSelectPos {
+				continue
+			}
+			before := masked[:pos]
+			if strings.Count(before, "(") == strings.Count(before, ")") {
+				boundaries = append(boundaries, pos)
+			}
+		}
+	}
+	sort.Ints(boundaries)
+
+	// For each JOIN, find its alias and ON clause extent.
+	var valid []joinEntry
+	for _, e := range entries {
+		// Find the ON keyword after this JOIN keyword.
+		onMatches := onKeywordRe.FindAllStringIndex(masked[e.kwEnd:], -1)
+		onAbsPos := -1
+		for _, om := range onMatches {
+			candidate := e.kwEnd + om[0]
+			before := masked[:candidate]
+			if strings.Count(before, "(") == strings.Count(before, ")") {
+				onAbsPos = candidate
+				break
+			}
+		}
+		if onAbsPos == -1 {
+			continue
+		}
+
+		// Extract table name and alias between JOIN keyword end and ON.
+		// Patterns: "table alias", "table AS alias", "table" (no alias),
+		//           "(subquery) alias", "(subquery) AS alias"
+		between := strings.TrimSpace(m.query[e.kwEnd:onAbsPos])
+		words := strings.Fields(between)
+		if len(words) == 0 {
+			continue
+		}
+
+		alias := strings.Trim(words[len(words)-1], "`\"[]")
+		tableName := strings.Trim(words[0], "`\"[]")
+
+		// For subqueries, the first word starts with "(" — skip table name tracking.
+		if strings.HasPrefix(words[0], "(") {
+			tableName = ""
+		}
+
+		// Build list of identifiers to match against clauses.
+		var idents []string
+		aliasUpper := strings.ToUpper(alias)
+		tableUpper := strings.ToUpper(tableName)
+		idents = append(idents, aliasUpper)
+		if tableUpper != "" && tableUpper != aliasUpper {
+			idents = append(idents, tableUpper)
+		}
+
+		// Find end of this JOIN clause: next boundary after onAbsPos
+		// that is not this JOIN's own start position.
+		clauseEnd := len(m.query)
+		for _, bp := range boundaries {
+			if bp > onAbsPos && bp != e.start {
+				clauseEnd = bp
+				break
+			}
+		}
+
+		e.end = clauseEnd
+		e.tableName = tableName
+		e.alias = alias
+		e.idents = idents
+		e.onStart = onAbsPos
+		e.onUpper = strings.ToUpper(m.query[onAbsPos:clauseEnd])
+		if e.alias != "" {
+			valid = append(valid, e)
+		}
+	}
+
+	return valid
+}
+
 // cleanSelectForRemovedAliases removes SELECT column expressions that reference
 // any of the given aliases. If all columns are removed, replaces with "1".
 func (m *SQLModifier) cleanSelectForRemovedAliases(removedAliases map[string]bool) {
@@ -878,8 +2104,9 @@ func splitOnTopLevelComma(s string) []string {
 	var result []string
 	depth := 0
 	start := 0
-	for i := 0; i < len(s); i++ {
-		switch s[i] {
+	masked := lexer.Mask(s)
+	for i := 0; i < len(masked); i++ {
+		switch masked[i] {
 		case '(':
 			depth++
 		case ')':
@@ -897,10 +2124,87 @@ func splitOnTopLevelComma(s string) []string {
 	return result
 }
 
-// Build returns the normalized SQL query
+// insertClause inserts clause at pos, the start of a clause or the end of the
+// query. The whitespace before pos stays in front of the following clause, or in
+// front of clause at the end of the query, so the layout of the query is kept. A
+// line comment ending before pos is closed by a newline so it does not comment out
+// the inserted clause.
+func (m *SQLModifier) insertClause(pos int, clause string) {
+	before := strings.TrimRightFunc(m.query[:pos], unicode.IsSpace)
+	gap := m.query[len(before):pos]
+	switch {
+	case pos == len(m.query) && gap != "":
+		m.query = before + gap + clause
+		return
+	case pos == len(m.query):
+		gap = ""
+	case gap == "":
+		gap = " "
+	}
+
+	m.query = separate(before) + clause + gap + m.query[pos:]
+}
+
+// replaceClause replaces the clause at m.query[start:end] with clause, keeping
+// the whitespace that separated it from the following clause.
+func (m *SQLModifier) replaceClause(start, end int, clause string) {
+	old := strings.TrimRightFunc(m.query[start:end], unicode.IsSpace)
+	gap := m.query[start+len(old) : end]
+	switch {
+	case end == len(m.query):
+		gap = ""
+	case gap == "":
+		gap = " "
+	}
+
+	m.query = m.query[:start] + clause + gap + m.query[end:]
+}
+
+// separate returns s followed by the separator for text appended to it: a space,
+// or a newline when s ends with a line comment. An empty s is returned as is.
+func separate(s string) string {
+	switch {
+	case s == "":
+		return s
+	case endsWithLineComment(s):
+		return s + "\n"
+	}
+	return s + " "
+}
+
+// endLine returns s followed by a newline when it ends with a line comment, so
+// that text appended to it is not commented out.
+func endLine(s string) string {
+	if endsWithLineComment(s) {
+		return s + "\n"
+	}
+	return s
+}
+
+// endsWithLineComment reports whether s ends with a "-- ..." comment.
+func endsWithLineComment(s string) bool {
+	if !strings.Contains(s, "--") {
+		return false
+	}
+	tokens := lexer.Tokenize(s)
+	last := tokens[len(tokens)-1]
+	return last.Kind == lexer.Comment && strings.HasPrefix(last.Text, "--")
+}
+
+// Build returns the SQL query. Whitespace is collapsed into single spaces, except
+// after line comments, unless SetPreserveFormatting is enabled.
 func (m *SQLModifier) Build() (string, error) {
 
-	q, err := normalizeSQL(m.query)
+	query := m.query
+	if m.limitSyntax == RowNum {
+		query = applyRowNum(query)
+	}
+
+	if m.preserve {
+		return strings.TrimSpace(query), nil
+	}
+
+	q, err := normalizeSQL(query)
 	if err != nil {
 		return "", err
 	}
@@ -908,38 +2212,25 @@ func (m *SQLModifier) Build() (string, error) {
 	return q, nil
 }
 
+// normalizeSQL collapses every run of whitespace outside literals, comments and
+// quoted identifiers into a single space. The whitespace after a line comment
+// becomes a newline, so the comment does not swallow the rest of the query.
 func normalizeSQL(query string) (string, error) {
-	// Define regular expressions to match quoted strings
-	quotedPatterns := []string{
-		`'([^']*)'`, // single quotes
-		`"([^"]*)"`, // double quotes
-		"`([^`]*)`", // backticks
-	}
-
-	// Temporary map to store quoted sections and their positions
-	quotedSections := make([]string, 0)
-
-	// Replace the quoted sections with placeholders
-	for _, pattern := range quotedPatterns {
-		re := regexp.MustCompile(pattern)
-		query = re.ReplaceAllStringFunc(query, func(matched string) string {
-			quotedSections = append(quotedSections, matched)
-			return fmt.Sprintf("<QUOTE%d>", len(quotedSections)-1)
-		})
-	}
-
-	// Now remove extra spaces, tabs, and newlines (outside the quoted sections)
-	re := regexp.MustCompile(`\s+`)
-	normalizedQuery := re.ReplaceAllString(query, " ")
-
-	// Restore the quoted sections back to their original places
-	for i, quoted := range quotedSections {
-		placeholder := fmt.Sprintf("<QUOTE%d>", i)
-		normalizedQuery = strings.ReplaceAll(normalizedQuery, placeholder, quoted)
+	var (
+		sb   strings.Builder
+		prev lexer.Token
+	)
+	for _, t := range lexer.Tokenize(query) {
+		switch {
+		case t.Kind == lexer.Space && prev.Kind == lexer.Comment && strings.HasPrefix(prev.Text, "--"):
+			sb.WriteByte('\n')
+		case t.Kind == lexer.Space:
+			sb.WriteByte(' ')
+		default:
+			sb.WriteString(t.Text)
+		}
+		prev = t
 	}
 
-	// Trim leading and trailing spaces
-	normalizedQuery = strings.TrimSpace(normalizedQuery)
-
-	return normalizedQuery, nil
+	return strings.TrimSpace(sb.String()), nil
 }
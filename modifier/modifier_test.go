@@ -1,6 +1,8 @@
 package modifier
 
 import (
+	"errors"
+	"fmt"
 	"strings"
 	"testing"
 )
@@ -48,6 +50,17 @@ func TestSQLModifier(t *testing.T) {
 			where: NewNestedCondition("AND", NewCondition("age = 20"), NewCondition("status = 'active'")),
 			out:   "SELECT * FROM table WHERE (id = 1 OR name = 'John') AND (age = 20 AND status = 'active')",
 		},
+		// LOWERCASE OPERATORS IN THE EXISTING WHERE CLAUSE
+		{
+			in:    "SELECT * FROM table WHERE id = 1 or name = 'John'",
+			where: NewCondition("age = 20"),
+			out:   "SELECT * FROM table WHERE (id = 1 or name = 'John') AND age = 20",
+		},
+		{
+			in:    "SELECT * FROM table WHERE name = 'John or Jane'",
+			where: NewCondition("age = 20"),
+			out:   "SELECT * FROM table WHERE name = 'John or Jane' AND age = 20",
+		},
 		// WITH ALIAS TABLE
 		{
 			in:      "SELECT * FROM table t WHERE t.id = 1",
@@ -327,6 +340,45 @@ func TestSQLModifier(t *testing.T) {
 			limit:   "10",
 			out:     "SELECT e.`id` FROM employees e WHERE `name` = 'John' ORDER BY e.`id` DESC LIMIT 10",
 		},
+		// KEYWORDS INSIDE LITERALS, COMMENTS AND QUOTED IDENTIFIERS
+		{
+			in:      "SELECT * FROM t WHERE note = 'it''s (ORDER BY x LIMIT 1'",
+			where:   NewCondition("id = 1"),
+			orderBy: []string{"id ASC"},
+			limit:   "10",
+			out:     "SELECT * FROM t WHERE note = 'it''s (ORDER BY x LIMIT 1' AND id = 1 ORDER BY id ASC LIMIT 10",
+		},
+		{
+			in:    `SELECT * FROM t WHERE note = E'\' OR (' AND x = 1`,
+			where: NewCondition("id = 1"),
+			limit: "10",
+			out:   `SELECT * FROM t WHERE (note = E'\' OR (' AND x = 1) AND id = 1 LIMIT 10`,
+		},
+		{
+			in:      "SELECT * FROM t WHERE body = $$ WHERE (a) LIMIT $$",
+			where:   NewCondition("id = 1"),
+			orderBy: []string{"id ASC"},
+			out:     "SELECT * FROM t WHERE body = $$ WHERE (a) LIMIT $$ AND id = 1 ORDER BY id ASC",
+		},
+		{
+			in:    "SELECT * FROM t /* WHERE x = 1) LIMIT 5 */ WHERE a = 1",
+			where: NewCondition("id = 1"),
+			limit: "10",
+			out:   "SELECT * FROM t /* WHERE x = 1) LIMIT 5 */ WHERE a = 1 AND id = 1 LIMIT 10",
+		},
+		{
+			in:      `SELECT "limit", [order by] FROM t`,
+			where:   NewCondition("id = 1"),
+			orderBy: []string{"id ASC"},
+			limit:   "10",
+			out:     `SELECT "limit", [order by] FROM t WHERE id = 1 ORDER BY id ASC LIMIT 10`,
+		},
+		{
+			in:      "SELECT * FROM t WHERE a = 1 ORDER\n  BY id",
+			where:   NewCondition("id > 1"),
+			orderBy: []string{"id DESC"},
+			out:     "SELECT * FROM t WHERE a = 1 AND id > 1 ORDER BY id DESC",
+		},
 	}
 
 	for _, tc := range testCases {
@@ -413,6 +465,12 @@ func TestFindCTEBodyBounds(t *testing.T) {
 			// wantBody is compared after normalizing whitespace
 			wantBody: "SELECT id FROM t JOIN (SELECT max_id FROM meta) m ON m.max_id = t.id WHERE t.status = 'active'",
 		},
+		{
+			name:     "parentheses and names inside literals and comments",
+			query:    "WITH /* foo AS (x) */ foo AS (SELECT id FROM t WHERE s = ')' /* ) */) SELECT * FROM foo",
+			cteName:  "foo",
+			wantBody: "SELECT id FROM t WHERE s = ')' /* ) */",
+		},
 		{
 			name:      "CTE not found",
 			query:     "WITH foo AS (SELECT id FROM t) SELECT * FROM foo",
@@ -563,3 +621,811 @@ func TestCTETargetNotFound(t *testing.T) {
 		t.Error("expected error when CTE not found, got nil")
 	}
 }
+
+func TestLimitSyntax(t *testing.T) {
+	testCases := []struct {
+		name   string
+		syntax LimitSyntax
+		query  string
+		limit  string
+		offset string
+		out    string
+	}{
+		{
+			name:   "offset fetch adds OFFSET 0 ROWS without an offset",
+			syntax: OffsetFetch,
+			query:  "SELECT id FROM t ORDER BY id",
+			limit:  "$0",
+			out:    "SELECT id FROM t ORDER BY id OFFSET 0 ROWS FETCH NEXT $0 ROWS ONLY",
+		},
+		{
+			name:   "offset fetch with offset",
+			syntax: OffsetFetch,
+			query:  "SELECT id FROM t ORDER BY id",
+			limit:  "10",
+			offset: "20",
+			out:    "SELECT id FROM t ORDER BY id OFFSET 20 ROWS FETCH NEXT 10 ROWS ONLY",
+		},
+		{
+			name:   "offset fetch replaces existing clauses",
+			syntax: OffsetFetch,
+			query:  "SELECT id FROM t ORDER BY id OFFSET 5 ROWS FETCH FIRST 3 ROWS ONLY",
+			limit:  "10",
+			offset: "20",
+			out:    "SELECT id FROM t ORDER BY id OFFSET 20 ROWS FETCH NEXT 10 ROWS ONLY",
+		},
+		{
+			name:   "offset fetch before locking clause",
+			syntax: OffsetFetch,
+			query:  "SELECT id FROM t ORDER BY id FOR UPDATE",
+			limit:  "10",
+			out:    "SELECT id FROM t ORDER BY id OFFSET 0 ROWS FETCH NEXT 10 ROWS ONLY FOR UPDATE",
+		},
+		{
+			name:   "top after select",
+			syntax: Top,
+			query:  "SELECT id FROM t WHERE (SELECT 1) = 1",
+			limit:  "10",
+			out:    "SELECT TOP (10) id FROM t WHERE (SELECT 1) = 1",
+		},
+		{
+			name:   "top after distinct replaces existing top",
+			syntax: Top,
+			query:  "SELECT DISTINCT TOP 5 id FROM t",
+			limit:  "10",
+			out:    "SELECT DISTINCT TOP (10) id FROM t",
+		},
+		{
+			name:   "top on main select after CTE",
+			syntax: Top,
+			query:  "WITH c AS (SELECT id FROM t) SELECT id FROM c",
+			limit:  "10",
+			out:    "WITH c AS (SELECT id FROM t) SELECT TOP (10) id FROM c",
+		},
+		{
+			name:   "fetch first without an offset",
+			syntax: FetchFirst,
+			query:  "SELECT id FROM t ORDER BY id",
+			limit:  "10",
+			out:    "SELECT id FROM t ORDER BY id FETCH FIRST 10 ROWS ONLY",
+		},
+		{
+			name:   "fetch first with offset",
+			syntax: FetchFirst,
+			query:  "SELECT id FROM t ORDER BY id",
+			limit:  "10",
+			offset: "20",
+			out:    "SELECT id FROM t ORDER BY id OFFSET 20 ROWS FETCH FIRST 10 ROWS ONLY",
+		},
+		{
+			name:   "rownum wraps the ordered query",
+			syntax: RowNum,
+			query:  "SELECT id FROM t WHERE x IN (SELECT y FROM u) ORDER BY id",
+			limit:  "10",
+			out:    "SELECT * FROM (SELECT id FROM t WHERE x IN (SELECT y FROM u) ORDER BY id) WHERE ROWNUM <= 10",
+		},
+		{
+			name:   "rownum with offset",
+			syntax: RowNum,
+			query:  "WITH c AS (SELECT id FROM t) SELECT id FROM c ORDER BY id",
+			limit:  "10",
+			offset: "20",
+			out:    "WITH c AS (SELECT id FROM t) SELECT id FROM (SELECT kuysor_rownum.*, ROWNUM kuysor_rn FROM (SELECT id FROM c ORDER BY id) kuysor_rownum WHERE ROWNUM <= 20 + 10) WHERE kuysor_rn > 20",
+		},
+		{
+			name:   "rownum with offset projects aliases and column names",
+			syntax: RowNum,
+			query:  "SELECT DISTINCT t.id, t.code AS c, UPPER(t.name) AS \"Name\" FROM t ORDER BY t.id",
+			limit:  "10",
+			offset: "20",
+			out:    "SELECT id, c, \"Name\" FROM (SELECT kuysor_rownum.*, ROWNUM kuysor_rn FROM (SELECT DISTINCT t.id, t.code AS c, UPPER(t.name) AS \"Name\" FROM t ORDER BY t.id) kuysor_rownum WHERE ROWNUM <= 20 + 10) WHERE kuysor_rn > 20",
+		},
+		{
+			name:   "rownum with offset keeps star when columns can't be named",
+			syntax: RowNum,
+			query:  "SELECT t.*, COUNT(*) OVER () FROM t ORDER BY t.id",
+			limit:  "10",
+			offset: "20",
+			out:    "SELECT * FROM (SELECT kuysor_rownum.*, ROWNUM kuysor_rn FROM (SELECT t.*, COUNT(*) OVER () FROM t ORDER BY t.id) kuysor_rownum WHERE ROWNUM <= 20 + 10) WHERE kuysor_rn > 20",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewSQLModifier(tc.query)
+			m.SetLimitSyntax(tc.syntax)
+			if err := m.SetLimit(tc.limit); err != nil {
+				t.Fatal(err)
+			}
+			if tc.offset != "" {
+				if err := m.SetOffset(tc.offset); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := m.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.out {
+				t.Errorf("expected %s, got %s", tc.out, got)
+			}
+		})
+	}
+}
+
+func TestLineComments(t *testing.T) {
+	testCases := []struct {
+		name     string
+		query    string
+		preserve bool
+		out      string
+	}{
+		{
+			name:  "compact keeps the newline after a line comment",
+			query: "SELECT id\nFROM t -- all rows\nWHERE a = 1",
+			out:   "SELECT id FROM t -- all rows\nWHERE a = 1 AND id > ? ORDER BY id DESC LIMIT ?",
+		},
+		{
+			name:  "clause appended after a trailing line comment",
+			query: "SELECT id FROM t -- all rows",
+			out:   "SELECT id FROM t -- all rows\nWHERE id > ? ORDER BY id DESC LIMIT ?",
+		},
+		{
+			name:  "condition appended after a commented condition",
+			query: "SELECT id FROM t WHERE a = 1 -- only a\n",
+			out:   "SELECT id FROM t WHERE a = 1 -- only a\nAND id > ? ORDER BY id DESC LIMIT ?",
+		},
+		{
+			name:     "preserve splices clauses into the original layout",
+			query:    "SELECT id\nFROM t -- all rows\n\nORDER BY id\nLIMIT 5",
+			preserve: true,
+			out:      "SELECT id\nFROM t -- all rows\nWHERE id > ?\n\nORDER BY id DESC\nLIMIT ?",
+		},
+		{
+			name:     "preserve inside a CTE body",
+			query:    "WITH c AS (\n    SELECT id\n    FROM t\n)\nSELECT id FROM c",
+			preserve: true,
+			out:      "WITH c AS (\n    SELECT id\n    FROM t WHERE id > ? ORDER BY id DESC LIMIT ?\n)\nSELECT id FROM c",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewSQLModifier(tc.query)
+			m.SetPreserveFormatting(tc.preserve)
+			if strings.HasPrefix(tc.query, "WITH") {
+				m.SetCTETarget("c")
+			}
+			if err := m.AppendWhere("id > ?"); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.SetOrderBy("id DESC"); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.SetLimit("?"); err != nil {
+				t.Fatal(err)
+			}
+			got, err := m.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.out {
+				t.Errorf("expected %q, got %q", tc.out, got)
+			}
+		})
+	}
+}
+
+func TestPretty(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{
+			name: "main clauses",
+			in:   "select a.id, count(*) from a left join b on b.id = a.id where a.x = 1 group by a.id order by a.id limit 10",
+			out:  "select a.id, count(*)\nfrom a\nleft join b on b.id = a.id\nwhere a.x = 1\ngroup by a.id\norder by a.id\nlimit 10",
+		},
+		{
+			name: "subqueries are indented",
+			in:   "WITH c AS (SELECT id FROM t WHERE x IN (SELECT y FROM u)) SELECT id FROM c",
+			out:  "WITH c AS (\n  SELECT id\n  FROM t\n  WHERE x IN (\n    SELECT y\n    FROM u\n  )\n)\nSELECT id\nFROM c",
+		},
+		{
+			name: "function calls and windows are not broken",
+			in:   "SELECT EXTRACT(YEAR FROM d), ROW_NUMBER() OVER (ORDER BY id) FROM t",
+			out:  "SELECT EXTRACT(YEAR FROM d), ROW_NUMBER() OVER (ORDER BY id)\nFROM t",
+		},
+		{
+			name: "literals and comments are kept",
+			in:   "SELECT 'from  x' FROM t -- where\n WHERE a = 1",
+			out:  "SELECT 'from  x'\nFROM t -- where\nWHERE a = 1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Pretty(tc.in)
+			if got != tc.out {
+				t.Errorf("expected %q, got %q", tc.out, got)
+			}
+		})
+	}
+}
+
+func TestClausePolicy(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy ClausePolicy
+		query  string
+		offset bool
+		out    string
+	}{
+		{
+			name:  "replace strips every row-limiting clause",
+			query: "SELECT id FROM t ORDER BY name LIMIT 5 OFFSET 10 FOR UPDATE",
+			out:   "SELECT id FROM t ORDER BY id ASC LIMIT ? FOR UPDATE",
+		},
+		{
+			name:   "replace with limit and offset",
+			query:  "SELECT id FROM t OFFSET 10 LIMIT 5",
+			offset: true,
+			out:    "SELECT id FROM t ORDER BY id ASC LIMIT ? OFFSET ?",
+		},
+		{
+			name:   "keep existing order by",
+			policy: KeepOrderBy,
+			query:  "SELECT id FROM t ORDER BY name DESC, id DESC NULLS LAST",
+			out:    "SELECT id FROM t ORDER BY id ASC, name DESC LIMIT ?",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewSQLModifier(tc.query)
+			m.SetClausePolicy(tc.policy)
+			if err := m.SetLimit("?"); err != nil {
+				t.Fatal(err)
+			}
+			if tc.offset {
+				if err := m.SetOffset("?"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := m.SetOrderBy("id ASC"); err != nil {
+				t.Fatal(err)
+			}
+			got, err := m.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.out {
+				t.Errorf("expected %s, got %s", tc.out, got)
+			}
+		})
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		m := NewSQLModifier("SELECT id FROM t ORDER BY name")
+		m.SetClausePolicy(RejectClause)
+		if err := m.SetLimit("?"); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.SetOrderBy("id ASC"); !errors.Is(err, ErrExistingClause) {
+			t.Errorf("expected ErrExistingClause, got %v", err)
+		}
+	})
+}
+
+func TestGrammar(t *testing.T) {
+	testCases := []struct {
+		name    string
+		grammar Grammar
+		syntax  LimitSyntax
+		query   string
+		out     string
+	}{
+		{
+			name:  "named window",
+			query: "SELECT id, RANK() OVER w FROM t WINDOW w AS (ORDER BY id)",
+			out:   "SELECT id, RANK() OVER w FROM t WHERE x > ? WINDOW w AS (ORDER BY id) ORDER BY id ASC LIMIT ?",
+		},
+		{
+			name:  "qualify",
+			query: "SELECT id FROM t QUALIFY ROW_NUMBER() OVER (PARTITION BY g ORDER BY id) = 1",
+			out:   "SELECT id FROM t WHERE x > ? QUALIFY ROW_NUMBER() OVER (PARTITION BY g ORDER BY id) = 1 ORDER BY id ASC LIMIT ?",
+		},
+		{
+			name:  "for no key update",
+			query: "SELECT id FROM t FOR NO KEY UPDATE",
+			out:   "SELECT id FROM t WHERE x > ? ORDER BY id ASC LIMIT ? FOR NO KEY UPDATE",
+		},
+		{
+			name:  "for update of skip locked",
+			query: "SELECT id FROM t WHERE a = 1 FOR UPDATE OF t SKIP LOCKED",
+			out:   "SELECT id FROM t WHERE a = 1 AND x > ? ORDER BY id ASC LIMIT ? FOR UPDATE OF t SKIP LOCKED",
+		},
+		{
+			name:  "into outfile",
+			query: "SELECT id FROM t INTO OUTFILE '/tmp/ids'",
+			out:   "SELECT id FROM t WHERE x > ? ORDER BY id ASC LIMIT ? INTO OUTFILE '/tmp/ids'",
+		},
+		{
+			name:  "into before from is not a boundary",
+			query: "INSERT INTO archive SELECT id FROM t",
+			out:   "INSERT INTO archive SELECT id FROM t WHERE x > ? ORDER BY id ASC LIMIT ?",
+		},
+		{
+			name:  "returning",
+			query: "DELETE FROM t RETURNING id",
+			out:   "DELETE FROM t WHERE x > ? ORDER BY id ASC LIMIT ? RETURNING id",
+		},
+		{
+			name:    "dialect grammar",
+			grammar: Grammar{{"WHERE"}, {"GROUP BY"}, {"HAVING"}, {"ORDER BY"}, {"OFFSET"}, {"FETCH"}, {"FOR XML", "FOR JSON"}, {"OPTION"}},
+			syntax:  OffsetFetch,
+			query:   "SELECT id FROM t FOR JSON PATH OPTION (RECOMPILE)",
+			out:     "SELECT id FROM t WHERE x > ? ORDER BY id ASC OFFSET 0 ROWS FETCH NEXT ? ROWS ONLY FOR JSON PATH OPTION (RECOMPILE)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewSQLModifier(tc.query)
+			m.SetGrammar(tc.grammar)
+			m.SetLimitSyntax(tc.syntax)
+			if err := m.AppendWhere("x > ?"); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.SetOrderBy("id ASC"); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.SetLimit("?"); err != nil {
+				t.Fatal(err)
+			}
+			got, err := m.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.out {
+				t.Errorf("expected %s, got %s", tc.out, got)
+			}
+		})
+	}
+}
+
+func TestSetLock(t *testing.T) {
+	testCases := []struct {
+		name      string
+		query     string
+		cteTarget string
+		out       string
+	}{
+		{
+			name:  "after order by and limit",
+			query: "SELECT id FROM job WHERE status = ?",
+			out:   "SELECT id FROM job WHERE status = ? ORDER BY id ASC LIMIT ? FOR UPDATE SKIP LOCKED",
+		},
+		{
+			name:  "before returning",
+			query: "DELETE FROM job RETURNING id",
+			out:   "DELETE FROM job ORDER BY id ASC LIMIT ? FOR UPDATE SKIP LOCKED RETURNING id",
+		},
+		{
+			name:      "inside the cte target",
+			query:     "WITH batch AS (SELECT id FROM job WHERE status = ?) UPDATE job SET status = ? FROM batch WHERE job.id = batch.id",
+			cteTarget: "batch",
+			out:       "WITH batch AS (SELECT id FROM job WHERE status = ? ORDER BY id ASC LIMIT ? FOR UPDATE SKIP LOCKED) UPDATE job SET status = ? FROM batch WHERE job.id = batch.id",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewSQLModifier(tc.query)
+			m.SetCTETarget(tc.cteTarget)
+			if err := m.SetOrderBy("id ASC"); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.SetLimit("?"); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.SetLock("FOR UPDATE SKIP LOCKED"); err != nil {
+				t.Fatal(err)
+			}
+			got, err := m.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.out {
+				t.Errorf("expected %s, got %s", tc.out, got)
+			}
+		})
+	}
+
+	t.Run("existing lock", func(t *testing.T) {
+		m := NewSQLModifier("SELECT id FROM job FOR SHARE")
+		if err := m.SetLock("FOR UPDATE"); err == nil {
+			t.Error("expected an error for a query that already locks rows")
+		}
+	})
+}
+
+func TestMainUnion(t *testing.T) {
+	t.Run("wrap", func(t *testing.T) {
+		testCases := []struct {
+			query string
+			out   string
+		}{
+			{
+				query: "SELECT id FROM a UNION ALL SELECT id FROM b",
+				out:   "SELECT * FROM ( SELECT id FROM a UNION ALL SELECT id FROM b ) kuysor_union WHERE id > ? ORDER BY id ASC LIMIT ?",
+			},
+			{
+				query: "WITH c AS (SELECT id FROM a UNION SELECT id FROM b) SELECT id FROM c UNION SELECT id FROM d ORDER BY id LIMIT 5",
+				out:   "WITH c AS (SELECT id FROM a UNION SELECT id FROM b) SELECT * FROM ( SELECT id FROM c UNION SELECT id FROM d ) kuysor_union WHERE id > ? ORDER BY id ASC LIMIT ?",
+			},
+		}
+
+		for _, tc := range testCases {
+			m := NewSQLModifier(tc.query)
+			if !m.WrapMainUnion() {
+				t.Fatalf("%s: expected the union to be wrapped", tc.query)
+			}
+			if err := m.AppendWhere("id > ?"); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.SetOrderBy("id ASC"); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.SetLimit("?"); err != nil {
+				t.Fatal(err)
+			}
+			got, err := m.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.out {
+				t.Errorf("expected %s, got %s", tc.out, got)
+			}
+		}
+
+		if NewSQLModifier("WITH c AS (SELECT 1 UNION SELECT 2) SELECT * FROM c").WrapMainUnion() {
+			t.Error("expected a union inside a CTE not to be wrapped")
+		}
+	})
+
+	t.Run("branches", func(t *testing.T) {
+		m := NewSQLModifier("SELECT a.id FROM a UNION ALL (SELECT b.id FROM b LIMIT 3) UNION ALL SELECT c.id FROM c")
+		err := m.EachUnionBranch(func(i int, branch *SQLModifier) error {
+			if err := branch.AppendWhere(fmt.Sprintf("x%d > ?", i)); err != nil {
+				return err
+			}
+			return branch.SetLimit("?")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := m.Build()
+		out := "SELECT * FROM ( SELECT a.id FROM a WHERE x0 > ? LIMIT ? ) kuysor_union_1 UNION ALL (SELECT b.id FROM b LIMIT 3) UNION ALL SELECT * FROM ( SELECT c.id FROM c WHERE x2 > ? LIMIT ? ) kuysor_union_3"
+		if got != out {
+			t.Errorf("expected %s, got %s", out, got)
+		}
+
+		err = NewSQLModifier("SELECT id FROM a UNION SELECT id FROM b EXCEPT SELECT id FROM c").EachUnionBranch(func(int, *SQLModifier) error { return nil })
+		if err == nil {
+			t.Error("expected an error for a union combined with EXCEPT")
+		}
+	})
+
+	t.Run("columns", func(t *testing.T) {
+		testCases := []struct {
+			query    string
+			column   string
+			output   string
+			branches []string
+			err      bool
+		}{
+			{query: "SELECT a.id, a.name FROM a UNION SELECT b.id, b.title FROM b", column: "a.name", output: "name", branches: []string{"a.name", "b.title"}},
+			{query: "SELECT a.created AS ts FROM a UNION SELECT b.at FROM b", column: "ts", output: "ts", branches: []string{"a.created", "b.at"}},
+			{query: "SELECT a.created ts FROM a UNION SELECT b.at FROM b", column: "a.created", output: "ts", branches: []string{"a.created", "b.at"}},
+			{query: "SELECT * FROM a UNION SELECT * FROM b", column: "t.id", output: "id", branches: []string{"id", "id"}},
+			{query: "SELECT DISTINCT COUNT(*) AS n FROM a UNION SELECT 1 FROM b", column: "n", output: "n", branches: []string{"COUNT(*)", "1"}},
+			{query: "SELECT COUNT(*) FROM a UNION SELECT 1 FROM b", column: "n", err: true},
+			{query: "SELECT a.id, a.name FROM a UNION SELECT b.id FROM b", column: "a.name", err: true},
+		}
+
+		for _, tc := range testCases {
+			output, branches, err := NewSQLModifier(tc.query).UnionColumns(tc.column)
+			if tc.err {
+				if err == nil {
+					t.Errorf("%s: expected an error", tc.query)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tc.query, err)
+			}
+			if output[tc.column] != tc.output {
+				t.Errorf("%s: expected output %s, got %s", tc.query, tc.output, output[tc.column])
+			}
+			for i, branch := range branches {
+				if branch[tc.column] != tc.branches[i] {
+					t.Errorf("%s: expected branch %d to select %s, got %s", tc.query, i+1, tc.branches[i], branch[tc.column])
+				}
+			}
+		}
+	})
+}
+
+func TestSubqueryTarget(t *testing.T) {
+	testCases := []struct {
+		name  string
+		query string
+		alias string
+		out   string
+		err   bool
+	}{
+		{
+			name:  "derived table with as",
+			query: "SELECT t.* FROM (SELECT id FROM ticket WHERE status IN (1, 2)) AS p JOIN ticket t ON t.id = p.id",
+			alias: "p",
+			out:   "SELECT t.* FROM (SELECT id FROM ticket WHERE status IN (1, 2) AND id > ? ORDER BY id ASC LIMIT ?) AS p JOIN ticket t ON t.id = p.id",
+		},
+		{
+			name:  "joined derived table after a cte",
+			query: "WITH a AS (SELECT id FROM (SELECT 1 AS id) p) SELECT * FROM a JOIN (SELECT id FROM b) p ON p.id = a.id",
+			alias: "p",
+			out:   "WITH a AS (SELECT id FROM (SELECT 1 AS id) p) SELECT * FROM a JOIN (SELECT id FROM b WHERE id > ? ORDER BY id ASC LIMIT ?) p ON p.id = a.id",
+		},
+		{
+			name:  "union derived table",
+			query: "SELECT * FROM (SELECT id FROM a UNION SELECT id FROM b) p",
+			alias: "p",
+			out:   "SELECT * FROM (SELECT * FROM ( SELECT id FROM a UNION SELECT id FROM b ) kuysor_cte_union WHERE id > ? ORDER BY id ASC LIMIT ?) p",
+		},
+		{
+			name:  "scalar subquery aliased the same before from",
+			query: "SELECT (SELECT MAX(id) FROM c) p, t.* FROM (SELECT id FROM ticket) p JOIN ticket t ON t.id = p.id",
+			alias: "p",
+			out:   "SELECT (SELECT MAX(id) FROM c) p, t.* FROM (SELECT id FROM ticket WHERE id > ? ORDER BY id ASC LIMIT ?) p JOIN ticket t ON t.id = p.id",
+		},
+		{
+			name:  "table function",
+			query: "SELECT * FROM t CROSS JOIN unnest(t.tags) p",
+			alias: "p",
+			err:   true,
+		},
+		{
+			name:  "nested derived table",
+			query: "SELECT * FROM (SELECT * FROM (SELECT id FROM a) p) q",
+			alias: "p",
+			err:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewSQLModifier(tc.query)
+			m.SetSubqueryTarget(tc.alias)
+			err := m.AppendWhere("id > ?")
+			if tc.err {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.SetOrderBy("id ASC"); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.SetLimit("?"); err != nil {
+				t.Fatal(err)
+			}
+			got, err := m.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.out {
+				t.Errorf("expected %s, got %s", tc.out, got)
+			}
+		})
+	}
+}
+
+func TestInferColumnMap(t *testing.T) {
+	const main = " SELECT t.* FROM p JOIN ticket t ON t.id = p.id"
+
+	testCases := []struct {
+		name      string
+		body      string
+		columns   []string
+		out       map[string]string
+		ambiguous bool
+		err       bool
+	}{
+		{
+			name:    "selected as is",
+			body:    "SELECT id, created_at FROM ticket",
+			columns: []string{"id", "created_at"},
+			out:     map[string]string{"id": "id", "created_at": "created_at"},
+		},
+		{
+			name:    "qualified in the main query",
+			body:    "SELECT tk.id, tk.created_at AS ts FROM ticket tk",
+			columns: []string{"t.id", "p.ts"},
+			out:     map[string]string{"t.id": "tk.id", "p.ts": "tk.created_at"},
+		},
+		{
+			name:    "qualifier of the body",
+			body:    "SELECT tk.* FROM ticket tk JOIN team m ON m.id = tk.team_id",
+			columns: []string{"tk.id"},
+			out:     map[string]string{"tk.id": "tk.id"},
+		},
+		{
+			name:    "star over a single table",
+			body:    "SELECT * FROM ticket WHERE status = ?",
+			columns: []string{"t.id"},
+			out:     map[string]string{"t.id": "id"},
+		},
+		{
+			name:    "qualified star",
+			body:    "SELECT tk.*, m.name FROM ticket tk JOIN team m ON m.id = tk.team_id",
+			columns: []string{"t.id"},
+			out:     map[string]string{"t.id": "tk.id"},
+		},
+		{
+			name:    "union body",
+			body:    "SELECT id AS ticket_id FROM ticket UNION SELECT ticket_id FROM archive",
+			columns: []string{"t.ticket_id"},
+			out:     map[string]string{"t.ticket_id": "ticket_id"},
+		},
+		{
+			name:      "same name twice",
+			body:      "SELECT tk.id, m.id FROM ticket tk JOIN team m ON m.id = tk.team_id",
+			columns:   []string{"t.id"},
+			ambiguous: true,
+		},
+		{
+			name:      "star over several tables",
+			body:      "SELECT * FROM ticket tk JOIN team m ON m.id = tk.team_id",
+			columns:   []string{"t.id"},
+			ambiguous: true,
+		},
+		{
+			name:      "several qualified stars",
+			body:      "SELECT tk.*, m.* FROM ticket tk JOIN team m ON m.id = tk.team_id",
+			columns:   []string{"t.id"},
+			ambiguous: true,
+		},
+		{
+			name:    "not selected",
+			body:    "SELECT id FROM ticket",
+			columns: []string{"t.created_at"},
+			err:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewSQLModifier("WITH p AS (" + tc.body + ")" + main)
+			m.SetCTETarget("p")
+			got, err := m.InferColumnMap(tc.columns...)
+			if tc.ambiguous || tc.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if errors.Is(err, ErrAmbiguousColumn) != tc.ambiguous {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.out) {
+				t.Errorf("expected %v, got %v", tc.out, got)
+			}
+		})
+	}
+
+	t.Run("derived table", func(t *testing.T) {
+		m := NewSQLModifier("SELECT t.* FROM (SELECT tk.id FROM ticket tk) p JOIN ticket t ON t.id = p.id")
+		m.SetSubqueryTarget("p")
+		got, err := m.InferColumnMap("t.id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got["t.id"] != "tk.id" {
+			t.Errorf("expected tk.id, got %v", got)
+		}
+	})
+}
+
+func TestAppendHaving(t *testing.T) {
+	testCases := []struct {
+		name   string
+		query  string
+		target string
+		out    string
+	}{
+		{
+			name:  "no having",
+			query: "SELECT a, COUNT(*) AS n FROM t WHERE b = 1 GROUP BY a ORDER BY a",
+			out:   "SELECT a, COUNT(*) AS n FROM t WHERE b = 1 GROUP BY a HAVING COUNT(*) > ? ORDER BY a",
+		},
+		{
+			name:  "existing having",
+			query: "SELECT a, COUNT(*) AS n FROM t GROUP BY a HAVING COUNT(*) > 1 OR MAX(b) = 0 LIMIT 5",
+			out:   "SELECT a, COUNT(*) AS n FROM t GROUP BY a HAVING (COUNT(*) > 1 OR MAX(b) = 0) AND COUNT(*) > ? LIMIT 5",
+		},
+		{
+			name:   "cte target",
+			query:  "WITH c AS (SELECT a, COUNT(*) AS n FROM t GROUP BY a) SELECT * FROM c WHERE n > 0",
+			target: "c",
+			out:    "WITH c AS (SELECT a, COUNT(*) AS n FROM t GROUP BY a HAVING COUNT(*) > ?) SELECT * FROM c WHERE n > 0",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewSQLModifier(tc.query)
+			m.SetCTETarget(tc.target)
+			if grouped, err := m.HasGroupBy(); err != nil || !grouped {
+				t.Fatalf("expected a GROUP BY, got %v, %v", grouped, err)
+			}
+			if err := m.AppendHaving("COUNT(*) > ?"); err != nil {
+				t.Fatal(err)
+			}
+			got, err := m.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.out {
+				t.Errorf("expected %s, got %s", tc.out, got)
+			}
+		})
+	}
+}
+
+func TestWrapMain(t *testing.T) {
+	testCases := []struct {
+		name  string
+		query string
+		out   string
+	}{
+		{
+			name:  "tail clauses stay outside",
+			query: "SELECT id, RANK() OVER (ORDER BY score) AS r FROM t WHERE a = ? ORDER BY id LIMIT 5",
+			out:   "SELECT * FROM ( SELECT id, RANK() OVER (ORDER BY score) AS r FROM t WHERE a = ? ) kuysor_main ORDER BY id LIMIT 5",
+		},
+		{
+			name:  "with clause",
+			query: "WITH s AS (SELECT * FROM t) SELECT id FROM s",
+			out:   "WITH s AS (SELECT * FROM t) SELECT * FROM ( SELECT id FROM s ) kuysor_main",
+		},
+		{
+			name:  "union",
+			query: "SELECT id FROM a UNION SELECT id FROM b",
+			out:   "SELECT * FROM ( SELECT id FROM a UNION SELECT id FROM b ) kuysor_union",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewSQLModifier(tc.query)
+			if !m.WrapMain() {
+				t.Fatal("expected the query to be wrapped")
+			}
+			got, err := m.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.out {
+				t.Errorf("expected %s, got %s", tc.out, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package modifier
+
+import (
+	"strings"
+
+	"github.com/redhajuanda/kuysor/internal/lexer"
+)
+
+// prettyIndent is the indentation of one subquery level in Pretty.
+const prettyIndent = "  "
+
+// Pretty formats query for reading: whitespace is collapsed, every main clause of
+// a statement starts on its own line, and subqueries are indented with their
+// closing parenthesis on its own line. Literals, comments and quoted identifiers
+// are kept as is, and expressions inside function calls or lists are not broken.
+func Pretty(query string) string {
+
+	var (
+		tokens      = lexer.Tokenize(strings.TrimSpace(query))
+		sb          strings.Builder
+		stack       []bool // one entry per open parenthesis, true for a subquery
+		level       int    // number of open subqueries
+		space       bool   // whitespace was skipped before the current token
+		lineComment bool   // the previous token is a line comment
+		prevWord    string
+	)
+
+	newline := func() {
+		if sb.Len() > 0 {
+			sb.WriteString("\n" + strings.Repeat(prettyIndent, level))
+		}
+		space, lineComment = false, false
+	}
+	writeSpace := func() {
+		switch {
+		case lineComment:
+			newline()
+		case space && sb.Len() > 0:
+			sb.WriteByte(' ')
+		}
+		space = false
+	}
+
+	for i, t := range tokens {
+
+		if t.Kind == lexer.Space {
+			space = true
+			continue
+		}
+
+		statement := len(stack) == 0 || stack[len(stack)-1]
+		word := strings.ToUpper(t.Text)
+
+		switch {
+		case t.Text == "(":
+			writeSpace()
+			sub := nextWord(tokens, i)
+			stack = append(stack, sub == "SELECT" || sub == "WITH")
+			if stack[len(stack)-1] {
+				level++
+			}
+			sb.WriteString(t.Text)
+
+		case t.Text == ")" && len(stack) > 0:
+			if stack[len(stack)-1] {
+				level--
+				newline()
+			} else {
+				writeSpace()
+			}
+			stack = stack[:len(stack)-1]
+			sb.WriteString(t.Text)
+
+		case t.Kind == lexer.Word && statement && startsClause(prevWord, word, nextWord(tokens, i)):
+			newline()
+			sb.WriteString(t.Text)
+
+		default:
+			writeSpace()
+			sb.WriteString(t.Text)
+		}
+
+		lineComment = t.Kind == lexer.Comment && strings.HasPrefix(t.Text, "--")
+		if t.Kind != lexer.Comment {
+			prevWord = word
+		}
+	}
+
+	return sb.String()
+
+}
+
+// startsClause reports whether word, between the words prev and next, starts a
+// main clause of a statement.
+func startsClause(prev, word, next string) bool {
+	switch word {
+	case "SELECT", "WHERE", "HAVING", "LIMIT", "OFFSET", "FETCH", "UNION", "EXCEPT",
+		"INTERSECT", "WINDOW", "QUALIFY", "RETURNING", "NATURAL":
+		return true
+	case "FROM":
+		return prev != "DISTINCT"
+	case "WITH":
+		return prev == "" || prev == "("
+	case "GROUP", "ORDER":
+		return next == "BY"
+	case "JOIN":
+		switch prev {
+		case "LEFT", "RIGHT", "FULL", "INNER", "CROSS", "OUTER", "NATURAL":
+			return false
+		}
+		return true
+	case "LEFT", "RIGHT", "FULL":
+		return next == "JOIN" || next == "OUTER"
+	case "INNER", "CROSS":
+		return next == "JOIN" || next == "APPLY"
+	case "FOR":
+		return next == "UPDATE" || next == "SHARE" || next == "NO" || next == "KEY"
+	}
+	return false
+}
+
+// nextWord returns the uppercased text of the token after tokens[i], skipping
+// whitespace and comments.
+func nextWord(tokens []lexer.Token, i int) string {
+	for _, t := range tokens[i+1:] {
+		if t.Kind != lexer.Space && t.Kind != lexer.Comment {
+			return strings.ToUpper(t.Text)
+		}
+	}
+	return ""
+}
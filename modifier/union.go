@@ -0,0 +1,395 @@
+package modifier
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/redhajuanda/kuysor/internal/lexer"
+)
+
+const (
+	// unionWrapAlias is the derived-table alias of a main-level UNION wrapped by
+	// WrapMainUnion.
+	unionWrapAlias = "kuysor_union"
+	// unionBranchAlias prefixes the derived-table aliases of the branches wrapped by
+	// EachUnionBranch, e.g. "kuysor_union_1".
+	unionBranchAlias = "kuysor_union_"
+	// mainWrapAlias is the derived-table alias of a main query wrapped by WrapMain.
+	mainWrapAlias = "kuysor_main"
+)
+
+var (
+	unionRe       = regexp.MustCompile(`\bUNION(?:\s+(?:ALL|DISTINCT)\b)?`)
+	setOperatorRe = regexp.MustCompile(`\b(?:INTERSECT|EXCEPT|MINUS)\b`)
+	selectQuantRe = regexp.MustCompile(`(?i)^(?:DISTINCT|ALL)\s+`)
+	// unionTailClauses are the clauses after the last branch of a UNION that
+	// apply to the whole union.
+	unionTailClauses = append([]string{"ORDER BY"}, rowLimitingClauses...)
+)
+
+// HasMainUnion reports whether the main query is a UNION or UNION ALL.
+func (m *SQLModifier) HasMainUnion() bool {
+	_, _, ok := m.mainUnion()
+	return ok
+}
+
+// mainUnion returns the bounds of the branches of a main-level UNION, in query
+// order, and the start of the ORDER BY and row-limiting clauses that follow the
+// last branch, which apply to the whole union (len(m.query) when there are none).
+// ok is false when the main query is not a UNION.
+func (m *SQLModifier) mainUnion() (branches [][2]int, tail int, ok bool) {
+	masked := m.masked()
+
+	start := 0
+	if strings.HasPrefix(masked, "WITH") {
+		if start = m.findMainSelectPosition(); start == -1 {
+			return nil, 0, false
+		}
+	}
+
+	for _, match := range unionRe.FindAllStringIndex(masked, -1) {
+		before := masked[:match[0]]
+		if match[0] < start || strings.Count(before, "(") != strings.Count(before, ")") {
+			continue
+		}
+		branches = append(branches, [2]int{start, match[0]})
+		start = match[1]
+	}
+	if len(branches) == 0 {
+		return nil, 0, false
+	}
+
+	tail = len(m.query)
+	for _, clause := range unionTailClauses {
+		if pos := m.findMainClauseAfter(clause, start); pos != -1 && pos < tail {
+			tail = pos
+		}
+	}
+	return append(branches, [2]int{start, tail}), tail, true
+}
+
+// WrapMainUnion wraps a main-level UNION in a derived table,
+// "SELECT * FROM (...) kuysor_union", so that the clauses set afterwards apply to
+// the union result instead of one of its branches. The ORDER BY and row-limiting
+// clauses after the last branch apply to the whole union and stay outside the
+// derived table, and a leading WITH clause stays at the statement level. It
+// reports whether the query was wrapped.
+func (m *SQLModifier) WrapMainUnion() bool {
+	branches, tail, ok := m.mainUnion()
+	if !ok {
+		return false
+	}
+
+	m.wrap(branches[0][0], tail, unionWrapAlias)
+	return true
+}
+
+// WrapMain wraps the main query in a derived table, "SELECT * FROM (...)
+// kuysor_main", so that the clauses set afterwards can reference the columns it
+// outputs by their aliases, e.g. to filter on a window function. As in
+// WrapMainUnion, its ORDER BY and row-limiting clauses stay outside the derived
+// table, and a leading WITH clause stays at the statement level. A UNION is
+// wrapped as by WrapMainUnion. It reports whether the query was wrapped.
+func (m *SQLModifier) WrapMain() bool {
+	if m.HasMainUnion() {
+		return m.WrapMainUnion()
+	}
+
+	start := m.findMainSelectPosition()
+	if start == -1 {
+		return false
+	}
+	tail := len(m.query)
+	for _, clause := range unionTailClauses {
+		if pos := m.findMainClauseAfter(clause, start); pos != -1 && pos < tail {
+			tail = pos
+		}
+	}
+	m.wrap(start, tail, mainWrapAlias)
+	return true
+}
+
+// wrap wraps m.query[start:tail] in a derived table named alias.
+func (m *SQLModifier) wrap(start, tail int, alias string) {
+	inner := strings.TrimSpace(m.query[start:tail])
+	wrapped := "SELECT * FROM ( " + endLine(inner) + " ) " + alias
+	if tail < len(m.query) {
+		wrapped += " "
+	}
+	m.query = m.query[:start] + wrapped + m.query[tail:]
+}
+
+// EachUnionBranch calls fn with a modifier of every branch of a main-level UNION,
+// in query order, and splices the modified branches back. As a branch cannot have
+// its own ORDER BY or row-limiting clause, a branch given one is wrapped in a
+// derived table, e.g. "SELECT * FROM (...) kuysor_union_1". A parenthesized branch
+// that already has one is left as is. A union combined with
+// INTERSECT or EXCEPT returns an error, as its branches cannot be changed
+// independently. Call it before WrapMainUnion.
+func (m *SQLModifier) EachUnionBranch(fn func(i int, branch *SQLModifier) error) error {
+	branches, _, ok := m.mainUnion()
+	if !ok {
+		return fmt.Errorf("query is not a UNION")
+	}
+	if m.hasMainSetOperator() {
+		return fmt.Errorf("cannot change the branches of a UNION combined with INTERSECT or EXCEPT")
+	}
+
+	rendered := make([]string, len(branches))
+	for i, bounds := range branches {
+		sub := &SQLModifier{
+			query:       unparenthesize(strings.TrimSpace(m.query[bounds[0]:bounds[1]])),
+			limitSyntax: m.limitSyntax,
+			preserve:    m.preserve,
+			policy:      m.policy,
+			grammar:     m.grammar,
+		}
+		if sub.hasOrderOrLimit() {
+			continue
+		}
+		if err := fn(i, sub); err != nil {
+			return err
+		}
+
+		rendered[i] = sub.query
+		if sub.hasOrderOrLimit() {
+			rendered[i] = fmt.Sprintf("SELECT * FROM ( %s ) %s%d", endLine(sub.query), unionBranchAlias, i+1)
+		}
+	}
+
+	// splice from the last branch so the positions of the others stay valid
+	for i := len(branches) - 1; i >= 0; i-- {
+		if rendered[i] == "" {
+			continue
+		}
+		start, end := branches[i][0], branches[i][1]
+		branch := strings.TrimSpace(m.query[start:end])
+		lead := strings.Index(m.query[start:end], branch)
+		end = start + lead + len(branch)
+		start += lead
+		m.query = m.query[:start] + endLine(rendered[i]) + m.query[end:]
+	}
+	return nil
+}
+
+// hasMainSetOperator reports whether the main query has an INTERSECT, EXCEPT or
+// MINUS operator.
+func (m *SQLModifier) hasMainSetOperator() bool {
+	masked := m.masked()
+	for _, match := range setOperatorRe.FindAllStringIndex(masked, -1) {
+		before := masked[:match[0]]
+		if strings.Count(before, "(") == strings.Count(before, ")") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasOrderOrLimit reports whether the statement has a main-level ORDER BY, a
+// row-limiting clause or a TOP limit.
+func (m *SQLModifier) hasOrderOrLimit() bool {
+	for _, clause := range unionTailClauses {
+		if m.findMainClausePosition(clause) != -1 {
+			return true
+		}
+	}
+	pos := m.findMainSelectPosition()
+	return pos != -1 && strings.HasPrefix(strings.TrimSpace(m.masked()[pos+6:]), "TOP")
+}
+
+// UnionColumns maps each of columns, sort columns as written in the query, to the
+// name of the column of the main-level UNION result that selects it (output), and
+// to the expression selecting it in each branch (branches). A column is looked up
+// in the SELECT list of the first branch, by expression or by name: "a.created_at"
+// in "SELECT a.created_at AS ts ..." is output as "ts", and selected by the item at
+// the same position in the other branches. A column that is not listed is output
+// unqualified when the branch selects "*", and is an error otherwise.
+func (m *SQLModifier) UnionColumns(columns ...string) (output map[string]string, branches []map[string]string, err error) {
+	bounds, _, ok := m.mainUnion()
+	if !ok {
+		return nil, nil, fmt.Errorf("query is not a UNION")
+	}
+
+	lists := make([][]selectItem, len(bounds))
+	for i, b := range bounds {
+		lists[i] = selectList(unparenthesize(strings.TrimSpace(m.query[b[0]:b[1]])))
+	}
+
+	output = make(map[string]string, len(columns))
+	branches = make([]map[string]string, len(bounds))
+	for i := range branches {
+		branches[i] = make(map[string]string, len(columns))
+	}
+
+	for _, column := range columns {
+		pos := findSelectItem(lists[0], column)
+		switch {
+		case pos != -1 && lists[0][pos].name != "":
+			output[column] = lists[0][pos].name
+		case pos == -1 && hasStarItem(lists[0]):
+			output[column] = unqualified(column)
+		default:
+			return nil, nil, fmt.Errorf("sort column %s is not a named column of the UNION", column)
+		}
+
+		for i, list := range lists {
+			switch {
+			case hasStarItem(list):
+				branches[i][column] = output[column]
+			case pos != -1 && pos < len(list):
+				branches[i][column] = list[pos].expr
+			default:
+				return nil, nil, fmt.Errorf("sort column %s is not selected by UNION branch %d", column, i+1)
+			}
+		}
+	}
+	return output, branches, nil
+}
+
+// selectItem is an item of a SELECT list: its expression, and the name of the
+// column it outputs, as written, or "" when the expression is unnamed.
+type selectItem struct {
+	expr string
+	name string
+}
+
+// selectList returns the items of the main SELECT list of query.
+func selectList(query string) []selectItem {
+	sub := &SQLModifier{query: query}
+	selectPos := sub.findMainSelectPosition()
+	if selectPos == -1 {
+		return nil
+	}
+	end := sub.findMainClausePosition("FROM")
+	if end == -1 {
+		end = len(query)
+	}
+
+	list := selectQuantRe.ReplaceAllString(strings.TrimSpace(query[selectPos+6:end]), "")
+
+	var items []selectItem
+	for _, item := range splitOnTopLevelComma(list) {
+		items = append(items, parseSelectItem(item))
+	}
+	return items
+}
+
+// parseSelectItem splits a SELECT item into its expression and output name: the
+// alias after AS, the alias after a column reference, or the column name of a
+// column reference.
+func parseSelectItem(item string) selectItem {
+	var (
+		tokens []lexer.Token
+		depth  int
+	)
+	for _, t := range lexer.Tokenize(item) {
+		switch {
+		case t.Text == "(":
+			depth++
+		case t.Text == ")":
+			depth--
+		}
+		if t.Kind != lexer.Space && t.Kind != lexer.Comment && (depth == 0 || t.Text == "(") {
+			tokens = append(tokens, t)
+		}
+	}
+
+	n := len(tokens)
+	if n >= 2 && isNameToken(tokens[n-1]) {
+		prev := tokens[n-2]
+		if prev.Kind == lexer.Word && strings.EqualFold(prev.Text, "AS") {
+			return selectItem{expr: strings.TrimSpace(item[:prev.Pos]), name: tokens[n-1].Text}
+		}
+		if isColumnRef(tokens[:n-1]) {
+			return selectItem{expr: strings.TrimSpace(item[:tokens[n-1].Pos]), name: tokens[n-1].Text}
+		}
+	}
+	if isColumnRef(tokens) {
+		return selectItem{expr: item, name: tokens[n-1].Text}
+	}
+	return selectItem{expr: item}
+}
+
+// isNameToken reports whether t is an identifier, quoted or not.
+func isNameToken(t lexer.Token) bool {
+	return t.Kind == lexer.Ident || t.Kind == lexer.Word && (t.Text[0] < '0' || t.Text[0] > '9')
+}
+
+// isColumnRef reports whether tokens are a possibly qualified column reference,
+// e.g. "t.id".
+func isColumnRef(tokens []lexer.Token) bool {
+	if len(tokens)%2 == 0 {
+		return false
+	}
+	for i, t := range tokens {
+		if i%2 == 0 && !isNameToken(t) || i%2 == 1 && t.Text != "." {
+			return false
+		}
+	}
+	return true
+}
+
+// findSelectItem returns the position in items of column, matched by expression
+// or by output name, or -1.
+func findSelectItem(items []selectItem, column string) int {
+	for i, item := range items {
+		if sameExpr(item.expr, column) {
+			return i
+		}
+	}
+	for i, item := range items {
+		if item.name != "" && strings.EqualFold(unquote(item.name), unquote(unqualified(column))) {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasStarItem reports whether items select "*" or "t.*".
+func hasStarItem(items []selectItem) bool {
+	for _, item := range items {
+		if strings.HasSuffix(item.expr, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// sameExpr reports whether a and b are the same expression, ignoring case and
+// whitespace.
+func sameExpr(a, b string) bool {
+	return strings.EqualFold(strings.Join(strings.Fields(a), ""), strings.Join(strings.Fields(b), ""))
+}
+
+// unparenthesize returns query without the parentheses enclosing all of it, e.g.
+// a branch written "(SELECT ... LIMIT 5)".
+func unparenthesize(query string) string {
+	masked := lexer.Mask(query)
+	if !strings.HasPrefix(masked, "(") || !strings.HasSuffix(masked, ")") {
+		return query
+	}
+	depth := 0
+	for i := 0; i < len(masked)-1; i++ {
+		switch masked[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+		if depth == 0 {
+			return query
+		}
+	}
+	return strings.TrimSpace(query[1 : len(query)-1])
+}
+
+// unqualified returns the column name of a possibly qualified column.
+func unqualified(column string) string {
+	return column[strings.LastIndex(column, ".")+1:]
+}
+
+// unquote returns name without its identifier quotes.
+func unquote(name string) string {
+	return strings.Trim(name, "`\"[]")
+}
@@ -0,0 +1,158 @@
+package kuysor
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/redhajuanda/kuysor/internal/lexer"
+)
+
+// namedArgTag is the struct tag read by WithNamedArgs, the same one sqlx uses.
+const namedArgTag = "db"
+
+// namedInjectedPrefix prefixes the names generated for the cursor, LIMIT and
+// OFFSET placeholders injected by kuysor when the output is named.
+const namedInjectedPrefix = "kuysor_"
+
+// namedParam is a named placeholder found in the user query.
+type namedParam struct {
+	prefix byte // ':' or '@'
+	name   string
+}
+
+// bindNamedArgs replaces the :name and @name placeholders of query with markers
+// and looks their values up in arg, a map[string]any or a struct (or pointer to
+// one) whose fields are named by their "db" tag or their lowercased name.
+// A name used several times binds the same value at each occurrence.
+func bindNamedArgs(query string, arg any) (*markedQuery, error) {
+
+	values, err := namedValues(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, token := range tokenizeQuery(query) {
+		if token.tokenType == "placeholder" && token.value != defaultInternalPlaceHolder {
+			return nil, fmt.Errorf("cannot mix positional placeholder %q with named args", token.value)
+		}
+	}
+
+	var (
+		nq   = &markedQuery{}
+		sb   strings.Builder
+		last int
+	)
+	for _, param := range scanNamedParams(query) {
+		value, ok := values[param.name]
+		if !ok {
+			return nil, fmt.Errorf("missing named argument %q", param.name)
+		}
+		sb.WriteString(query[last:param.start])
+		sb.WriteString(userPlaceholderMarker + strconv.Itoa(len(nq.args)))
+		last = param.end
+		nq.params = append(nq.params, namedParam{prefix: query[param.start], name: param.name})
+		nq.args = append(nq.args, value)
+	}
+	sb.WriteString(query[last:])
+	nq.query = sb.String()
+
+	return nq, nil
+
+}
+
+// namedParamPos is the position of a named placeholder in a query.
+type namedParamPos struct {
+	start, end int
+	name       string
+}
+
+// scanNamedParams finds the :name and @name placeholders of query. Quoted strings,
+// comments, casts (::type), system variables (@@var) and the positional @pN
+// placeholders are skipped by the lexer.
+func scanNamedParams(query string) []namedParamPos {
+
+	var params []namedParamPos
+	for _, t := range lexer.Tokenize(query) {
+		if t.Kind == lexer.Named {
+			params = append(params, namedParamPos{start: t.Pos, end: t.Pos + len(t.Text), name: t.Text[1:]})
+		}
+	}
+	return params
+
+}
+
+// namedValues returns the values of a map[string]any, or of the fields of a struct
+// (or pointer to one) keyed by their "db" tag or lowercased name. Fields tagged
+// "-" and unexported fields are ignored; embedded structs are flattened.
+func namedValues(arg any) (map[string]any, error) {
+
+	if m, ok := arg.(map[string]any); ok {
+		return m, nil
+	}
+
+	v := reflect.ValueOf(arg)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, errors.New("named args must not be a nil pointer")
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("named args must be a map[string]any or a struct, got %T", arg)
+	}
+
+	values := make(map[string]any)
+	collectNamedValues(v, values)
+	return values, nil
+
+}
+
+// collectNamedValues adds the fields of the struct v to values. Fields of the
+// outer struct win over those of embedded structs.
+func collectNamedValues(v reflect.Value, values map[string]any) {
+
+	t := v.Type()
+	var embedded []reflect.Value
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fieldValue := v.Field(i)
+		tag := field.Tag.Get(namedArgTag)
+
+		if tag == "-" {
+			continue
+		}
+		if field.Anonymous && tag == "" {
+			if fieldValue.Kind() == reflect.Ptr && !fieldValue.IsNil() {
+				fieldValue = fieldValue.Elem()
+			}
+			if fieldValue.Kind() == reflect.Struct {
+				embedded = append(embedded, fieldValue)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		values[name] = fieldValue.Interface()
+	}
+
+	for _, e := range embedded {
+		inner := make(map[string]any)
+		collectNamedValues(e, inner)
+		for name, value := range inner {
+			if _, ok := values[name]; !ok {
+				values[name] = value
+			}
+		}
+	}
+
+}
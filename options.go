@@ -1,10 +1,147 @@
 package kuysor
 
+import (
+	"fmt"
+	"time"
+
+	"github.com/redhajuanda/kuysor/modifier"
+)
+
+// Format is the layout of the generated SQL.
+type Format uint8
+
+const (
+	// Compact collapses whitespace into single spaces. A line comment is closed by
+	// a newline so it does not comment out the rest of the query.
+	Compact Format = iota
+	// Preserve splices the generated clauses into the original query text and
+	// keeps its line breaks, indentation and comments.
+	Preserve
+	// Pretty compacts the query and puts every main clause on its own line, with
+	// subqueries indented.
+	Pretty
+)
+
+// ClausePolicy decides what happens to an ORDER BY, LIMIT, OFFSET or FETCH clause
+// that the query already has when kuysor sets its own.
+type ClausePolicy uint8
+
+const (
+	// ReplaceClauses replaces the existing clauses. The args bound by their
+	// placeholders are dropped, so the args after them stay aligned.
+	ReplaceClauses ClausePolicy = iota
+	// RejectClauses makes Build fail with an error wrapping ErrExistingClause.
+	RejectClauses
+	// KeepExistingSort keeps the terms of an existing ORDER BY after the sort set by
+	// WithOrderBy, as a secondary sort. LIMIT, OFFSET and FETCH are replaced.
+	KeepExistingSort
+)
+
+// modifierClausePolicy converts the clause policy for the modifier.
+func modifierClausePolicy(policy ClausePolicy) (modifier.ClausePolicy, error) {
+	switch policy {
+	case ReplaceClauses:
+		return modifier.ReplaceClause, nil
+	case RejectClauses:
+		return modifier.RejectClause, nil
+	case KeepExistingSort:
+		return modifier.KeepOrderBy, nil
+	}
+	return 0, fmt.Errorf("unsupported clause policy: %d", policy)
+}
+
 type Options struct {
+	// Dialect describes the SQL syntax of the database. When set, it supplies the
+	// placeholder type and null sort method unless those are set explicitly. A
+	// field left at its zero value (Question, BoolSort) can't be told apart from an
+	// unset one, so use Options.WithPlaceHolderType or Options.WithNullSortMethod
+	// to override the dialect with it.
+	Dialect         Dialect
 	PlaceHolderType PlaceHolderType
 	DefaultLimit    int
 	StructTag       string
 	NullSortMethod  NullSortMethod
+	// ForeignKeys are schema hints used by NewCount to remove INNER JOINs that
+	// cannot change the count. See ForeignKey.
+	ForeignKeys []ForeignKey
+	// TotalCountMaxAge enables carrying the total count inside the cursor. A total
+	// passed to Result.SetTotal is embedded in the generated cursors, and later
+	// pages reuse it through Result.CachedTotal until it is older than this age.
+	// Zero disables it.
+	TotalCountMaxAge time.Duration
+	// RangeGuard adds a redundant range predicate on the first sort column to the
+	// cursor condition of multi-column sorts, e.g. "a >= ? AND ((a > ?) OR (a = ?
+	// AND b > ?))", so MySQL can use an index range scan. Row-value conditions
+	// get it too: "a >= ? AND (a, b) > (?, ?)".
+	RangeGuard bool
+	// StableShape makes every page render the same SQL, so prepared-statement
+	// caches and query digests see one statement per endpoint. The keyset
+	// conditions and ORDER BY terms of both directions are always emitted behind
+	// a bound direction, NULL on the first page, 0 on next pages and 1 on
+	// previous pages, cast to DECIMAL so its type is known. Such an ORDER BY
+	// cannot be served by an index.
+	StableShape bool
+	// ExpandSlices expands a slice arg into one placeholder per element, so
+	// "id IN (?)" with []int{1, 2, 3} becomes "id IN (?, ?, ?)" bound to 1, 2, 3.
+	// []byte and driver.Valuer args are bound as is. An empty slice is an error.
+	ExpandSlices bool
+	// UnionPushDown repeats the cursor condition, ORDER BY and LIMIT of the page
+	// inside every branch of a main-level UNION, so that each branch reads at most
+	// one page before the union is sorted. A main-level UNION is always paginated as
+	// a whole, wrapped in a derived table; this only adds the per-branch filters.
+	UnionPushDown bool
+	// Format is the layout of the generated SQL, Compact by default. See Format.
+	Format Format
+	// ClausePolicy decides what happens to the ORDER BY, LIMIT, OFFSET and FETCH
+	// clauses of the query when kuysor sets its own. See ClausePolicy.
+	ClausePolicy ClausePolicy
+
+	// placeHolderTypeSet and nullSortMethodSet record an explicit override, which
+	// wins over the dialect even when set to the zero value.
+	placeHolderTypeSet bool
+	nullSortMethodSet  bool
+}
+
+// WithPlaceHolderType returns a copy of the options with the placeholder type set
+// explicitly, so it wins over the dialect even when it is Question.
+func (o Options) WithPlaceHolderType(placeHolderType PlaceHolderType) Options {
+	o.PlaceHolderType = placeHolderType
+	o.placeHolderTypeSet = true
+	return o
+}
+
+// WithNullSortMethod returns a copy of the options with the null sort method set
+// explicitly, so it wins over the dialect even when it is BoolSort.
+func (o Options) WithNullSortMethod(method NullSortMethod) Options {
+	o.NullSortMethod = method
+	o.nullSortMethodSet = true
+	return o
+}
+
+// placeHolderType returns the placeholder type to render with. An explicit
+// PlaceHolderType wins over the dialect's.
+func (o *Options) placeHolderType() PlaceHolderType {
+	if o.Dialect == nil || o.placeHolderTypeSet || o.PlaceHolderType != Question {
+		return o.PlaceHolderType
+	}
+	return o.Dialect.PlaceHolderType()
+}
+
+// nullSortMethod returns the method used to order nullable sort columns. An
+// explicit NullSortMethod wins over the dialect's.
+func (o *Options) nullSortMethod() NullSortMethod {
+	if o.Dialect == nil || o.nullSortMethodSet || o.NullSortMethod != BoolSort {
+		return o.NullSortMethod
+	}
+	return o.Dialect.NullSortMethod()
+}
+
+// limitSyntax returns the syntax used to limit and skip rows.
+func (o *Options) limitSyntax() LimitSyntax {
+	if o.Dialect == nil {
+		return LimitOffsetSyntax
+	}
+	return o.Dialect.LimitSyntax()
 }
 
 var (
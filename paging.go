@@ -8,12 +8,13 @@ type uPaging struct {
 	ColumnID       string      // only used for cursor pagination
 	CTETarget      string      // optional: name of the primary CTE whose body should be paginated
 	CTEOptions     *CTEOptions // optional: per-clause routing when CTETarget is set
+	SubqueryTarget bool        // optional: CTETarget is the alias of a derived table, see WithSubqueryTarget
+	Locking        LockMode    // optional: locking clause added after LIMIT, see WithLocking
 	// SecondaryCTEs are ADDITIONAL CTE bodies that also receive the cursor WHERE,
-	// ORDER BY, and LIMIT (in addition to the primary CTETarget). They are injected
-	// before the primary so placeholder args stay in query-string order; each
-	// secondary CTE must therefore be defined BEFORE the primary CTE in the WITH
-	// clause. Only the ColumnMap of their options is honored — the clauses are
-	// always injected into the CTE body, never mirrored on the main query.
+	// ORDER BY, and LIMIT (in addition to the primary CTETarget), wherever they are
+	// defined in the WITH clause. Only the ColumnMap and InferColumnMap of their
+	// options are honored — the clauses are always injected into the CTE body,
+	// never mirrored on the main query.
 	SecondaryCTEs []secondaryCTE
 }
 
@@ -1,8 +1,16 @@
 package kuysor
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+
+	"github.com/redhajuanda/kuysor/internal/lexer"
 )
 
 type PlaceHolderType uint8
@@ -14,23 +22,6 @@ const (
 	Colon
 )
 
-// findOrderOfInternalPlaceholders finds the indices of internal placeholders
-// Returns the indices where internal placeholder appears in the order of all parameters
-func findOrderOfInternalPlaceholders(query string) []int {
-	tokens := tokenizeQuery(query)
-	var indices []int
-	currentParam := 0
-	for _, token := range tokens {
-		if token.tokenType == "placeholder" {
-			if token.value == defaultInternalPlaceHolder {
-				indices = append(indices, currentParam)
-			}
-			currentParam++
-		}
-	}
-	return indices
-}
-
 // replacePlaceholders replaces internal placeholders with the appropriate placeholders
 // based on the placeholder type
 func replacePlaceholders(query string, placeholderType PlaceHolderType) string {
@@ -111,126 +102,353 @@ func replacePlaceholders(query string, placeholderType PlaceHolderType) string {
 	return result
 }
 
-// extractNumber extracts a number from a string
-func extractNumber(s string) int {
-	var num int
-	fmt.Sscanf(s, "%d", &num)
-	return num
+// userPlaceholderMarker prefixes the identifiers that stand in for user
+// placeholders while a query is rewritten (see markUserPlaceholders).
+const userPlaceholderMarker = "kuysor_arg_"
+
+var userPlaceholderMarkerRe = regexp.MustCompile(`\b` + userPlaceholderMarker + `(\d+)\b`)
+
+// markUserPlaceholders replaces every user placeholder with a marker naming the
+// argument it binds, so that args can be realigned after a rewrite drops or
+// repeats parts of the query. Numbered placeholders ($n, @pn, :n) bind argument
+// n; "?" placeholders bind the arguments in order. A query that mixes placeholder
+// styles is an error, as its args can't be aligned.
+func markUserPlaceholders(query string) (string, error) {
+
+	var (
+		sb       strings.Builder
+		last     int
+		question int
+	)
+
+	if err := checkPlaceholderStyle(query); err != nil {
+		return "", err
+	}
+
+	for _, token := range tokenizeQuery(query) {
+		if token.tokenType != "placeholder" || token.value == defaultInternalPlaceHolder {
+			continue
+		}
+
+		var idx int
+		switch {
+		case token.value == "?":
+			idx = question
+			question++
+		case strings.HasPrefix(token.value, "@p"):
+			idx = extractNumber(token.value[2:]) - 1
+		default: // $n and :n
+			idx = extractNumber(token.value[1:]) - 1
+		}
+
+		sb.WriteString(query[last:token.position])
+		sb.WriteString(userPlaceholderMarker + strconv.Itoa(idx))
+		last = token.position + len(token.value)
+	}
+	sb.WriteString(query[last:])
+
+	return sb.String(), nil
 }
 
-// Token represents a token in the SQL query
-type Token struct {
-	position  int
-	value     string
-	tokenType string
+// checkPlaceholderStyle returns an error when query mixes placeholder styles,
+// e.g. "?" with "$1": "?" binds the args in order and $n binds arg n, so the
+// args of such a query are ambiguous.
+func checkPlaceholderStyle(query string) error {
+
+	var first string
+	for _, token := range tokenizeQuery(query) {
+		if token.tokenType != "placeholder" || token.value == defaultInternalPlaceHolder {
+			continue
+		}
+		style := placeholderStyle(token.value)
+		if first == "" {
+			first = token.value
+		} else if style != placeholderStyle(first) {
+			return fmt.Errorf("query mixes placeholder styles: %s and %s", first, token.value)
+		}
+	}
+	return nil
+
 }
 
-// tokenizeQuery breaks down a SQL query into tokens
-func tokenizeQuery(query string) []Token {
-	var tokens []Token
-	i := 0
-	for i < len(query) {
-		if i < len(query) && (query[i] == '\'' || query[i] == '"' || query[i] == '`') {
-			quoteChar := query[i]
-			startPos := i
-			i++
-			escaped := false
-			for i < len(query) && (query[i] != quoteChar || escaped) {
-				escaped = query[i] == '\\' && !escaped
-				i++
+// placeholderStyle returns the prefix of a user placeholder: "?", "$", "@p" or ":".
+func placeholderStyle(placeholder string) string {
+	switch {
+	case placeholder == "?":
+		return "?"
+	case strings.HasPrefix(placeholder, "@p"):
+		return "@p"
+	default:
+		return placeholder[:1]
+	}
+}
+
+// markedQuery is a user query whose placeholders were replaced by the markers of
+// markUserPlaceholders (or by bindNamedArgs for named placeholders). A marker
+// dropped while the query is rewritten, e.g. with a replaced LIMIT clause, drops
+// its arg too.
+type markedQuery struct {
+	query  string
+	params []namedParam // indexed by marker number, named placeholders only
+	args   []any        // indexed by marker number
+}
+
+// render replaces the markers left in query with internal placeholders and
+// returns the args bound by all of them, in order. vArgs are the values of the
+// internal placeholders already in query, in order. When named is true, the user
+// placeholders keep their names, the internal ones are named kuysor_1, kuysor_2,
+// ... with prefix, and the args are sql.NamedArg values, one per name. When expand
+// is also true, a named placeholder bound to a slice becomes one placeholder per
+// element, named name_1, name_2, ..., see expandSliceArgs.
+func (nq *markedQuery) render(query string, vArgs []any, prefix byte, named, expand bool) (string, []any, error) {
+
+	var (
+		sb       strings.Builder
+		args     []any
+		last     int
+		internal int
+		seen     = make(map[string]bool)
+		markers  = userPlaceholderMarkerRe.FindAllStringSubmatchIndex(query, -1)
+		marker   = 0
+	)
+
+	write := func(start, end int, placeholder string, name string, value any) error {
+		sb.WriteString(query[last:start])
+		last = end
+		if !named {
+			sb.WriteString(defaultInternalPlaceHolder)
+			args = append(args, value)
+			return nil
+		}
+		v := reflect.ValueOf(value)
+		if !expand || !isExpandable(value, v) {
+			sb.WriteString(placeholder)
+			if !seen[name] {
+				seen[name] = true
+				args = append(args, sql.Named(name, value))
 			}
-			if i < len(query) {
-				i++
+			return nil
+		}
+		if v.Len() == 0 {
+			return fmt.Errorf("empty slice argument for placeholder %s", placeholder)
+		}
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			suffix := "_" + strconv.Itoa(i+1)
+			sb.WriteString(placeholder + suffix)
+			if !seen[name+suffix] {
+				seen[name+suffix] = true
+				args = append(args, sql.Named(name+suffix, v.Index(i).Interface()))
 			}
-			tokens = append(tokens, Token{
-				position:  startPos,
-				value:     query[startPos:i],
-				tokenType: "quoted",
-			})
-			continue
 		}
-		if i < len(query)-1 && query[i] == '$' && query[i+1] == '0' {
-			tokens = append(tokens, Token{
-				position:  i,
-				value:     defaultInternalPlaceHolder,
-				tokenType: "placeholder",
-			})
-			i += 2
-			continue
+		return nil
+	}
+	writeMarker := func() error {
+		idx, _ := strconv.Atoi(query[markers[marker][2]:markers[marker][3]])
+		var placeholder, name string
+		if named {
+			param := nq.params[idx]
+			placeholder, name = string(param.prefix)+param.name, param.name
 		}
-		if i < len(query) && query[i] == '?' {
-			tokens = append(tokens, Token{
-				position:  i,
-				value:     "?",
-				tokenType: "placeholder",
-			})
-			i++
+		marker++
+		return write(markers[marker-1][0], markers[marker-1][1], placeholder, name, nq.args[idx])
+	}
+
+	for _, token := range tokenizeQuery(query) {
+		if token.tokenType != "placeholder" || token.value != defaultInternalPlaceHolder {
 			continue
 		}
-		if i < len(query)-1 && query[i] == '$' && isDigit(query[i+1]) {
-			startPos := i
-			i++
-			for i < len(query) && isDigit(query[i]) {
-				i++
+		for marker < len(markers) && markers[marker][0] < token.position {
+			if err := writeMarker(); err != nil {
+				return "", nil, err
 			}
-			tokens = append(tokens, Token{
-				position:  startPos,
-				value:     query[startPos:i],
-				tokenType: "placeholder",
-			})
-			continue
 		}
-		if i < len(query)-2 && query[i] == '@' && query[i+1] == 'p' && i+2 < len(query) && isDigit(query[i+2]) {
-			startPos := i
-			i += 2
-			for i < len(query) && isDigit(query[i]) {
-				i++
+		if internal >= len(vArgs) {
+			return "", nil, errors.New("missing value for an injected placeholder")
+		}
+		name := namedInjectedPrefix + strconv.Itoa(internal+1)
+		if err := write(token.position, token.position+len(token.value), string(prefix)+name, name, vArgs[internal]); err != nil {
+			return "", nil, err
+		}
+		internal++
+	}
+	for marker < len(markers) {
+		if err := writeMarker(); err != nil {
+			return "", nil, err
+		}
+	}
+	sb.WriteString(query[last:])
+
+	return sb.String(), args, nil
+
+}
+
+// prefix returns the prefix of the generated names: the one used by the query,
+// or the one matching the placeholder type when the query has no named params.
+func (nq *markedQuery) prefix(placeholderType PlaceHolderType) byte {
+	if len(nq.params) > 0 {
+		return nq.params[0].prefix
+	}
+	if placeholderType == At {
+		return '@'
+	}
+	return ':'
+}
+
+// restoreUserPlaceholders turns the markers left in query by markUserPlaceholders
+// back into placeholders of the given type and returns the args they bind, in
+// placeholder order.
+func restoreUserPlaceholders(query string, args []any, placeholderType PlaceHolderType) (string, []any, error) {
+
+	var (
+		outArgs = make([]any, 0, len(args))
+		err     error
+	)
+
+	query = userPlaceholderMarkerRe.ReplaceAllStringFunc(query, func(marker string) string {
+		idx, _ := strconv.Atoi(strings.TrimPrefix(marker, userPlaceholderMarker))
+		if idx < 0 || idx >= len(args) {
+			if err == nil {
+				err = fmt.Errorf("missing argument for placeholder #%d: got %d args", idx+1, len(args))
 			}
-			tokens = append(tokens, Token{
-				position:  startPos,
-				value:     query[startPos:i],
-				tokenType: "placeholder",
-			})
+			return marker
+		}
+		outArgs = append(outArgs, args[idx])
+		return defaultInternalPlaceHolder
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return replacePlaceholders(query, placeholderType), outArgs, nil
+}
+
+// countUserArgs returns the number of args bound by the user placeholders of
+// query: one per "?", plus the highest number among $n, @pn and :n, which may be
+// used several times. A query that mixes placeholder styles is an error.
+func countUserArgs(query string) (int, error) {
+
+	if err := checkPlaceholderStyle(query); err != nil {
+		return 0, err
+	}
+
+	var question, numbered int
+	for _, token := range tokenizeQuery(query) {
+		if token.tokenType != "placeholder" || token.value == defaultInternalPlaceHolder {
 			continue
 		}
-		// Colon placeholder support
-		if i < len(query)-1 && query[i] == ':' && isDigit(query[i+1]) {
-			startPos := i
-			i++
-			for i < len(query) && isDigit(query[i]) {
-				i++
-			}
-			tokens = append(tokens, Token{
-				position:  startPos,
-				value:     query[startPos:i],
-				tokenType: "placeholder",
-			})
+		if token.value == "?" {
+			question++
 			continue
 		}
-		startPos := i
-		for i < len(query) &&
-			!(query[i] == '\'' || query[i] == '"' || query[i] == '`') &&
-			!(i < len(query)-1 && query[i] == '$' && query[i+1] == '0') &&
-			!(query[i] == '?') &&
-			!(i < len(query)-1 && query[i] == '$' && isDigit(query[i+1])) &&
-			!(i < len(query)-2 && query[i] == '@' && query[i+1] == 'p' && i+2 < len(query) && isDigit(query[i+2])) &&
-			!(i < len(query)-1 && query[i] == ':' && isDigit(query[i+1])) {
-			i++
-		}
-		if i > startPos {
-			tokens = append(tokens, Token{
-				position:  startPos,
-				value:     query[startPos:i],
-				tokenType: "text",
-			})
-		} else {
-			i++
+		numbered = max(numbered, placeholderNumber(token.value))
+	}
+	return question + numbered, nil
+
+}
+
+// placeholderNumber returns n for the numbered placeholders $n, @pn and :n.
+func placeholderNumber(placeholder string) int {
+	if strings.HasPrefix(placeholder, "@p") {
+		return extractNumber(placeholder[2:])
+	}
+	return extractNumber(placeholder[1:])
+}
+
+// expandSliceArgs replaces each placeholder bound to a slice arg with one internal
+// placeholder per element and flattens the slice into args. args must be aligned
+// with the placeholders of query, in order. []byte and driver.Valuer args, such as
+// pq.Array, are bound as is.
+func expandSliceArgs(query string, args []any) (string, []any, error) {
+
+	var (
+		sb       strings.Builder
+		outArgs  = make([]any, 0, len(args))
+		last     int
+		argIndex int
+	)
+
+	for _, token := range tokenizeQuery(query) {
+		if token.tokenType != "placeholder" {
+			continue
 		}
+		if argIndex >= len(args) {
+			break
+		}
+		arg := args[argIndex]
+		argIndex++
+
+		v := reflect.ValueOf(arg)
+		if !isExpandable(arg, v) {
+			outArgs = append(outArgs, arg)
+			continue
+		}
+		if v.Len() == 0 {
+			return "", nil, fmt.Errorf("empty slice argument for placeholder #%d", argIndex)
+		}
+
+		sb.WriteString(query[last:token.position])
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(defaultInternalPlaceHolder)
+			outArgs = append(outArgs, v.Index(i).Interface())
+		}
+		last = token.position + len(token.value)
 	}
-	return tokens
+	sb.WriteString(query[last:])
+
+	return sb.String(), append(outArgs, args[argIndex:]...), nil
+
+}
+
+// isExpandable reports whether arg is a slice or array to expand.
+func isExpandable(arg any, v reflect.Value) bool {
+	if _, ok := arg.(driver.Valuer); ok {
+		return false
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		return v.Type().Elem().Kind() != reflect.Uint8
+	case reflect.Array:
+		return true
+	}
+	return false
+}
+
+// extractNumber extracts a number from a string
+func extractNumber(s string) int {
+	var num int
+	fmt.Sscanf(s, "%d", &num)
+	return num
 }
 
-// Helper function to check if a character is a digit
-func isDigit(c byte) bool {
-	return c >= '1' && c <= '9'
+// Token represents a token in the SQL query
+type Token struct {
+	position  int
+	value     string
+	tokenType string
+}
+
+// tokenizeQuery breaks down a SQL query into tokens using the shared lexer, so
+// placeholders inside string literals, comments and quoted identifiers are ignored.
+// Placeholders are "placeholder" tokens, literals and quoted identifiers are
+// "quoted" tokens, and everything else is "text".
+func tokenizeQuery(query string) []Token {
+	lexed := lexer.Tokenize(query)
+	tokens := make([]Token, 0, len(lexed))
+	for _, t := range lexed {
+		tokenType := "text"
+		switch t.Kind {
+		case lexer.Placeholder:
+			tokenType = "placeholder"
+		case lexer.String, lexer.Ident:
+			tokenType = "quoted"
+		}
+		tokens = append(tokens, Token{position: t.Pos, value: t.Text, tokenType: tokenType})
+	}
+	return tokens
 }
@@ -1,9 +1,11 @@
 package kuysor
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"reflect"
+	"time"
 )
 
 // Result represents the result of a query.
@@ -11,6 +13,91 @@ type Result struct {
 	Query string
 	Args  []any
 	ks    *Kuysor
+	total *int64 // total set by SetTotal, embedded in the generated cursors
+}
+
+// NamedArgs returns Args as sql.NamedArg values named p1, p2, ..., matching the
+// At placeholder type (@p1, @p2, ...). Use it with drivers that bind parameters by
+// name, such as SQL Server's. Args that are already sql.NamedArg values, as with
+// WithNamedOutput, are returned as is.
+func (r *Result) NamedArgs() []any {
+	named := make([]any, len(r.Args))
+	for i, arg := range r.Args {
+		if arg, ok := arg.(sql.NamedArg); ok {
+			named[i] = arg
+			continue
+		}
+		named[i] = sql.Named(fmt.Sprintf("p%d", i+1), arg)
+	}
+	return named
+}
+
+// ArgsMap returns NamedArgs as a map from name to value, e.g. for sqlx.NamedQuery
+// with a query built using WithNamedOutput.
+func (r *Result) ArgsMap() map[string]any {
+	args := make(map[string]any, len(r.Args))
+	for _, arg := range r.NamedArgs() {
+		arg := arg.(sql.NamedArg)
+		args[arg.Name] = arg.Value
+	}
+	return args
+}
+
+// now returns the current time; it is a variable so tests can control the clock.
+var now = time.Now
+
+// SetTotal records a freshly computed total row count. When a total count max age
+// is set, the total and the current time are embedded in the cursors generated by
+// SanitizeMap / SanitizeStruct, so later pages can reuse it via CachedTotal.
+// Call it before sanitizing the data.
+func (r *Result) SetTotal(total int64) {
+	r.total = &total
+}
+
+// CachedTotal returns the total row count carried by the request cursor.
+// ok is false when no total count max age is set, on the first page, when the
+// cursor carries no total, or when the total is older than the max age — in those
+// cases the count query should be run and its result passed to SetTotal.
+// The cursor is client-supplied, so treat the total as informational only.
+func (r *Result) CachedTotal() (total int64, ok bool) {
+
+	maxAge := r.ks.options.TotalCountMaxAge
+	if maxAge <= 0 || r.ks.vTabling == nil {
+		return 0, false
+	}
+
+	vcursor := r.ks.vTabling.vCursor
+	if vcursor == nil || vcursor.Total == nil {
+		return 0, false
+	}
+
+	if now().Sub(time.Unix(vcursor.CountedAt, 0)) > maxAge {
+		return 0, false
+	}
+
+	return *vcursor.Total, true
+}
+
+// stampTotal embeds the total count in the generated cursor: a total set by
+// SetTotal is stamped with the current time, otherwise a still-fresh cached
+// total is carried forward with its original timestamp.
+func (r *Result) stampTotal(c *vCursor) {
+
+	if r.ks.options.TotalCountMaxAge <= 0 {
+		return
+	}
+
+	if r.total != nil {
+		total := *r.total
+		c.Total = &total
+		c.CountedAt = now().Unix()
+		return
+	}
+
+	if total, ok := r.CachedTotal(); ok {
+		c.Total = &total
+		c.CountedAt = r.ks.vTabling.vCursor.CountedAt
+	}
 }
 
 // SanitizeMap handles the map data for the cursor pagination.
@@ -185,6 +272,19 @@ func (r *Result) generateCursor(totalData int, limit int, isFirstPage bool, vcur
 		next, prev string
 	)
 
+	r.stampTotal(cursorNext)
+	r.stampTotal(cursorPrev)
+
+	// a locked batch is fetched without the extra row, so the next cursor resumes
+	// after the last claimed row whenever the batch has rows
+	if r.ks.uTabling.uPaging.Locking != NoLock {
+		nextB64, err := cursorNext.generateCursorBase64()
+		if err != nil {
+			return next, prev, err
+		}
+		return string(nextB64), prev, nil
+	}
+
 	if (totalData > limit) || (vcursor.Prefix.isPrev() && totalData <= limit) {
 		nextB64, err := cursorNext.generateCursorBase64()
 		if err != nil {
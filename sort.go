@@ -24,12 +24,20 @@ const (
 	CaseWhen                 = iota
 )
 
+// sortExpr is the SQL expression of a sort key, see WithSortExpr.
+type sortExpr struct {
+	expr      string
+	aggregate bool
+}
+
 type vSort struct {
 	prefix         string
 	column         string
 	nullable       bool
 	nullSortMethod NullSortMethod
 	direction      orderDirection
+	expr           string // SQL expression of the column, when it is a sort key
+	aggregate      bool   // expr is an aggregate, e.g. SUM(o.amount)
 }
 
 // isNullable returns true if the sort is nullable.
@@ -65,6 +73,39 @@ func (s *vSort) extractColumn() (qualifier string, column string, err error) {
 
 type vSorts []vSort
 
+// hasAggregate reports whether a sort is on an aggregate expression.
+func (s vSorts) hasAggregate() bool {
+	for _, vSort := range s {
+		if vSort.aggregate {
+			return true
+		}
+	}
+	return false
+}
+
+// exprColumns returns colMap with the sort keys mapped to their expressions.
+func (s vSorts) exprColumns(colMap map[string]string) map[string]string {
+
+	var merged map[string]string
+	for _, vSort := range s {
+		if vSort.expr == "" {
+			continue
+		}
+		if merged == nil {
+			merged = make(map[string]string, len(colMap)+len(s))
+			for column, mapped := range colMap {
+				merged[column] = mapped
+			}
+		}
+		merged[vSort.column] = vSort.expr
+	}
+
+	if merged == nil {
+		return colMap
+	}
+	return merged
+}
+
 // reverseDirection reverses the direction of the vSorts.
 func (s vSorts) reverseDirection() vSorts {
 
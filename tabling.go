@@ -1,8 +1,9 @@
 package kuysor
 
 type uTabling struct {
-	uPaging *uPaging
-	uSort   *uSort
+	uPaging   *uPaging
+	uSort     *uSort
+	sortExprs map[string]sortExpr // expressions of the sort keys, see WithSortExpr
 }
 
 type vTabling struct {
@@ -52,6 +53,11 @@ type CTEOptions struct {
 	// "ORDER BY id DESC" / "id < ?" inside the CTE while the main query keeps
 	// "t.id". A nil map leaves all behavior unchanged.
 	ColumnMap map[string]string
+	// InferColumnMap fills in the ColumnMap entries of the sort columns it does not
+	// list, by matching each column against the SELECT list and FROM aliases of the
+	// CTE body, e.g. "t.id" maps to "id" in "SELECT id FROM ticket". Build fails when
+	// a column cannot be matched, or matches several columns (ErrAmbiguousColumn).
+	InferColumnMap bool
 }
 
 // cteColumnMap returns the per-CTE column remap, or nil when unset.